@@ -7,6 +7,25 @@ type ArkivIngester interface {
 	Ingest(ctx context.Context, record IngestRecord) error
 }
 
+// BatchIngester is implemented by backends that can write many records in one round trip.
+// Like Ingest, IngestBatch must be idempotent: already-stored keys are skipped.
+type BatchIngester interface {
+	ArkivIngester
+	IngestBatch(ctx context.Context, records []IngestRecord) error
+}
+
+// Fetcher reads blocks from a chain source. Head is the latest block available to FetchBlock.
+type Fetcher interface {
+	Head(ctx context.Context) (uint64, error)
+	FetchBlock(ctx context.Context, number uint64) (*IngestRecord, error)
+}
+
+// headSubscriber is implemented by fetchers that can push new heads instead of being polled.
+// The channel is closed when the subscription ends; the scheduler then falls back to polling.
+type headSubscriber interface {
+	SubscribeHeads(ctx context.Context) (<-chan uint64, error)
+}
+
 // IngestRecord holds chain data for one block; IdempotencyKey deduplicates.
 type IngestRecord struct {
 	IdempotencyKey string
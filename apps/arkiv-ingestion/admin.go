@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminAPI serves runtime control of chain workers under /admin, for on-call during incidents.
+// Every request needs "Authorization: Bearer <ADMIN_TOKEN>"; without a token it isn't served.
+//
+//	GET  /admin/chains                      worker state of every chain
+//	GET  /admin/chains/{chain}
+//	POST /admin/chains/{chain}/pause        stop fetching after the current block
+//	POST /admin/chains/{chain}/resume
+//	POST /admin/chains/{chain}/reingest?from=&to=   re-fetch and overwrite stored blocks
+//	GET, PUT, DELETE /admin/faults          injected faults, with FAULT_INJECTION (see faultInjector)
+//
+// State is per replica: with leader election, send these to the chain's leader (see role).
+type adminAPI struct {
+	token       string
+	chains      map[string]*adminChain
+	maxReingest uint64         // largest range one re-ingest may cover
+	faults      *faultInjector // nil without FAULT_INJECTION
+	log         *slog.Logger
+}
+
+// adminChain is what the admin API controls for one chain.
+type adminChain struct {
+	state     *chainState
+	reingests chan<- blockRange // the chain scheduler's reingests; needs a buffer of 1
+}
+
+// adminChainStatus is a chain's worker state as reported by the admin API.
+type adminChainStatus struct {
+	ChainID      string          `json:"chain_id"`
+	Role         string          `json:"role,omitempty"`
+	Paused       bool            `json:"paused"`
+	Head         uint64          `json:"head"`
+	Next         uint64          `json:"next_block"`
+	Lag          uint64          `json:"lag_blocks"`
+	LastProgress time.Time       `json:"last_progress,omitempty"`
+	LastError    string          `json:"last_error,omitempty"`
+	Reingest     *reingestStatus `json:"reingest,omitempty"`
+}
+
+func statusOf(snap chainSnapshot) adminChainStatus {
+	return adminChainStatus{
+		ChainID: snap.ChainID, Role: snap.Role, Paused: snap.Paused, Head: snap.Head, Next: snap.Next,
+		Lag: snap.Lag(), LastProgress: snap.LastProgress, LastError: snap.LastError, Reingest: snap.Reingest,
+	}
+}
+
+func (a *adminAPI) register(mux *http.ServeMux) {
+	mux.Handle("GET /admin/chains", a.auth(a.list))
+	mux.Handle("GET /admin/chains/{chain}", a.auth(a.get))
+	mux.Handle("POST /admin/chains/{chain}/pause", a.auth(a.pause))
+	mux.Handle("POST /admin/chains/{chain}/resume", a.auth(a.resume))
+	mux.Handle("POST /admin/chains/{chain}/reingest", a.auth(a.reingest))
+	if a.faults != nil {
+		mux.Handle("GET /admin/faults", a.auth(a.getFaults))
+		mux.Handle("PUT /admin/faults", a.auth(a.setFaults))
+		mux.Handle("DELETE /admin/faults", a.auth(a.clearFaults))
+	}
+}
+
+func (a *adminAPI) auth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="arkiv-admin"`)
+			writeError(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// chain returns the chain named in the path, or writes 404.
+func (a *adminAPI) chain(w http.ResponseWriter, r *http.Request) *adminChain {
+	c := a.chains[r.PathValue("chain")]
+	if c == nil {
+		writeError(w, http.StatusNotFound, "unknown chain")
+	}
+	return c
+}
+
+func (a *adminAPI) list(w http.ResponseWriter, r *http.Request) {
+	out := make([]adminChainStatus, 0, len(a.chains))
+	for _, c := range a.chains {
+		out = append(out, statusOf(c.state.snapshot()))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ChainID < out[j].ChainID })
+	writeJSON(w, http.StatusOK, map[string]any{"chains": out})
+}
+
+func (a *adminAPI) get(w http.ResponseWriter, r *http.Request) {
+	if c := a.chain(w, r); c != nil {
+		writeJSON(w, http.StatusOK, statusOf(c.state.snapshot()))
+	}
+}
+
+func (a *adminAPI) pause(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, true)
+}
+
+func (a *adminAPI) resume(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, false)
+}
+
+func (a *adminAPI) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	c := a.chain(w, r)
+	if c == nil {
+		return
+	}
+	if c.state.setPaused(paused) {
+		a.log.Warn("admin: worker paused changed", "chain_id", c.state.chainID, "paused", paused, "remote", r.RemoteAddr)
+	}
+	writeJSON(w, http.StatusOK, statusOf(c.state.snapshot()))
+}
+
+func (a *adminAPI) reingest(w http.ResponseWriter, r *http.Request) {
+	c := a.chain(w, r)
+	if c == nil {
+		return
+	}
+	q := r.URL.Query()
+	from, errFrom := uintParam(q.Get("from"), 0)
+	to, errTo := uintParam(q.Get("to"), 0)
+	switch {
+	case q.Get("from") == "" || q.Get("to") == "" || errFrom != nil || errTo != nil:
+		writeError(w, http.StatusBadRequest, "from and to must be non-negative integers")
+		return
+	case from > to:
+		writeError(w, http.StatusBadRequest, "from must be <= to")
+		return
+	case to-from >= a.maxReingest:
+		writeError(w, http.StatusBadRequest, "range too large; split it up")
+		return
+	}
+	if c.state.snapshot().Role == "standby" {
+		writeError(w, http.StatusConflict, "this replica is standby for the chain; send it to the leader")
+		return
+	}
+	if !c.state.queueReingest(blockRange{from: from, to: to}) {
+		writeError(w, http.StatusConflict, "a re-ingest is already queued or running")
+		return
+	}
+	c.reingests <- blockRange{from: from, to: to} // can't block: at most one is queued
+	a.log.Warn("admin: re-ingest queued", "chain_id", c.state.chainID, "from", from, "to", to, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, statusOf(c.state.snapshot()))
+}
+
+func (a *adminAPI) getFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.faults.snapshot())
+}
+
+// setFaults replaces the faults of the targets in the body, e.g. {"ingester":{"error_rate":0.5}};
+// other targets keep theirs.
+func (a *adminAPI) setFaults(w http.ResponseWriter, r *http.Request) {
+	var faults map[string]faultConfig
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&faults); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON object of faults by target: "+err.Error())
+		return
+	}
+	if err := a.faults.set(faults); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.log.Warn("admin: faults changed", "faults", a.faults.snapshot(), "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, a.faults.snapshot())
+}
+
+func (a *adminAPI) clearFaults(w http.ResponseWriter, r *http.Request) {
+	a.faults.set(map[string]faultConfig{faultIngester: {}, faultFetcher: {}})
+	a.log.Warn("admin: faults cleared", "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, a.faults.snapshot())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminServer(t *testing.T, chains map[string]*adminChain) *httptest.Server {
+	mux := http.NewServeMux()
+	(&adminAPI{token: "s3cret", chains: chains, maxReingest: 100, log: discardLogger()}).register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func adminDo(t *testing.T, srv *httptest.Server, method, path, token string) (int, adminChainStatus) {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st adminChainStatus
+	json.NewDecoder(resp.Body).Decode(&st)
+	return resp.StatusCode, st
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv := adminServer(t, map[string]*adminChain{"1": {state: newChainState("1")}})
+	for _, token := range []string{"", "wrong", "S3CRET"} {
+		if code, _ := adminDo(t, srv, "POST", "/admin/chains/1/pause", token); code != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d", token, code)
+		}
+	}
+	if code, _ := adminDo(t, srv, "GET", "/admin/chains", "s3cret"); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if code, _ := adminDo(t, srv, "GET", "/admin/chains/2", "s3cret"); code != http.StatusNotFound {
+		t.Fatalf("unknown chain: status %d", code)
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	f := &fakeFetcher{head: 1 << 20}
+	state := newChainState("1")
+	s := &scheduler{chainID: "1", fetcher: f, ingester: &fakeBatchIngester{}, pollInterval: time.Hour, catchupRate: 500, batchSize: 10, state: state, log: discardLogger()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+	srv := adminServer(t, map[string]*adminChain{"1": {state: state}})
+
+	waitFor(t, func() bool { return f.count() > 0 })
+	if code, st := adminDo(t, srv, "POST", "/admin/chains/1/pause", "s3cret"); code != http.StatusOK || !st.Paused {
+		t.Fatalf("pause: %d %+v", code, st)
+	}
+	time.Sleep(20 * time.Millisecond) // let the block in flight finish
+	before := f.count()
+	time.Sleep(50 * time.Millisecond)
+	if f.count() != before {
+		t.Fatalf("fetched %d blocks while paused", f.count()-before)
+	}
+	if code, st := adminDo(t, srv, "POST", "/admin/chains/1/resume", "s3cret"); code != http.StatusOK || st.Paused {
+		t.Fatalf("resume: %d %+v", code, st)
+	}
+	waitFor(t, func() bool { return f.count() > before })
+}
+
+func TestAdminReingest(t *testing.T) {
+	state := newChainState("1")
+	reingests := make(chan blockRange, 1)
+	rewrites := &recordingOverwriter{}
+	s := &scheduler{chainID: "1", fetcher: &fakeFetcher{head: 100}, ingester: &fakeBatchIngester{}, next: 101, pollInterval: time.Hour, batchSize: 10,
+		state: state, reingests: reingests, overwriter: rewrites, log: discardLogger()}
+	srv := adminServer(t, map[string]*adminChain{"1": {state: state, reingests: reingests}})
+
+	for _, bad := range []string{"", "?from=5", "?from=5&to=4", "?from=-1&to=3", "?from=0&to=100"} {
+		if code, _ := adminDo(t, srv, "POST", "/admin/chains/1/reingest"+bad, "s3cret"); code != http.StatusBadRequest {
+			t.Errorf("reingest%s: status %d", bad, code)
+		}
+	}
+	code, st := adminDo(t, srv, "POST", "/admin/chains/1/reingest?from=3&to=6", "s3cret")
+	if code != http.StatusAccepted || st.Reingest == nil || st.Reingest.State != "queued" {
+		t.Fatalf("reingest: %d %+v", code, st)
+	}
+	if code, _ := adminDo(t, srv, "POST", "/admin/chains/1/reingest?from=7&to=8", "s3cret"); code != http.StatusConflict {
+		t.Fatalf("second reingest: status %d", code)
+	}
+
+	// Re-ingests run on the worker, even while paused.
+	state.setPaused(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+	waitFor(t, func() bool { r := state.snapshot().Reingest; return r != nil && r.State == "done" })
+	if got := rewrites.blocks; len(got) != 4 || got[0] != 3 || got[3] != 6 {
+		t.Fatalf("overwritten %v, want 3..6", got)
+	}
+	if _, st := adminDo(t, srv, "GET", "/admin/chains/1", "s3cret"); !st.Paused || st.Reingest.Next != 7 {
+		t.Fatalf("status after reingest: %+v %+v", st, st.Reingest)
+	}
+
+	state.setRole(false)
+	if code, _ := adminDo(t, srv, "POST", "/admin/chains/1/reingest?from=7&to=8", "s3cret"); code != http.StatusConflict {
+		t.Fatalf("reingest on standby: status %d", code)
+	}
+}
+
+func TestReingestFailsWhenWorkerPanics(t *testing.T) {
+	state := newChainState("1")
+	reingests := make(chan blockRange, 1)
+	s := &scheduler{chainID: "1", fetcher: &fakeFetcher{head: 100}, ingester: &fakeBatchIngester{}, next: 101, pollInterval: time.Hour, batchSize: 10,
+		state: state, reingests: reingests, overwriter: panickingOverwriter{}, log: discardLogger()}
+	state.queueReingest(blockRange{from: 3, to: 6})
+	reingests <- blockRange{from: 3, to: 6}
+
+	err := runRecovered(context.Background(), func(ctx context.Context) error { s.run(ctx); return nil })
+	if err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Fatalf("run = %v, want a panic", err)
+	}
+	if r := state.snapshot().Reingest; r.State != "failed" || r.Error != errWorkerStopped.Error() {
+		t.Fatalf("reingest = %+v, want failed", r)
+	}
+	if !state.queueReingest(blockRange{from: 3, to: 6}) {
+		t.Fatal("a new re-ingest was refused after the worker died")
+	}
+}
+
+type panickingOverwriter struct{}
+
+func (panickingOverwriter) Overwrite(ctx context.Context, r IngestRecord) error {
+	panic("boom")
+}
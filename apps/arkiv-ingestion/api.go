@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storedRecord is an ingestion_records row as served by the read API.
+type storedRecord struct {
+	ChainID        string          `json:"chain_id"`
+	BlockNumber    uint64          `json:"block_number"`
+	IdempotencyKey string          `json:"idempotency_key"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// recordReader reads stored records for the query API.
+type recordReader interface {
+	// GetBlock returns nil if the block isn't stored.
+	GetBlock(ctx context.Context, chainID string, number uint64) (*storedRecord, error)
+	// ListBlocks returns up to limit records with from <= block_number <= to, ascending.
+	ListBlocks(ctx context.Context, chainID string, from, to uint64, limit int) ([]storedRecord, error)
+	// Head returns the highest stored block; ok is false if the chain has none.
+	Head(ctx context.Context, chainID string) (number uint64, ok bool, err error)
+}
+
+// queryAPI serves read-only access to ingested records under /v1/chains/{chain}:
+//
+//	GET /v1/chains/{chain}/blocks/{number}
+//	GET /v1/chains/{chain}/blocks?from=&to=&limit=&cursor=   (ascending; follow next_cursor)
+//	GET /v1/chains/{chain}/head
+type queryAPI struct {
+	store    recordReader
+	timeout  time.Duration // per-request query timeout
+	maxLimit int
+}
+
+const defaultPageLimit = 100
+
+func (a *queryAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/chains/{chain}/blocks/{number}", a.getBlock)
+	mux.HandleFunc("GET /v1/chains/{chain}/blocks", a.listBlocks)
+	mux.HandleFunc("GET /v1/chains/{chain}/head", a.head)
+}
+
+func (a *queryAPI) getBlock(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.ParseUint(r.PathValue("number"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "block number must be a non-negative integer")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+	rec, err := a.store.GetBlock(ctx, r.PathValue("chain"), number)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	if rec == nil {
+		writeError(w, http.StatusNotFound, "block not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+type blockPage struct {
+	Blocks     []storedRecord `json:"blocks"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+func (a *queryAPI) listBlocks(w http.ResponseWriter, r *http.Request) {
+	chainID := r.PathValue("chain")
+	q := r.URL.Query()
+	from, err := uintParam(q.Get("from"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "from: "+err.Error())
+		return
+	}
+	to, err := uintParam(q.Get("to"), ^uint64(0)>>1) // BIGINT max
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "to: "+err.Error())
+		return
+	}
+	limit := defaultPageLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, a.maxLimit)
+	}
+	if c := q.Get("cursor"); c != "" {
+		cursorChain, next, err := decodeCursor(c)
+		if err != nil || cursorChain != chainID {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		from = next
+	}
+	if from > to {
+		writeError(w, http.StatusBadRequest, "from must be <= to")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+	recs, err := a.store.ListBlocks(ctx, chainID, from, to, limit)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	page := blockPage{Blocks: recs}
+	if page.Blocks == nil {
+		page.Blocks = []storedRecord{}
+	}
+	if len(recs) == limit {
+		if last := recs[len(recs)-1].BlockNumber; last < to {
+			page.NextCursor = encodeCursor(chainID, last+1)
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (a *queryAPI) head(w http.ResponseWriter, r *http.Request) {
+	chainID := r.PathValue("chain")
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+	number, ok, err := a.store.Head(ctx, chainID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no blocks ingested for chain")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"chain_id": chainID, "block_number": number})
+}
+
+func uintParam(s string, def uint64) (uint64, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 63) // must fit BIGINT
+	if err != nil {
+		return 0, fmt.Errorf("must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// Cursors are opaque to clients: base64url("<chain>:<next block>").
+func encodeCursor(chainID string, next uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(chainID + ":" + strconv.FormatUint(next, 10)))
+}
+
+func decodeCursor(c string) (string, uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return "", 0, err
+	}
+	i := strings.LastIndexByte(string(raw), ':')
+	if i < 0 {
+		return "", 0, errors.New("malformed cursor")
+	}
+	next, err := strconv.ParseUint(string(raw[i+1:]), 10, 63)
+	return string(raw[:i]), next, err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// writeQueryError maps store errors to 504 on timeout and 500 otherwise, without leaking details.
+func writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, "query timed out")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "query failed")
+}
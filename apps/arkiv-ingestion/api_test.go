@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// memReader serves blocks 0..n-1 of chain "1".
+type memReader struct {
+	n     uint64
+	delay time.Duration
+}
+
+func (m *memReader) GetBlock(ctx context.Context, chainID string, number uint64) (*storedRecord, error) {
+	if chainID != "1" || number >= m.n {
+		return nil, nil
+	}
+	return &storedRecord{ChainID: chainID, BlockNumber: number, IdempotencyKey: fmt.Sprintf("1-%d", number), Data: json.RawMessage(`{}`)}, nil
+}
+
+func (m *memReader) ListBlocks(ctx context.Context, chainID string, from, to uint64, limit int) ([]storedRecord, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(m.delay):
+	}
+	var out []storedRecord
+	for b := from; b <= to && b < m.n && len(out) < limit; b++ {
+		r, _ := m.GetBlock(ctx, chainID, b)
+		out = append(out, *r)
+	}
+	return out, nil
+}
+
+func (m *memReader) Head(ctx context.Context, chainID string) (uint64, bool, error) {
+	if chainID != "1" || m.n == 0 {
+		return 0, false, nil
+	}
+	return m.n - 1, true, nil
+}
+
+func apiServer(reader recordReader) http.Handler {
+	mux := http.NewServeMux()
+	(&queryAPI{store: reader, timeout: 50 * time.Millisecond, maxLimit: 10}).register(mux)
+	return instrument(mux)
+}
+
+func get(t *testing.T, h http.Handler, url string, out any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if out != nil {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestQueryAPIGetBlockAndHead(t *testing.T) {
+	h := apiServer(&memReader{n: 5})
+
+	var rec storedRecord
+	if code := get(t, h, "/v1/chains/1/blocks/3", &rec); code != http.StatusOK || rec.BlockNumber != 3 {
+		t.Errorf("get block: %d %+v", code, rec)
+	}
+	if code := get(t, h, "/v1/chains/1/blocks/99", nil); code != http.StatusNotFound {
+		t.Errorf("missing block: %d, want 404", code)
+	}
+	if code := get(t, h, "/v1/chains/1/blocks/abc", nil); code != http.StatusBadRequest {
+		t.Errorf("bad number: %d, want 400", code)
+	}
+
+	var head struct {
+		BlockNumber uint64 `json:"block_number"`
+	}
+	if code := get(t, h, "/v1/chains/1/head", &head); code != http.StatusOK || head.BlockNumber != 4 {
+		t.Errorf("head: %d %+v", code, head)
+	}
+	if code := get(t, h, "/v1/chains/2/head", nil); code != http.StatusNotFound {
+		t.Errorf("unknown chain head: %d, want 404", code)
+	}
+}
+
+func TestQueryAPIListPagination(t *testing.T) {
+	h := apiServer(&memReader{n: 25})
+
+	var got []uint64
+	url := "/v1/chains/1/blocks?from=2&to=22&limit=50" // limit capped at maxLimit 10
+	for pages := 0; url != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		var page blockPage
+		if code := get(t, h, url, &page); code != http.StatusOK {
+			t.Fatalf("GET %s = %d", url, code)
+		}
+		for _, r := range page.Blocks {
+			got = append(got, r.BlockNumber)
+		}
+		url = ""
+		if page.NextCursor != "" {
+			url = "/v1/chains/1/blocks?to=22&cursor=" + page.NextCursor
+		}
+	}
+	if len(got) != 21 || got[0] != 2 || got[20] != 22 {
+		t.Errorf("blocks = %v, want 2..22", got)
+	}
+
+	for _, bad := range []string{
+		"/v1/chains/1/blocks?from=x",
+		"/v1/chains/1/blocks?from=5&to=1",
+		"/v1/chains/1/blocks?limit=0",
+		"/v1/chains/1/blocks?cursor=!!",
+		"/v1/chains/1/blocks?cursor=" + encodeCursor("2", 5), // cursor from another chain
+	} {
+		if code := get(t, h, bad, nil); code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", bad, code)
+		}
+	}
+}
+
+func TestQueryAPITimeout(t *testing.T) {
+	h := apiServer(&memReader{n: 5, delay: time.Second})
+	if code := get(t, h, "/v1/chains/1/blocks", nil); code != http.StatusGatewayTimeout {
+		t.Errorf("slow query: %d, want 504", code)
+	}
+}
+
+func TestInstrumentUsesRoutePattern(t *testing.T) {
+	h := apiServer(&memReader{n: 5})
+	before := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("GET", "/v1/chains/{chain}/blocks/{number}", "2xx"))
+	get(t, h, "/v1/chains/1/blocks/1", nil)
+	get(t, h, "/v1/chains/1/blocks/2", nil)
+	after := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("GET", "/v1/chains/{chain}/blocks/{number}", "2xx"))
+	if after-before != 2 {
+		t.Errorf("route-labelled requests = %v, want 2", after-before)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveSink writes records to rolling local files (NDJSON, optionally gzipped, or Parquet)
+// under <dir>/chain_id=<id>/blocks=<lo>-<hi>/. A file is written under a temporary name and
+// renamed into place when it is rotated: on reaching maxBytes or maxAge, when the chain moves to
+// another block range, or on Close. Each completed file is then appended to
+// <dir>/manifest.jsonl; files not listed there are incomplete. Records replayed after a failure
+// are written again, so readers dedupe by idempotency_key.
+type archiveSink struct {
+	dir             string
+	format          string // "ndjson" or "parquet"
+	gzip            bool
+	maxBytes        int64
+	maxAge          time.Duration
+	partitionBlocks uint64
+	log             *slog.Logger
+	now             func() time.Time
+
+	mu     sync.Mutex
+	files  map[string]*archiveFile // open file per chain
+	stop   chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+type archiveFile struct {
+	partition   uint64 // first block of the file's range
+	tmpPath     string
+	f           *os.File
+	hash        hash.Hash
+	disk        *countingWriter // bytes handed to the file
+	buf         *bufio.Writer
+	gz          *gzip.Writer // ndjson with gzip
+	rows        parquetRows  // parquet: buffered until the file is completed
+	first, last uint64
+	records     int
+	acked       int // records accepted by calls that returned; see fail
+	opened      time.Time
+}
+
+// archiveLine is one NDJSON record.
+type archiveLine struct {
+	IdempotencyKey string          `json:"idempotency_key"`
+	ChainID        string          `json:"chain_id"`
+	BlockNumber    uint64          `json:"block_number"`
+	Data           json.RawMessage `json:"data"`
+}
+
+type archiveManifestEntry struct {
+	File       string    `json:"file"` // relative to the archive dir
+	Format     string    `json:"format"`
+	ChainID    string    `json:"chain_id"`
+	FirstBlock uint64    `json:"first_block"`
+	LastBlock  uint64    `json:"last_block"`
+	Records    int       `json:"records"`
+	Bytes      int64     `json:"bytes"`
+	SHA256     string    `json:"sha256"`
+	ClosedAt   time.Time `json:"closed_at"`
+}
+
+const archiveManifest = "manifest.jsonl"
+
+// newArchiveSink prepares dir, removing temporary files left by a previous crash (their records
+// were never in the manifest), and starts rotating files by age.
+func newArchiveSink(dir, format string, gzipped bool, maxBytes int64, maxAge time.Duration, partitionBlocks uint64, log *slog.Logger) (*archiveSink, error) {
+	if format != "ndjson" && format != "parquet" {
+		return nil, fmt.Errorf("archive: unknown format %q", format)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	stale := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasPrefix(d.Name(), ".part-") && strings.HasSuffix(d.Name(), ".tmp") {
+			stale++
+			return os.Remove(path)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("archive: clean up: %w", err)
+	}
+	if stale > 0 {
+		log.Warn("removed incomplete archive files", "dir", dir, "count", stale)
+	}
+	a := &archiveSink{
+		dir: dir, format: format, gzip: gzipped, maxBytes: maxBytes, maxAge: maxAge,
+		partitionBlocks: max(partitionBlocks, 1), log: log, now: time.Now,
+		files: map[string]*archiveFile{}, stop: make(chan struct{}), done: make(chan struct{}),
+	}
+	go a.rotateByAge()
+	return a, nil
+}
+
+func (a *archiveSink) Ingest(ctx context.Context, r IngestRecord) error {
+	return a.IngestBatch(ctx, []IngestRecord{r})
+}
+
+func (a *archiveSink) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return errors.New("archive: closed")
+	}
+	var bad []string
+	for _, r := range records {
+		if !json.Valid(r.Data) {
+			bad = append(bad, r.IdempotencyKey) // skipped; the rest of the batch is archived
+			continue
+		}
+		partition := r.BlockNumber / a.partitionBlocks * a.partitionBlocks
+		f := a.files[r.ChainID]
+		if f != nil && f.partition != partition {
+			if err := a.complete(r.ChainID, f); err != nil {
+				return err
+			}
+			f = nil
+		}
+		if f == nil {
+			var err error
+			if f, err = a.open(r.ChainID, partition); err != nil {
+				return err
+			}
+		}
+		if err := a.write(f, r); err != nil {
+			a.fail(r.ChainID, f)
+			return fmt.Errorf("archive: write: %w", err)
+		}
+		if f.size() >= a.maxBytes {
+			if err := a.complete(r.ChainID, f); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range a.files {
+		f.acked = f.records
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%w: archive: data is not JSON: %s", errInvalidPayload, strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+func (a *archiveSink) partitionDir(chainID string, partition uint64) string {
+	return filepath.Join(a.dir, "chain_id="+url.PathEscape(chainID),
+		fmt.Sprintf("blocks=%d-%d", partition, partition+a.partitionBlocks-1))
+}
+
+func (a *archiveSink) open(chainID string, partition uint64) (*archiveFile, error) {
+	dir := a.partitionDir(chainID, partition)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	now := a.now()
+	f, err := os.Create(filepath.Join(dir, fmt.Sprintf(".part-%d.tmp", now.UnixNano())))
+	if err != nil {
+		return nil, err
+	}
+	af := &archiveFile{partition: partition, tmpPath: f.Name(), f: f, hash: sha256.New(), opened: now}
+	af.disk = &countingWriter{w: io.MultiWriter(f, af.hash)}
+	af.buf = bufio.NewWriterSize(af.disk, 64<<10)
+	if a.format == "ndjson" && a.gzip {
+		af.gz = gzip.NewWriter(af.buf)
+	}
+	a.files[chainID] = af
+	return af, nil
+}
+
+func (a *archiveSink) write(f *archiveFile, r IngestRecord) error {
+	if f.records == 0 || r.BlockNumber < f.first {
+		f.first = r.BlockNumber
+	}
+	if f.records == 0 || r.BlockNumber > f.last {
+		f.last = r.BlockNumber
+	}
+	f.records++
+	if a.format == "parquet" {
+		f.rows.add(r)
+		return nil
+	}
+	line, err := json.Marshal(archiveLine{IdempotencyKey: r.IdempotencyKey, ChainID: r.ChainID, BlockNumber: r.BlockNumber, Data: json.RawMessage(r.Data)})
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f.buf
+	if f.gz != nil {
+		w = f.gz
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// size estimates the finished file's size.
+func (f *archiveFile) size() int64 {
+	return f.disk.n + int64(f.buf.Buffered()) + f.rows.size
+}
+
+// complete finishes f, renames it into place and records it in the manifest. If that fails, f is
+// dropped as by fail.
+func (a *archiveSink) complete(chainID string, f *archiveFile) error {
+	err := a.finish(f)
+	if err == nil {
+		err = f.f.Sync()
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		a.fail(chainID, f)
+		return fmt.Errorf("archive: complete %s: %w", f.tmpPath, err)
+	}
+	delete(a.files, chainID)
+
+	ext := ".ndjson"
+	switch {
+	case a.format == "parquet":
+		ext = ".parquet"
+	case a.gzip:
+		ext = ".ndjson.gz"
+	}
+	dir := filepath.Dir(f.tmpPath)
+	final := filepath.Join(dir, fmt.Sprintf("part-%d-%d-%d%s", f.first, f.last, f.opened.UnixNano(), ext))
+	if err := os.Rename(f.tmpPath, final); err != nil {
+		a.fail(chainID, f)
+		return fmt.Errorf("archive: %w", err)
+	}
+	syncDir(dir)
+
+	rel, _ := filepath.Rel(a.dir, final)
+	entry := archiveManifestEntry{
+		File: filepath.ToSlash(rel), Format: a.format, ChainID: chainID,
+		FirstBlock: f.first, LastBlock: f.last, Records: f.records,
+		Bytes: f.disk.n, SHA256: hex.EncodeToString(f.hash.Sum(nil)), ClosedAt: a.now().UTC(),
+	}
+	return a.appendManifest(entry)
+}
+
+func (a *archiveSink) finish(f *archiveFile) error {
+	if a.format == "parquet" {
+		if err := f.rows.writeTo(f.buf, a.gzip); err != nil {
+			return err
+		}
+	} else if f.gz != nil {
+		if err := f.gz.Close(); err != nil {
+			return err
+		}
+	}
+	return f.buf.Flush()
+}
+
+// fail drops f after a write or completion error. Only records of the failing call are reported
+// as failed; earlier calls already returned, so a file holding their records is not removed but
+// kept as .failed-<nanos> next to the parts: not in the manifest, and left alone on start, for
+// recovery by hand.
+func (a *archiveSink) fail(chainID string, f *archiveFile) {
+	delete(a.files, chainID)
+	f.f.Close()
+	if f.acked == 0 {
+		os.Remove(f.tmpPath)
+		return
+	}
+	kept := filepath.Join(filepath.Dir(f.tmpPath), fmt.Sprintf(".failed-%d", f.opened.UnixNano()))
+	if err := os.Rename(f.tmpPath, kept); err != nil {
+		kept = f.tmpPath
+	}
+	a.log.Error("archive file failed; kept for recovery", "chain_id", chainID, "file", kept, "records", f.acked)
+}
+
+func (a *archiveSink) appendManifest(e archiveManifestEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	mf, err := os.OpenFile(filepath.Join(a.dir, archiveManifest), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("archive: manifest: %w", err)
+	}
+	_, err = mf.Write(append(line, '\n'))
+	if err == nil {
+		err = mf.Sync()
+	}
+	if cerr := mf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("archive: manifest: %w", err)
+	}
+	return nil
+}
+
+func (a *archiveSink) rotateByAge() {
+	defer close(a.done)
+	t := time.NewTicker(max(a.maxAge/4, time.Second))
+	defer t.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-t.C:
+			a.rotateExpired()
+		}
+	}
+}
+
+func (a *archiveSink) rotateExpired() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for chainID, f := range a.files {
+		if a.now().Sub(f.opened) < a.maxAge {
+			continue
+		}
+		if err := a.complete(chainID, f); err != nil {
+			a.log.Warn("archive rotation failed", "chain_id", chainID, "err", err)
+		}
+	}
+}
+
+// Close completes all open files.
+func (a *archiveSink) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.stop)
+	var errs []error
+	for chainID, f := range a.files {
+		errs = append(errs, a.complete(chainID, f))
+	}
+	a.mu.Unlock()
+	<-a.done
+	return errors.Join(errs...)
+}
+
+// syncDir makes a rename durable; best effort, not all platforms support it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func archiveRecord(chainID string, n uint64) IngestRecord {
+	return IngestRecord{IdempotencyKey: fmt.Sprintf("%s-%d", chainID, n), ChainID: chainID, BlockNumber: n, Data: []byte(fmt.Sprintf(`{"n":%d}`, n))}
+}
+
+func readManifest(t *testing.T, dir string) []archiveManifestEntry {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, archiveManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []archiveManifestEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e archiveManifestEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func TestArchiveNDJSONPartitionsAndManifest(t *testing.T) {
+	dir := t.TempDir()
+	a, err := newArchiveSink(dir, "ndjson", true, 1<<20, time.Hour, 10, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := a.IngestBatch(ctx, []IngestRecord{archiveRecord("1", 8), archiveRecord("1", 9), archiveRecord("2", 3)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Ingest(ctx, archiveRecord("1", 10)); err != nil { // next range: completes 8..9
+		t.Fatal(err)
+	}
+	if got := len(readManifest(t, dir)); got != 1 {
+		t.Fatalf("manifest has %d entries before Close, want 1", got)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readManifest(t, dir)
+	if len(entries) != 3 {
+		t.Fatalf("manifest: %+v", entries)
+	}
+	e := entries[0]
+	if e.ChainID != "1" || e.FirstBlock != 8 || e.LastBlock != 9 || e.Records != 2 ||
+		!strings.HasPrefix(e.File, "chain_id=1/blocks=0-9/part-8-9-") || !strings.HasSuffix(e.File, ".ndjson.gz") {
+		t.Fatalf("entry: %+v", e)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, e.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(raw); hex.EncodeToString(sum[:]) != e.SHA256 || int64(len(raw)) != e.Bytes {
+		t.Fatal("manifest checksum/size mismatch")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []archiveLine
+	for dec := json.NewDecoder(zr); dec.More(); {
+		var l archiveLine
+		if err := dec.Decode(&l); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) != 2 || lines[1].IdempotencyKey != "1-9" || string(lines[1].Data) != `{"n":9}` {
+		t.Fatalf("lines: %+v", lines)
+	}
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*", "*", ".part-*"))
+	if len(tmps) != 0 {
+		t.Fatalf("temporary files left: %v", tmps)
+	}
+	if err := a.Ingest(ctx, archiveRecord("1", 11)); err == nil {
+		t.Fatal("ingest after Close should fail")
+	}
+}
+
+func TestArchiveRotatesBySizeAndAge(t *testing.T) {
+	dir := t.TempDir()
+	a, err := newArchiveSink(dir, "ndjson", false, 1, time.Hour, 1000, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	now := time.Now()
+	a.mu.Lock()
+	a.now = func() time.Time { return now }
+	a.mu.Unlock()
+
+	for n := uint64(0); n < 3; n++ {
+		if err := a.Ingest(context.Background(), archiveRecord("1", n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(readManifest(t, dir)); got != 3 {
+		t.Fatalf("size rotation: %d files, want 3", got)
+	}
+
+	a.mu.Lock()
+	a.maxBytes = 1 << 20
+	a.mu.Unlock()
+	if err := a.Ingest(context.Background(), archiveRecord("1", 3)); err != nil {
+		t.Fatal(err)
+	}
+	a.rotateExpired()
+	if got := len(readManifest(t, dir)); got != 3 {
+		t.Fatalf("rotated a fresh file: %d", got)
+	}
+	now = now.Add(2 * time.Hour)
+	a.rotateExpired()
+	if got := len(readManifest(t, dir)); got != 4 {
+		t.Fatalf("age rotation: %d files, want 4", got)
+	}
+}
+
+func TestArchiveSkipsBadRecordsAndKeepsAcceptedOnes(t *testing.T) {
+	dir := t.TempDir()
+	a, err := newArchiveSink(dir, "ndjson", false, 1<<20, time.Hour, 100, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := a.IngestBatch(ctx, []IngestRecord{archiveRecord("1", 1), archiveRecord("1", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	bad := archiveRecord("1", 4)
+	bad.Data = []byte(`{"n":`)
+	err = a.IngestBatch(ctx, []IngestRecord{archiveRecord("1", 3), bad, archiveRecord("1", 5)})
+	if !errors.Is(err, errInvalidPayload) || !strings.Contains(err.Error(), "1-4") {
+		t.Fatalf("bad batch: err = %v, want errInvalidPayload naming 1-4", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readManifest(t, dir)
+	if len(entries) != 1 || entries[0].Records != 4 || entries[0].FirstBlock != 1 || entries[0].LastBlock != 5 {
+		t.Fatalf("manifest: %+v, want one file with blocks 1, 2, 3 and 5", entries)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, entries[0].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), `"1-4"`) {
+		t.Fatalf("bad record archived: %s", raw)
+	}
+}
+
+func TestArchiveRemovesStaleTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "chain_id=1", "blocks=0-9", ".part-1.tmp")
+	os.MkdirAll(filepath.Dir(stale), 0o755)
+	os.WriteFile(stale, []byte("partial"), 0o644)
+	a, err := newArchiveSink(dir, "parquet", false, 1<<20, time.Hour, 10, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temp file kept: %v", err)
+	}
+}
+
+func TestArchiveParquet(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		dir := t.TempDir()
+		a, err := newArchiveSink(dir, "parquet", gzipped, 1<<20, time.Hour, 100000, discardLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []IngestRecord
+		for n := uint64(0); n < parquetPageRows+5; n++ { // two pages per column
+			records = append(records, archiveRecord("1", n))
+		}
+		if err := a.IngestBatch(context.Background(), records); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		entries := readManifest(t, dir)
+		if len(entries) != 1 || !strings.HasSuffix(entries[0].File, ".parquet") {
+			t.Fatalf("manifest: %+v", entries)
+		}
+		raw, err := os.ReadFile(filepath.Join(dir, entries[0].File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks, keys := readTestParquet(t, raw)
+		if len(blocks) != len(records) || blocks[len(blocks)-1] != int64(len(records)-1) || keys[3] != "1-3" {
+			t.Fatalf("gzip=%v: read %d blocks, last %d, key %q", gzipped, len(blocks), blocks[len(blocks)-1], keys[3])
+		}
+	}
+}
+
+// TestArchiveParquetReadsWithParquetGo reads archive files back with an independent Parquet
+// implementation, so the writer isn't only checked against this package's own decoding.
+func TestArchiveParquetReadsWithParquetGo(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		dir := t.TempDir()
+		a, err := newArchiveSink(dir, "parquet", gzipped, 1<<20, time.Hour, 100000, discardLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []IngestRecord
+		for n := uint64(0); n < parquetPageRows+5; n++ {
+			records = append(records, archiveRecord("1", n))
+		}
+		if err := a.IngestBatch(context.Background(), records); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		entries := readManifest(t, dir)
+		raw, err := os.ReadFile(filepath.Join(dir, entries[0].File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := parquet.OpenFile(bytes.NewReader(raw), int64(len(raw)))
+		if err != nil {
+			t.Fatalf("gzip=%v: open: %v", gzipped, err)
+		}
+		if f.NumRows() != int64(len(records)) {
+			t.Fatalf("gzip=%v: %d rows, want %d", gzipped, f.NumRows(), len(records))
+		}
+		for _, c := range []struct{ name, logical string }{{"chain_id", "STRING"}, {"data", "JSON"}} {
+			col, ok := f.Schema().Lookup(c.name)
+			if !ok || col.Node.Type().LogicalType() == nil || col.Node.Type().LogicalType().String() != c.logical {
+				t.Errorf("gzip=%v: column %s: %v", gzipped, c.name, col.Node)
+			}
+		}
+		rows := make([]parquet.Row, len(records)+1)
+		reader := f.RowGroups()[0].Rows()
+		n := 0
+		for {
+			read, err := reader.ReadRows(rows[n:])
+			n += read
+			if errors.Is(err, io.EOF) || (err == nil && read == 0) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("gzip=%v: read: %v", gzipped, err)
+			}
+		}
+		reader.Close()
+		if n != len(records) {
+			t.Fatalf("gzip=%v: read %d rows, want %d", gzipped, n, len(records))
+		}
+		for i, r := range records {
+			v := rows[i] // chain_id, block_number, idempotency_key, data
+			if len(v) != 4 || string(v[0].ByteArray()) != r.ChainID || v[1].Int64() != int64(r.BlockNumber) ||
+				string(v[2].ByteArray()) != r.IdempotencyKey || !bytes.Equal(v[3].ByteArray(), r.Data) {
+				t.Fatalf("gzip=%v: row %d = %v, want %+v", gzipped, i, v, r)
+			}
+		}
+	}
+}
+
+// readTestParquet decodes the block_number and idempotency_key columns of an archive Parquet
+// file, independently of the writer's encoding helpers.
+func readTestParquet(t *testing.T, raw []byte) (blocks []int64, keys []string) {
+	t.Helper()
+	if string(raw[:4]) != parquetMagic || string(raw[len(raw)-4:]) != parquetMagic {
+		t.Fatal("bad magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(raw[len(raw)-8:]))
+	meta := decodeTestThrift(t, bytes.NewReader(raw[len(raw)-8-footerLen:len(raw)-8]))
+	numRows := meta[3].(int64)
+	schema := meta[2].([]any)
+	if len(schema) != 5 || string(schema[2].(map[int16]any)[4].([]byte)) != "block_number" {
+		t.Fatalf("schema: %v", schema)
+	}
+	columns := meta[4].([]any)[0].(map[int16]any)[1].([]any)
+	readColumn := func(i int, value func(r *bytes.Reader)) {
+		cm := columns[i].(map[int16]any)[3].(map[int16]any)
+		codec, offset, n := cm[4].(int64), cm[9].(int64), cm[5].(int64)
+		if n != numRows {
+			t.Fatalf("column %d: %d values, %d rows", i, n, numRows)
+		}
+		r := bytes.NewReader(raw[offset:])
+		for read := int64(0); read < n; {
+			ph := decodeTestThrift(t, r)
+			body := make([]byte, ph[3].(int64))
+			io.ReadFull(r, body)
+			if codec == parquetCodecGzip {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ = io.ReadAll(zr)
+			}
+			if int64(len(body)) != ph[2].(int64) {
+				t.Fatal("uncompressed page size mismatch")
+			}
+			vals := ph[5].(map[int16]any)[1].(int64)
+			br := bytes.NewReader(body)
+			for j := int64(0); j < vals; j++ {
+				value(br)
+			}
+			read += vals
+		}
+	}
+	readColumn(1, func(r *bytes.Reader) {
+		var v int64
+		binary.Read(r, binary.LittleEndian, &v)
+		blocks = append(blocks, v)
+	})
+	readColumn(2, func(r *bytes.Reader) {
+		var n uint32
+		binary.Read(r, binary.LittleEndian, &n)
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		keys = append(keys, string(b))
+	})
+	return blocks, keys
+}
+
+// decodeTestThrift reads one compact-protocol struct into field id -> value (int64, []byte,
+// []any or nested map).
+func decodeTestThrift(t *testing.T, r *bytes.Reader) map[int16]any {
+	t.Helper()
+	zigzag := func() int64 {
+		u, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int64(u>>1) ^ -int64(u&1)
+	}
+	var value func(typ byte) any
+	value = func(typ byte) any {
+		switch typ {
+		case thriftI32, thriftI64, 4:
+			return zigzag()
+		case thriftBinary:
+			n, _ := binary.ReadUvarint(r)
+			b := make([]byte, n)
+			io.ReadFull(r, b)
+			return b
+		case thriftList:
+			h, _ := r.ReadByte()
+			n := int(h >> 4)
+			if n == 15 {
+				u, _ := binary.ReadUvarint(r)
+				n = int(u)
+			}
+			out := make([]any, n)
+			for i := range out {
+				out[i] = value(h & 0x0f)
+			}
+			return out
+		case thriftStruct:
+			return decodeTestThrift(t, r)
+		}
+		t.Fatalf("unexpected thrift type %d", typ)
+		return nil
+	}
+	out := map[int16]any{}
+	var last int16
+	for {
+		h, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h == 0 {
+			return out
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(zigzag())
+		}
+		last = id
+		out[id] = value(h & 0x0f)
+	}
+}
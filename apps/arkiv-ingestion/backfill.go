@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// backfiller ingests a fixed block range of one chain, for the backfill command. Unlike the
+// scheduler it stops at the end of the range and fails rather than dead-lettering or skipping
+// blocks, so a Job that failed can be rerun; blocks already stored are left as they are.
+type backfiller struct {
+	chainID   string
+	fetcher   Fetcher
+	ingester  ArkivIngester
+	batchSize int
+	retry     retryPolicy // for fetches and writes alike
+	log       *slog.Logger
+}
+
+// run fetches and ingests blocks from..to. It returns how many blocks were written before it
+// finished or failed.
+func (b *backfiller) run(ctx context.Context, from, to uint64) (uint64, error) {
+	var stored uint64
+	batch := make([]IngestRecord, 0, b.batchSize)
+	for n := from; n <= to; n++ {
+		r, err := b.fetch(ctx, n)
+		if err != nil {
+			return stored, err
+		}
+		batch = append(batch, *r)
+		if len(batch) < b.batchSize && n < to {
+			continue
+		}
+		if err := b.write(ctx, batch); err != nil {
+			return stored, fmt.Errorf("write blocks %d-%d: %w", batch[0].BlockNumber, n, err)
+		}
+		stored += uint64(len(batch))
+		b.log.Info("backfill progress", "through", n, "to", to)
+		batch = batch[:0]
+		if n == to {
+			break // to may be the largest uint64
+		}
+	}
+	return stored, nil
+}
+
+func (b *backfiller) fetch(ctx context.Context, n uint64) (*IngestRecord, error) {
+	var r *IngestRecord
+	_, err := b.retry.do(ctx, b.chainID, func() error {
+		var err error
+		if r, err = b.fetcher.FetchBlock(ctx, n); err == nil && r == nil {
+			err = fmt.Errorf("block %d not available from the source", n)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch block %d: %w", n, err)
+	}
+	return r, nil
+}
+
+func (b *backfiller) write(ctx context.Context, records []IngestRecord) error {
+	if batcher, ok := b.ingester.(BatchIngester); ok && len(records) > 1 {
+		_, err := ingestBatchWithRetry(ctx, b.retry, batcher, records)
+		return err
+	}
+	for i := range records {
+		if _, err := ingestWithRetry(ctx, b.retry, b.ingester, &records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ethBlock is the block payload fetchers put in IngestRecord.Data: the result of
+// eth_getBlockByNumber(n, true), plus an optional "logs" array as returned by eth_getLogs
+// for that block. Only the fields stored by normalizedIngester are decoded.
+type ethBlock struct {
+	Number        hexUint64        `json:"number"`
+	Hash          string           `json:"hash"`
+	ParentHash    string           `json:"parentHash"`
+	Timestamp     hexUint64        `json:"timestamp"`
+	Miner         string           `json:"miner,omitempty"`
+	GasUsed       hexUint64        `json:"gasUsed"`
+	GasLimit      hexUint64        `json:"gasLimit"`
+	BaseFeePerGas *hexBig          `json:"baseFeePerGas,omitempty"`
+	Transactions  []ethTransaction `json:"transactions"`
+	Logs          []ethLog         `json:"logs,omitempty"`
+}
+
+type ethTransaction struct {
+	Hash             string    `json:"hash"`
+	TransactionIndex hexUint64 `json:"transactionIndex"`
+	From             string    `json:"from"`
+	To               *string   `json:"to"` // nil for contract creation
+	Value            hexBig    `json:"value"`
+	Nonce            hexUint64 `json:"nonce"`
+	Gas              hexUint64 `json:"gas"`
+	GasPrice         *hexBig   `json:"gasPrice,omitempty"`
+	Input            string    `json:"input"`
+}
+
+type ethLog struct {
+	LogIndex        hexUint64 `json:"logIndex"`
+	TransactionHash string    `json:"transactionHash"`
+	Address         string    `json:"address"`
+	Topics          []string  `json:"topics"`
+	Data            string    `json:"data"`
+}
+
+// blockTimestamp returns the timestamp of a block payload, decoding only that field.
+func blockTimestamp(data []byte) (time.Time, bool) {
+	var b struct {
+		Timestamp hexUint64 `json:"timestamp"`
+	}
+	if json.Unmarshal(data, &b) != nil || b.Timestamp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(b.Timestamp), 0), true
+}
+
+// hexUint64 is a JSON-RPC quantity ("0x1a").
+type hexUint64 uint64
+
+func (h hexUint64) MarshalJSON() ([]byte, error) {
+	return json.Marshal("0x" + strconv.FormatUint(uint64(h), 16))
+}
+
+func (h *hexUint64) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return fmt.Errorf("quantity %q: %w", s, err)
+	}
+	*h = hexUint64(n)
+	return nil
+}
+
+// hexBig is a JSON-RPC quantity that may exceed 64 bits (wei values).
+type hexBig struct{ big.Int }
+
+func (h hexBig) MarshalJSON() ([]byte, error) {
+	return json.Marshal("0x" + h.Text(16))
+}
+
+func (h *hexBig) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if _, ok := h.SetString(strings.TrimPrefix(s, "0x"), 16); !ok {
+		return fmt.Errorf("quantity %q: invalid hex", s)
+	}
+	return nil
+}
+
+func decodeBlock(data []byte) (*ethBlock, error) {
+	var b ethBlock
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%w: decode block: %v", errInvalidPayload, err)
+	}
+	if b.Hash == "" {
+		return nil, fmt.Errorf("%w: block has no hash", errInvalidPayload)
+	}
+	return &b, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without calling the store while the breaker is open. Records that
+// get it are held by the worker and written once the store is back, never dead-lettered.
+var errCircuitOpen = errors.New("circuit open: store unavailable")
+
+// Circuit states, also the value of arkiv_store_circuit_state.
+const (
+	circuitClosed = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+// circuitBreaker stops writes to a store that keeps failing. Closed, it lets every call through
+// and opens after threshold consecutive retryable failures (connection loss and the like; bad
+// records don't count). Open, it fails calls with errCircuitOpen for openFor, then half-opens:
+// one probe call goes through, and closes the breaker if it succeeds or reopens it if not.
+type circuitBreaker struct {
+	threshold int
+	openFor   time.Duration
+	now       func() time.Time
+	log       *slog.Logger
+
+	mu       sync.Mutex
+	state    int
+	failures int       // consecutive, while closed
+	openedAt time.Time // last transition to open
+	probing  bool      // a half-open probe is in flight
+}
+
+func newCircuitBreaker(threshold int, openFor time.Duration, log *slog.Logger) *circuitBreaker {
+	storeCircuitState.Set(circuitClosed)
+	return &circuitBreaker{threshold: threshold, openFor: openFor, now: time.Now, log: log}
+}
+
+// allow reports whether a call may go to the store; if it returns nil, the caller must report the
+// outcome with done.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.openFor {
+			return errCircuitOpen
+		}
+		b.transition(circuitHalfOpen)
+		fallthrough
+	case circuitHalfOpen:
+		if b.probing {
+			return errCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the outcome of a call that allow let through.
+func (b *circuitBreaker) done(err error) {
+	class := ""
+	if err != nil {
+		class = classifyError(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if class == errClassCanceled {
+		b.probing = false // says nothing about the store; let the next call probe
+		return
+	}
+	failed := class == errClassRetryable
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing = false
+		if failed {
+			b.open(err)
+		} else {
+			b.transition(circuitClosed)
+		}
+	case circuitClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		if b.failures++; b.failures >= b.threshold {
+			b.open(err)
+		}
+	}
+}
+
+func (b *circuitBreaker) open(err error) {
+	b.openedAt = b.now()
+	b.transition(circuitOpen)
+	storeCircuitOpened.Inc()
+	b.log.Warn("circuit opened: pausing writes", "retry_in", b.openFor, "err", err)
+}
+
+func (b *circuitBreaker) transition(state int) {
+	if state != b.state && state == circuitClosed {
+		b.log.Info("circuit closed: store is back")
+	}
+	b.state = state
+	b.failures = 0
+	storeCircuitState.Set(float64(state))
+}
+
+// retryIn returns how long until a call may go through: 0 when closed or ready to probe. A nil
+// breaker is always closed.
+func (b *circuitBreaker) retryIn() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == circuitOpen:
+		return max(b.openedAt.Add(b.openFor).Sub(b.now()), 0)
+	case b.state == circuitHalfOpen && b.probing:
+		return time.Second // another worker's probe is in flight
+	}
+	return 0
+}
+
+// breakerIngester puts a circuitBreaker in front of a store.
+type breakerIngester struct {
+	ArkivIngester
+	breaker *circuitBreaker
+}
+
+func (b *breakerIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	if err := b.breaker.allow(); err != nil {
+		return err
+	}
+	err := b.ArkivIngester.Ingest(ctx, r)
+	b.breaker.done(err)
+	return err
+}
+
+func (b *breakerIngester) Overwrite(ctx context.Context, r IngestRecord) error {
+	if _, ok := b.ArkivIngester.(overwriter); !ok {
+		return errNoOverwrite // says nothing about the store's health
+	}
+	if err := b.breaker.allow(); err != nil {
+		return err
+	}
+	err := overwriteRecord(ctx, b.ArkivIngester, r)
+	b.breaker.done(err)
+	return err
+}
+
+func (b *breakerIngester) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	if err := b.breaker.allow(); err != nil {
+		return err
+	}
+	var err error
+	if batcher, ok := b.ArkivIngester.(BatchIngester); ok {
+		err = batcher.IngestBatch(ctx, records)
+	} else {
+		for _, r := range records {
+			if err = b.ArkivIngester.Ingest(ctx, r); err != nil {
+				break
+			}
+		}
+	}
+	b.breaker.done(err)
+	return err
+}
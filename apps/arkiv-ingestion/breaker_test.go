@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	b := newCircuitBreaker(3, 30*time.Second, discardLogger())
+	b.now = func() time.Time { return now }
+	call := func(err error) error {
+		if e := b.allow(); e != nil {
+			return e
+		}
+		b.done(err)
+		return err
+	}
+
+	call(errMock)
+	call(errMock)
+	call(fmt.Errorf("%w: bad block", errInvalidPayload)) // the store answered: resets the count
+	call(errMock)
+	call(errMock)
+	if b.state != circuitClosed {
+		t.Fatalf("state = %d after 2 consecutive failures, want closed", b.state)
+	}
+	call(errMock)
+	if err := call(nil); !errors.Is(err, errCircuitOpen) || b.retryIn() != 30*time.Second {
+		t.Fatalf("after 3 failures: err = %v, retry in %s; want open for 30s", err, b.retryIn())
+	}
+
+	now = now.Add(30 * time.Second)
+	if b.retryIn() != 0 {
+		t.Fatalf("retry in %s after openFor, want 0", b.retryIn())
+	}
+	if err := b.allow(); err != nil {
+		t.Fatalf("half-open probe refused: %v", err)
+	}
+	if err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("second call during the probe: err = %v, want errCircuitOpen", err)
+	}
+	b.done(errMock)
+	if b.state != circuitOpen || b.retryIn() != 30*time.Second {
+		t.Fatalf("failed probe: state %d, want open again for 30s", b.state)
+	}
+
+	now = now.Add(30 * time.Second)
+	if err := call(nil); err != nil || b.state != circuitClosed {
+		t.Fatalf("successful probe: err %v, state %d; want closed", err, b.state)
+	}
+}
+
+// flakyStore fails with a retryable error while down, and records what it stores.
+type flakyStore struct {
+	mu     sync.Mutex
+	down   bool
+	stored map[uint64]int
+	calls  int
+}
+
+func (f *flakyStore) Ingest(ctx context.Context, r IngestRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.down {
+		return errMock
+	}
+	f.stored[r.BlockNumber]++
+	return nil
+}
+
+func (f *flakyStore) set(down bool) (calls int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+	return f.calls
+}
+
+func (f *flakyStore) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.stored)
+}
+
+func TestSchedulerHoldsRecordsWhileCircuitOpen(t *testing.T) {
+	dlq, err := newFileDeadLetters(filepath.Join(t.TempDir(), "dlq.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &flakyStore{stored: map[uint64]int{}}
+	breaker := newCircuitBreaker(2, 100*time.Millisecond, discardLogger())
+	f := &fakeFetcher{head: 1 << 20}
+	s := &scheduler{
+		chainID:      "1",
+		fetcher:      f,
+		ingester:     &breakerIngester{ArkivIngester: store, breaker: breaker},
+		pollInterval: time.Hour,
+		catchupRate:  1000,
+		batchSize:    1,
+		retry:        testRetryPolicy,
+		dlq:          dlq,
+		breaker:      breaker,
+		state:        newChainState("1"),
+		log:          discardLogger(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	waitFor(t, func() bool { return store.count() >= 5 })
+	store.set(true)
+	waitFor(t, func() bool { return breaker.retryIn() > 0 })
+	fetched := f.count()
+	time.Sleep(350 * time.Millisecond) // a few open/probe cycles
+	if n := f.count(); n > fetched+1 {
+		t.Errorf("fetched %d more blocks while the circuit was open", n-fetched)
+	}
+	if calls := store.set(false); calls > 20 {
+		t.Errorf("store called %d times; the open circuit should have spared it", calls)
+	}
+	high := uint64(f.count())
+	waitFor(t, func() bool { return store.count() > int(high)+5 })
+	cancel()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for n := uint64(0); n < high; n++ {
+		if store.stored[n] == 0 {
+			t.Fatalf("block %d was lost", n)
+		}
+	}
+	if letters, _ := dlq.List(context.Background(), 10); len(letters) != 0 {
+		t.Errorf("dead letters = %+v, want none", letters)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// chainConfig describes one chain indexed by this process. Chains come from the CHAINS env var
+// (a JSON array) or CHAINS_FILE; without either, a single chain is built from CHAIN_ID.
+type chainConfig struct {
+	ID          string `json:"id"`
+	Fetcher     string `json:"fetcher"`      // "synthetic" (default) or "rpc"
+	RPCURL      string `json:"rpc_url"`      // rpc fetcher: single endpoint, shorthand for rpc_endpoints
+	WSURL       string `json:"ws_url"`       // rpc fetcher: follow heads via eth_subscribe("newHeads")
+	IntervalSec int    `json:"interval_sec"` // poll interval once caught up; default INGEST_INTERVAL_SEC
+	StartBlock  uint64 `json:"start_block"`  // first block when nothing is checkpointed yet
+
+	RPCEndpoints []rpcEndpointConfig `json:"rpc_endpoints"`  // rpc fetcher: endpoints to spread requests over (see rpcPool)
+	HedgeAfterMS int                 `json:"hedge_after_ms"` // rpc fetcher: also ask the next endpoint after this long; 0 = off
+
+	Scenario *syntheticScenario `json:"scenario"` // synthetic fetcher: seed and faults; default SYNTHETIC_SCENARIO
+}
+
+func (c chainConfig) interval() time.Duration {
+	return time.Duration(c.IntervalSec) * time.Second
+}
+
+// endpoints returns the chain's RPC endpoints, with rpc_url (if set) first.
+func (c chainConfig) endpoints() []rpcEndpointConfig {
+	if c.RPCURL == "" {
+		return c.RPCEndpoints
+	}
+	return append([]rpcEndpointConfig{{URL: c.RPCURL}}, c.RPCEndpoints...)
+}
+
+// loadChains resolves the chain list from cfg and validates it.
+func loadChains(cfg config) ([]chainConfig, error) {
+	raw := []byte(cfg.chainsJSON)
+	if cfg.chainsFile != "" {
+		b, err := os.ReadFile(cfg.chainsFile)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+	var scenario *syntheticScenario
+	if cfg.syntheticScenario != "" {
+		if err := json.Unmarshal([]byte(cfg.syntheticScenario), &scenario); err != nil {
+			return nil, fmt.Errorf("parse SYNTHETIC_SCENARIO: %w", err)
+		}
+	}
+	if len(raw) == 0 {
+		return []chainConfig{{ID: cfg.chainID, Fetcher: "synthetic", IntervalSec: int(cfg.interval / time.Second), Scenario: scenario}}, nil
+	}
+	var chains []chainConfig
+	if err := json.Unmarshal(raw, &chains); err != nil {
+		return nil, fmt.Errorf("parse chains: %w", err)
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("chains: empty list")
+	}
+	seen := map[string]bool{}
+	for i := range chains {
+		c := &chains[i]
+		if c.ID == "" {
+			return nil, fmt.Errorf("chains[%d]: id required", i)
+		}
+		if seen[c.ID] {
+			return nil, fmt.Errorf("chains[%d]: duplicate id %q", i, c.ID)
+		}
+		seen[c.ID] = true
+		if c.Fetcher == "" {
+			c.Fetcher = "synthetic"
+		}
+		switch c.Fetcher {
+		case "synthetic":
+			if c.Scenario == nil {
+				c.Scenario = scenario
+			}
+		case "rpc":
+			if err := validateEndpoints(c.endpoints()); err != nil {
+				return nil, fmt.Errorf("chain %s: %w", c.ID, err)
+			}
+		default:
+			return nil, fmt.Errorf("chain %s: unknown fetcher %q", c.ID, c.Fetcher)
+		}
+		if (c.WSURL != "" || len(c.RPCEndpoints) > 0 || c.HedgeAfterMS != 0) && c.Fetcher != "rpc" {
+			return nil, fmt.Errorf("chain %s: ws_url, rpc_endpoints and hedge_after_ms need the rpc fetcher", c.ID)
+		}
+		if c.Scenario != nil {
+			if c.Fetcher != "synthetic" {
+				return nil, fmt.Errorf("chain %s: scenario needs the synthetic fetcher", c.ID)
+			}
+			if err := c.Scenario.validate(); err != nil {
+				return nil, fmt.Errorf("chain %s: %w", c.ID, err)
+			}
+		}
+		if c.IntervalSec <= 0 {
+			c.IntervalSec = int(cfg.interval / time.Second)
+		}
+	}
+	return chains, nil
+}
+
+func validateEndpoints(endpoints []rpcEndpointConfig) error {
+	if len(endpoints) == 0 {
+		return fmt.Errorf("rpc_url or rpc_endpoints required for rpc fetcher")
+	}
+	names := map[string]bool{}
+	for i, e := range endpoints {
+		switch {
+		case e.URL == "":
+			return fmt.Errorf("rpc endpoint %d: url required", i)
+		case e.Weight < 0, e.RatePerSec < 0, e.Burst < 0:
+			return fmt.Errorf("rpc endpoint %s: weight, rate_per_sec and burst can't be negative", e.name())
+		case names[e.name()]:
+			return fmt.Errorf("rpc endpoint %s: duplicate name; set name to tell them apart", e.name())
+		}
+		names[e.name()] = true
+	}
+	return nil
+}
+
+func newFetcher(c chainConfig, cfg config, log *slog.Logger) Fetcher {
+	if c.Fetcher == "rpc" {
+		rpc := newRPCPool(c.endpoints(), time.Duration(c.HedgeAfterMS)*time.Millisecond)
+		if c.WSURL != "" {
+			return newWSFetcher(c.ID, rpc, c.WSURL, log)
+		}
+		return newRPCFetcher(c.ID, rpc)
+	}
+	f := newSyntheticFetcher(c.ID)
+	f.blockTime = c.interval()
+	f.startHead = cfg.syntheticStartHead
+	if c.Scenario != nil {
+		f.scenario = *c.Scenario
+		if c.Scenario.StartUnix != 0 {
+			f.started = time.Unix(c.Scenario.StartUnix, 0)
+		}
+	}
+	return f
+}
+
+// checkpointer reports the next block to ingest for a chain, from what is already stored.
+type checkpointer interface {
+	Checkpoint(ctx context.Context, chainID string) (next uint64, ok bool, err error)
+}
+
+// resumeFrom returns where a chain's worker should start: after the stored checkpoint if any,
+// otherwise the configured start block.
+func resumeFrom(ctx context.Context, ingester ArkivIngester, c chainConfig) (uint64, error) {
+	cp, ok := ingester.(checkpointer)
+	if !ok {
+		return c.StartBlock, nil
+	}
+	next, found, err := cp.Checkpoint(ctx, c.ID)
+	if err != nil {
+		return 0, fmt.Errorf("checkpoint: %w", err)
+	}
+	if !found || next < c.StartBlock {
+		return c.StartBlock, nil
+	}
+	return next, nil
+}
+
+// stableRunFactor times the maximum restart delay is how long a worker run must last for
+// superviseChain to count it as healthy and restart the backoff from the base delay.
+const stableRunFactor = 3
+
+// superviseChain runs a chain's worker until ctx is done. If run returns an error or panics, it is
+// restarted after backoff, which grows with consecutive failures; a run that lasted
+// stableRunFactor times the maximum delay resets it. run is expected to resume from its checkpoint.
+func superviseChain(ctx context.Context, chainID string, run func(context.Context) error, backoff retryPolicy, log *slog.Logger) {
+	for failures := 0; ; failures++ {
+		started := time.Now()
+		err := runRecovered(ctx, run)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) >= stableRunFactor*backoff.maxDelay {
+			failures = 0
+		}
+		delay := backoff.backoff(failures)
+		log.Error("chain worker stopped; restarting", "chain_id", chainID, "err", err, "in", delay)
+		ingestWorkerRestarts.WithLabelValues(chainID).Inc()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func runRecovered(ctx context.Context, run func(context.Context) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return run(ctx)
+}
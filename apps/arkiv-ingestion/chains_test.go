@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadChains(t *testing.T) {
+	base := config{chainID: "7", interval: 30 * time.Second}
+
+	chains, err := loadChains(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 1 || chains[0].ID != "7" || chains[0].Fetcher != "synthetic" || chains[0].IntervalSec != 30 {
+		t.Errorf("default chains = %+v, want single chain from CHAIN_ID", chains)
+	}
+
+	cfg := base
+	cfg.chainsJSON = `[{"id":"1","fetcher":"rpc","rpc_url":"http://node:8545","interval_sec":12},{"id":"10"}]`
+	chains, err = loadChains(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 2 || chains[0].interval() != 12*time.Second || chains[1].Fetcher != "synthetic" || chains[1].IntervalSec != 30 {
+		t.Errorf("chains = %+v", chains)
+	}
+
+	path := filepath.Join(t.TempDir(), "chains.json")
+	if err := os.WriteFile(path, []byte(`[{"id":"5"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg = base
+	cfg.chainsFile = path
+	if chains, err = loadChains(cfg); err != nil || chains[0].ID != "5" {
+		t.Errorf("chains from file = %+v, %v", chains, err)
+	}
+
+	cfg = base
+	cfg.syntheticScenario = `{"seed":42}`
+	cfg.chainsJSON = `[{"id":"1"},{"id":"2","scenario":{"seed":7,"reorg_every":50,"reorg_depth":3}}]`
+	if chains, err = loadChains(cfg); err != nil || chains[0].Scenario.Seed != 42 || chains[1].Scenario.ReorgDepth != 3 {
+		t.Errorf("chains with scenarios = %+v, %v", chains, err)
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`[{"fetcher":"synthetic"}]`,
+		`[{"id":"1"},{"id":"1"}]`,
+		`[{"id":"1","fetcher":"rpc"}]`,
+		`[{"id":"1","fetcher":"rpc","rpc_url":"http://a:8545","rpc_endpoints":[{"url":"http://a:8545/key"}]}]`,
+		`[{"id":"1","rpc_endpoints":[{"url":"http://a:8545"}]}]`,
+		`[{"id":"1","fetcher":"carrier-pigeon"}]`,
+		`[{"id":"1","fetcher":"rpc","rpc_url":"http://a:8545","scenario":{"seed":1}}]`,
+		`[{"id":"1","scenario":{"error_rate":1.5}}]`,
+		`[{"id":"1","scenario":{"reorg_every":3,"reorg_depth":3}}]`,
+		`{"id":"1"}`,
+	} {
+		cfg := base
+		cfg.chainsJSON = bad
+		if _, err := loadChains(cfg); err == nil {
+			t.Errorf("loadChains(%s): want error", bad)
+		}
+	}
+}
+
+type checkpointIngester struct {
+	mockIngester
+	next  uint64
+	found bool
+}
+
+func (c *checkpointIngester) Checkpoint(ctx context.Context, chainID string) (uint64, bool, error) {
+	return c.next, c.found, nil
+}
+
+func TestResumeFrom(t *testing.T) {
+	ctx := context.Background()
+	c := chainConfig{ID: "1", StartBlock: 100}
+	tests := []struct {
+		ing  ArkivIngester
+		want uint64
+	}{
+		{&mockIngester{}, 100},                            // no checkpoint support
+		{&checkpointIngester{found: false}, 100},          // nothing stored yet
+		{&checkpointIngester{next: 50, found: true}, 100}, // start_block raised past stored data
+		{&checkpointIngester{next: 500, found: true}, 500},
+	}
+	for i, tt := range tests {
+		got, err := resumeFrom(ctx, tt.ing, c)
+		if err != nil || got != tt.want {
+			t.Errorf("case %d: resumeFrom = %d, %v; want %d", i, got, err, tt.want)
+		}
+	}
+}
+
+func TestSuperviseChainRestartsAfterPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var runs atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		superviseChain(ctx, "1", func(ctx context.Context) error {
+			switch runs.Add(1) {
+			case 1:
+				panic("boom")
+			case 2:
+				return errors.New("checkpoint failed")
+			}
+			<-ctx.Done()
+			return nil
+		}, testRetryPolicy, discardLogger())
+	}()
+	waitFor(t, func() bool { return runs.Load() == 3 })
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("superviseChain did not return after cancel")
+	}
+}
+
+func TestSuperviseChainResetsBackoffAfterStableRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var logs syncBuffer
+	log := slog.New(slog.NewJSONHandler(&logs, nil))
+	backoff := testRetryPolicy
+	backoff.jitter = func() float64 { return 1 }
+	var runs atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		superviseChain(ctx, "1", func(ctx context.Context) error {
+			switch runs.Add(1) {
+			case 1, 2, 3:
+				return errors.New("flapping")
+			case 4:
+				time.Sleep(stableRunFactor*backoff.maxDelay + 20*time.Millisecond)
+				return errors.New("failed after a healthy run")
+			}
+			<-ctx.Done()
+			return nil
+		}, backoff, log)
+	}()
+	waitFor(t, func() bool { return runs.Load() == 5 })
+	cancel()
+	<-done
+
+	var delays []time.Duration
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct {
+			In time.Duration `json:"in"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		delays = append(delays, entry.In)
+	}
+	want := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, time.Millisecond}
+	if !reflect.DeepEqual(delays, want) {
+		t.Fatalf("restart delays = %v, want %v", delays, want)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for a logger writing from another goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRPCFetcher(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body strings.Builder
+		buf := make([]byte, 1024)
+		n, _ := r.Body.Read(buf)
+		body.Write(buf[:n])
+		switch {
+		case strings.Contains(body.String(), "eth_blockNumber"):
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x2a"}`))
+		case strings.Contains(body.String(), `"0x63"`): // block 99 not mined yet
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+		case strings.Contains(body.String(), "eth_getBlockByNumber"):
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"number":"0x2a","hash":"0xabc","parentHash":"0xabb","timestamp":"0x1","gasUsed":"0x0","gasLimit":"0x0","transactions":[]}}`))
+		case strings.Contains(body.String(), "eth_getLogs") && strings.Contains(body.String(), `"blockHash":"0xabc"`):
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[{"logIndex":"0x0","transactionHash":"0xt","address":"0xa","topics":[],"data":"0x"}]}`))
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found"}}`))
+		}
+	}))
+	defer srv.Close()
+	f := newRPCFetcher("1", newRPCClient(srv.URL))
+	ctx := context.Background()
+
+	head, err := f.Head(ctx)
+	if err != nil || head != 42 {
+		t.Fatalf("Head = %d, %v; want 42", head, err)
+	}
+	r, err := f.FetchBlock(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := decodeBlock(r.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.IdempotencyKey != "1-42" || b.Hash != "0xabc" || len(b.Logs) != 1 {
+		t.Errorf("record = %+v, block = %+v", r, b)
+	}
+	if r, err := f.FetchBlock(ctx, 99); r != nil || err != nil {
+		t.Errorf("FetchBlock(unmined) = %v, %v; want nil, nil", r, err)
+	}
+}
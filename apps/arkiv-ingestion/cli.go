@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit codes shared by every subcommand, so a Kubernetes Job (or its podFailurePolicy) can tell a
+// failure worth retrying from one that isn't.
+const (
+	exitOK      = 0
+	exitFailure = 1 // the command failed or found problems: store unreachable, mismatches, failed replays
+	exitUsage   = 2 // bad arguments or configuration; rerunning won't help
+)
+
+// errConfig marks errors in the configuration rather than the environment; see exitCode.
+var errConfig = errors.New("invalid configuration")
+
+func exitCode(err error) int {
+	if errors.Is(err, errConfig) {
+		return exitUsage
+	}
+	return exitFailure
+}
+
+// command is an arkiv-ingestion subcommand. run gets the remaining arguments and returns the
+// process exit code.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, cfg config, args []string, log *slog.Logger) int
+}
+
+var commands = []command{
+	{"serve", "run the chain workers and the HTTP server (default)", runServe},
+	{"migrate", "up|status: apply or list schema migrations", runMigrate},
+	{"backfill", "ingest a block range of one chain, then exit", runBackfill},
+	{"verify", "re-fetch stored blocks and compare them with the source", runVerify},
+	{"replay-dlq", "re-ingest dead-lettered records", runReplayDLQ},
+	{"export", "write stored records as JSON lines", runExport},
+}
+
+// run dispatches the command line (without the program name) to a subcommand and returns the
+// process exit code. Without arguments it serves.
+func run(args []string, log *slog.Logger) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage(os.Stdout)
+		return exitOK
+	}
+	for _, c := range commands {
+		if c.name == name {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+			return c.run(ctx, configFromEnv(), args, log)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "arkiv-ingestion: unknown command %q\n", name)
+	usage(os.Stderr)
+	return exitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: arkiv-ingestion [command] [flags]   (configured from env; see README)")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-11s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w, "\nexit codes: 0 ok, 1 failed, 2 bad arguments or configuration")
+	fmt.Fprintln(w, "run `arkiv-ingestion <command> -h` for a command's flags")
+}
+
+// parseFlags parses a subcommand's flags. If ok is false the command should return code: flags
+// were bad, or -h asked for help.
+func parseFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	err := fs.Parse(args)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK, false
+	case err != nil:
+		return exitUsage, false
+	case fs.NArg() > 0:
+		fmt.Fprintf(fs.Output(), "%s: unexpected argument %q\n", fs.Name(), fs.Arg(0))
+		fs.Usage()
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// app is the wiring the subcommands share: the primary store behind its circuit breaker, the
+// sinks written alongside it, the dead-letter store and the configured chains.
+type app struct {
+	cfg      config
+	log      *slog.Logger
+	pg       *postgresIngester
+	store    ArkivIngester   // the primary store (INGEST_MODE), without the breaker
+	breaker  *circuitBreaker // nil if disabled
+	sinks    []sink
+	ingester ArkivIngester // writes to the primary store and every sink
+	hub      *streamHub
+	dlq      deadLetterStore
+	chains   []chainConfig
+}
+
+// newApp loads the chains and builds the write path. Configuration errors wrap errConfig. Only
+// commands that own the schema (serve, backfill) pass migrate, and even they apply pending
+// migrations only with MIGRATE_ON_START; otherwise newApp refuses a schema that is behind or
+// ahead of this binary.
+func newApp(ctx context.Context, cfg config, log *slog.Logger, migrate bool) (*app, error) {
+	chains, err := loadChains(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: load chains: %v", errConfig, err)
+	}
+	pg, err := newPostgresIngester(ctx, cfg.databaseURL, migrate && cfg.migrateOnStart, cfg.partition)
+	if err != nil {
+		return nil, fmt.Errorf("create ingester: %w", err)
+	}
+	a := &app{cfg: cfg, log: log, pg: pg, store: pg, chains: chains, hub: newStreamHub(cfg.streamBuffer)}
+	if cfg.mode == "normalized" {
+		a.store = &normalizedIngester{pool: pg.pool}
+	}
+	// The breaker guards the primary store only; other sinks have their own retries and timeouts.
+	primary := a.store
+	if cfg.breakerFailures > 0 {
+		a.breaker = newCircuitBreaker(cfg.breakerFailures, cfg.breakerOpen, log)
+		primary = &breakerIngester{ArkivIngester: a.store, breaker: a.breaker}
+	}
+	if a.sinks, err = loadSinks(cfg, primary, pg, log); err != nil {
+		pg.pool.Close()
+		return nil, fmt.Errorf("%w: load sinks: %v", errConfig, err)
+	}
+	a.ingester = primary
+	if len(a.sinks) > 1 {
+		a.ingester = &teeIngester{sinks: a.sinks, log: log}
+	}
+	if cfg.streamSource != "notify" {
+		a.ingester = &publishingIngester{ArkivIngester: a.ingester, hub: a.hub}
+	}
+	if a.dlq, err = newDeadLetterStore(cfg, pg.pool); err != nil {
+		a.close()
+		return nil, fmt.Errorf("create dead-letter store: %w", err)
+	}
+	return a, nil
+}
+
+// close completes open archive files and closes the pool.
+func (a *app) close() {
+	if err := closeSinks(a.sinks); err != nil {
+		a.log.Error("close sinks", "err", err)
+	}
+	a.pg.pool.Close()
+}
+
+// requireRawMode fails commands and jobs that read ingestion_records, which INGEST_MODE=normalized
+// doesn't write; they would find nothing and report success.
+func requireRawMode(cfg config, what string) error {
+	if cfg.mode != "raw" {
+		return fmt.Errorf("%w: %s reads ingestion_records, which INGEST_MODE=%s doesn't write", errConfig, what, cfg.mode)
+	}
+	return nil
+}
+
+// chain returns the configured chain with the given id; an empty id picks the only chain.
+func (a *app) chain(id string) (chainConfig, error) {
+	if id == "" {
+		if len(a.chains) == 1 {
+			return a.chains[0], nil
+		}
+		return chainConfig{}, fmt.Errorf("%w: -chain is required with %d chains", errConfig, len(a.chains))
+	}
+	for _, c := range a.chains {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return chainConfig{}, fmt.Errorf("%w: unknown chain %q", errConfig, id)
+}
+
+// runMigrate implements `arkiv-ingestion migrate up|status`.
+func runMigrate(ctx context.Context, cfg config, args []string, log *slog.Logger) int {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status") {
+		fmt.Fprintln(os.Stderr, "usage: arkiv-ingestion migrate up|status")
+		return exitUsage
+	}
+	pool, err := newPostgresPool(ctx, cfg.databaseURL)
+	if err != nil {
+		log.Error("connect", "err", err)
+		return exitFailure
+	}
+	defer pool.Close()
+	m, err := newMigrator(pool, cfg.partition)
+	if err != nil {
+		log.Error("load migrations", "err", err)
+		return exitFailure
+	}
+	if args[0] == "status" {
+		if err := m.status(ctx, os.Stdout); err != nil {
+			log.Error("migrate status", "err", err)
+			return exitFailure
+		}
+		return exitOK
+	}
+	applied, err := m.up(ctx)
+	for _, mig := range applied {
+		log.Info("applied migration", "version", mig.version, "name", mig.name)
+	}
+	if err != nil {
+		log.Error("migrate up", "err", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runReplayDLQ implements `arkiv-ingestion replay-dlq [-limit N]`. Fails if any listed record
+// could not be replayed.
+func runReplayDLQ(ctx context.Context, cfg config, args []string, log *slog.Logger) int {
+	fs := flag.NewFlagSet("replay-dlq", flag.ContinueOnError)
+	limit := fs.Int("limit", 1000, "max records to replay")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	app, err := newApp(ctx, cfg, log, false)
+	if err != nil {
+		log.Error("replay-dlq", "err", err)
+		return exitCode(err)
+	}
+	defer app.close()
+	replayed, failed, err := replayDeadLetters(ctx, app.dlq, app.ingester, cfg.retry, *limit, log)
+	log.Info("replay-dlq done", "replayed", replayed, "failed", failed)
+	if err != nil {
+		log.Error("replay-dlq", "err", err)
+		return exitFailure
+	}
+	if failed > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runVerify implements `arkiv-ingestion verify`: re-fetch stored blocks and compare them with the
+// source, printing a JSON report per chain. Fails if anything is left mismatched or unverified.
+func runVerify(ctx context.Context, cfg config, args []string, log *slog.Logger) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	chainID := fs.String("chain", "", "chain to verify (default all)")
+	from := fs.Uint64("from", 0, "first block (default the chain's start_block)")
+	to := fs.Int64("to", -1, "last block; set to scan [from, to] instead of sampling")
+	sample := fs.Int("sample", 100, "random stored blocks to check when not scanning a range")
+	full := fs.Bool("full", false, "compare canonical JSON, not just block hashes")
+	repair := fs.Bool("repair", false, "overwrite mismatched rows with the source's version")
+	reportPath := fs.String("report", "-", "write the JSON report here (- = stdout)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := requireRawMode(cfg, "verify"); err != nil {
+		log.Error("verify", "err", err)
+		return exitCode(err)
+	}
+	app, err := newApp(ctx, cfg, log, false)
+	if err != nil {
+		log.Error("verify", "err", err)
+		return exitCode(err)
+	}
+	defer app.close()
+	var rewriter overwriter
+	if *repair {
+		o, ok := app.ingester.(overwriter)
+		if !ok {
+			log.Error("verify", "err", errNoOverwrite)
+			return exitUsage
+		}
+		rewriter = o
+	}
+	chains := app.chains
+	if *chainID != "" {
+		c, err := app.chain(*chainID)
+		if err != nil {
+			log.Error("verify", "err", err)
+			return exitCode(err)
+		}
+		chains = []chainConfig{c}
+	}
+
+	var reports []verifyReport
+	var runErr error
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, c := range chains {
+		v := &verifier{chainID: c.ID, fetcher: newFetcher(c, cfg, log), store: app.pg, repair: rewriter, full: *full, log: log.With("chain_id", c.ID)}
+		start := max(*from, c.StartBlock)
+		var rep verifyReport
+		var err error
+		if *to >= 0 {
+			rep, err = v.verifyRange(ctx, start, uint64(*to))
+		} else {
+			rep, err = v.verifySample(ctx, start, *sample, rnd)
+		}
+		reports = append(reports, rep)
+		if err != nil {
+			log.Error("verify", "chain_id", c.ID, "err", err)
+			runErr = err
+			break
+		}
+	}
+
+	out, closeOut, err := createOutput(*reportPath)
+	if err != nil {
+		log.Error("verify report", "err", err)
+		return exitFailure
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(reports)
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Error("verify report", "err", err)
+		return exitFailure
+	}
+	if runErr != nil {
+		return exitFailure
+	}
+	for _, rep := range reports {
+		for _, m := range rep.Mismatches {
+			if !m.Repaired {
+				return exitFailure
+			}
+		}
+	}
+	return exitOK
+}
+
+// runBackfill implements `arkiv-ingestion backfill [-chain ID] [-from N] -to M`: fetch and ingest
+// the range through the same write path as the workers, then exit. Blocks already stored are
+// skipped by the store, so a failed run can simply be rerun.
+func runBackfill(ctx context.Context, cfg config, args []string, log *slog.Logger) int {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	chainID := fs.String("chain", "", "chain to backfill (default the only configured chain)")
+	from := fs.Uint64("from", 0, "first block (default the chain's start_block)")
+	to := fs.Int64("to", -1, "last block (required)")
+	batchSize := fs.Int("batch", cfg.batchSize, "records per write")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *to < 0 || *batchSize < 1 {
+		fmt.Fprintln(fs.Output(), "backfill: -to is required and -batch must be at least 1")
+		fs.Usage()
+		return exitUsage
+	}
+	app, err := newApp(ctx, cfg, log, true)
+	if err != nil {
+		log.Error("backfill", "err", err)
+		return exitCode(err)
+	}
+	defer app.close()
+	c, err := app.chain(*chainID)
+	if err != nil {
+		log.Error("backfill", "err", err)
+		return exitCode(err)
+	}
+	start := max(*from, c.StartBlock)
+	if start > uint64(*to) {
+		log.Error("backfill", "err", fmt.Sprintf("empty range [%d, %d]", start, *to))
+		return exitUsage
+	}
+	b := &backfiller{
+		chainID:   c.ID,
+		fetcher:   newFetcher(c, cfg, log),
+		ingester:  app.ingester,
+		batchSize: *batchSize,
+		retry:     cfg.retry,
+		log:       log.With("chain_id", c.ID),
+	}
+	stored, err := b.run(ctx, start, uint64(*to))
+	log.Info("backfill done", "chain_id", c.ID, "from", start, "to", *to, "blocks", stored)
+	if err != nil {
+		log.Error("backfill", "chain_id", c.ID, "err", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runExport implements `arkiv-ingestion export [-chain ID] [-from N] [-to M] [-out PATH]`: write
+// stored records as JSON lines, in block order.
+func runExport(ctx context.Context, cfg config, args []string, log *slog.Logger) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	chainID := fs.String("chain", "", "chain to export (default the only configured chain)")
+	from := fs.Uint64("from", 0, "first block")
+	to := fs.Int64("to", -1, "last block (default the highest stored block)")
+	outPath := fs.String("out", "-", "write records here (- = stdout)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := requireRawMode(cfg, "export"); err != nil {
+		log.Error("export", "err", err)
+		return exitCode(err)
+	}
+	app, err := newApp(ctx, cfg, log, false)
+	if err != nil {
+		log.Error("export", "err", err)
+		return exitCode(err)
+	}
+	defer app.close()
+	c, err := app.chain(*chainID)
+	if err != nil {
+		log.Error("export", "err", err)
+		return exitCode(err)
+	}
+	last := uint64(*to)
+	if *to < 0 {
+		head, ok, err := app.pg.Head(ctx, c.ID)
+		if err != nil {
+			log.Error("export", "chain_id", c.ID, "err", err)
+			return exitFailure
+		}
+		if !ok {
+			log.Info("export done", "chain_id", c.ID, "records", 0)
+			return exitOK
+		}
+		last = head
+	}
+
+	out, closeOut, err := createOutput(*outPath)
+	if err != nil {
+		log.Error("export", "err", err)
+		return exitFailure
+	}
+	n, err := exportRecords(ctx, app.pg, c.ID, *from, last, 1000, out)
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	log.Info("export done", "chain_id", c.ID, "from", *from, "to", last, "records", n)
+	if err != nil {
+		log.Error("export", "chain_id", c.ID, "err", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// createOutput opens path for writing, or stdout for "-".
+func createOutput(path string) (io.Writer, func() error, error) {
+	if path == "-" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunExitCodes(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://nobody@127.0.0.1:1/none?connect_timeout=1")
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		chains string
+		want   int
+	}{
+		{"help", []string{"help"}, "", exitOK},
+		{"command help", []string{"backfill", "-h"}, "", exitOK},
+		{"unknown command", []string{"nope"}, "", exitUsage},
+		{"unknown flag", []string{"verify", "-bogus"}, "", exitUsage},
+		{"extra argument", []string{"export", "1"}, "", exitUsage},
+		{"serve takes no flags", []string{"serve", "-x"}, "", exitUsage},
+		{"migrate without action", []string{"migrate"}, "", exitUsage},
+		{"backfill without -to", []string{"backfill", "-from", "5"}, "", exitUsage},
+		{"backfill zero batch", []string{"backfill", "-to", "5", "-batch", "0"}, "", exitUsage},
+		{"bad CHAINS", []string{"backfill", "-to", "5"}, "not json", exitUsage},
+		{"store unreachable", []string{"migrate", "status"}, "", exitFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("CHAINS", tc.chains)
+			if got := run(tc.args, discardLogger()); got != tc.want {
+				t.Errorf("run(%q) = %d, want %d", tc.args, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunRefusesRawOnlyWorkInNormalizedMode(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://nobody@127.0.0.1:1/none?connect_timeout=1")
+	t.Setenv("INGEST_MODE", "normalized")
+	t.Setenv("VERIFY_INTERVAL_SEC", "60")
+	for _, args := range [][]string{{"verify"}, {"export"}, {"serve"}} {
+		if got := run(args, discardLogger()); got != exitUsage {
+			t.Errorf("run(%q) = %d, want %d", args, got, exitUsage)
+		}
+	}
+}
+
+func TestReadOnlyCommandsDontMigrate(t *testing.T) {
+	shared := testDBIngester(t)
+	ctx := context.Background()
+	schema := fmt.Sprintf("arkiv_ro_%d", time.Now().UnixNano())
+	if _, err := shared.pool.Exec(ctx, `CREATE SCHEMA `+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shared.pool.Exec(context.Background(), `DROP SCHEMA `+schema+` CASCADE`) })
+	url := os.Getenv("ARKIV_TEST_DATABASE_URL")
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	t.Setenv("DATABASE_URL", url+sep+"search_path="+schema)
+	for _, args := range [][]string{{"export"}, {"verify"}, {"replay-dlq"}} {
+		if got := run(args, discardLogger()); got != exitFailure {
+			t.Errorf("run(%q) on an empty schema = %d, want %d", args, got, exitFailure)
+		}
+	}
+	var tables int
+	shared.pool.QueryRow(ctx, `SELECT COUNT(*) FROM pg_tables WHERE schemaname = $1`, schema).Scan(&tables)
+	if tables != 0 {
+		t.Fatalf("read-only commands created %d tables", tables)
+	}
+}
+
+func TestAppChain(t *testing.T) {
+	a := &app{chains: []chainConfig{{ID: "1"}}}
+	if c, err := a.chain(""); err != nil || c.ID != "1" {
+		t.Errorf("chain(\"\") = %q, %v; want the only chain", c.ID, err)
+	}
+	if _, err := a.chain("2"); exitCode(err) != exitUsage {
+		t.Errorf("unknown chain: exit %d (%v), want %d", exitCode(err), err, exitUsage)
+	}
+	a.chains = append(a.chains, chainConfig{ID: "2"})
+	if _, err := a.chain(""); exitCode(err) != exitUsage {
+		t.Errorf("no -chain with two chains: exit %d (%v), want %d", exitCode(err), err, exitUsage)
+	}
+}
+
+func TestBackfiller(t *testing.T) {
+	fetcher := &fakeFetcher{}
+	store := &fakeBatchIngester{}
+	b := &backfiller{chainID: "1", fetcher: fetcher, ingester: store, batchSize: 4, retry: testRetryPolicy, log: discardLogger()}
+	stored, err := b.run(context.Background(), 10, 19)
+	if err != nil || stored != 10 {
+		t.Fatalf("run = %d, %v; want 10 blocks", stored, err)
+	}
+	if got := store.sizes(); !reflect.DeepEqual(got, []int{4, 4, 2}) {
+		t.Errorf("batch sizes = %v, want [4 4 2]", got)
+	}
+	if fetcher.fetched[0] != 10 || fetcher.fetched[len(fetcher.fetched)-1] != 19 {
+		t.Errorf("fetched %v, want 10..19", fetcher.fetched)
+	}
+
+	// A block the source doesn't have fails the run after retries; what came before is kept.
+	source := &sourceFetcher{blocks: map[uint64]string{0: `{}`, 1: `{}`, 3: `{}`}}
+	store = &fakeBatchIngester{}
+	b = &backfiller{chainID: "v", fetcher: source, ingester: store, batchSize: 1, retry: testRetryPolicy, log: discardLogger()}
+	stored, err = b.run(context.Background(), 0, 3)
+	if err == nil || !strings.Contains(err.Error(), "block 2 not available") {
+		t.Fatalf("run error = %v, want block 2 not available", err)
+	}
+	if stored != 2 {
+		t.Errorf("stored = %d, want 2", stored)
+	}
+}
+
+func TestExportRecords(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := exportRecords(context.Background(), &memReader{n: 25}, "1", 3, 22, 7, &buf)
+	if err != nil || n != 20 {
+		t.Fatalf("exportRecords = %d, %v; want 20", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 20 {
+		t.Fatalf("got %d lines, want 20", len(lines))
+	}
+	for i, line := range lines {
+		var r storedRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if r.BlockNumber != uint64(3+i) {
+			t.Errorf("line %d: block %d, want %d", i, r.BlockNumber, 3+i)
+		}
+	}
+
+	buf.Reset()
+	if n, err := exportRecords(context.Background(), &memReader{n: 25}, "1", 30, 40, 7, &buf); err != nil || n != 0 || buf.Len() != 0 {
+		t.Errorf("range past the stored blocks: %d records, %v, %q; want none", n, err, buf.String())
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// deadLetter is a record that exhausted ingest retries.
+type deadLetter struct {
+	Record        IngestRecord `json:"record"`
+	Error         string       `json:"error"`
+	Attempts      int          `json:"attempts"`
+	FirstFailedAt time.Time    `json:"first_failed_at"`
+	LastFailedAt  time.Time    `json:"last_failed_at"`
+}
+
+// deadLetterStore persists records that could not be ingested so they can be replayed.
+// Put on an existing key updates the error and adds to its attempt count.
+type deadLetterStore interface {
+	Put(ctx context.Context, r IngestRecord, cause error, attempts int) error
+	List(ctx context.Context, limit int) ([]deadLetter, error)
+	Delete(ctx context.Context, key string) error
+	Depth(ctx context.Context) (map[string]int, error) // by chain ID
+}
+
+// deadLetterRecords stores records in dlq and refreshes the depth gauge. A record that can't be
+// stored is lost; that is logged at error level with its key so it can be re-ingested by hand.
+func deadLetterRecords(ctx context.Context, dlq deadLetterStore, records []IngestRecord, cause error, attempts int, log *slog.Logger) {
+	if dlq == nil {
+		return
+	}
+	// A record that failed just before shutdown must still be stored.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	for _, r := range records {
+		if err := dlq.Put(ctx, r, cause, attempts); err != nil {
+			log.Error("dead-letter failed; record lost", "key", r.IdempotencyKey, "err", err)
+		}
+	}
+	refreshDLQDepth(ctx, dlq, log)
+}
+
+func refreshDLQDepth(ctx context.Context, dlq deadLetterStore, log *slog.Logger) {
+	depth, err := dlq.Depth(ctx)
+	if err != nil {
+		log.Warn("dlq depth", "err", err)
+		return
+	}
+	ingestDLQDepth.Reset() // drop chains whose letters were all replayed
+	for chainID, n := range depth {
+		ingestDLQDepth.WithLabelValues(chainID).Set(float64(n))
+	}
+}
+
+// replayDeadLetters re-ingests up to limit dead letters, oldest first. Successes are removed;
+// failures stay with their attempt count increased. Returns how many were replayed and failed.
+func replayDeadLetters(ctx context.Context, dlq deadLetterStore, ingester ArkivIngester, policy retryPolicy, limit int, log *slog.Logger) (replayed, failed int, err error) {
+	letters, err := dlq.List(ctx, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, dl := range letters {
+		r := dl.Record
+		if attempts, ingestErr := ingestWithRetry(ctx, policy, ingester, &r); ingestErr != nil {
+			if ctx.Err() != nil {
+				return replayed, failed, ctx.Err()
+			}
+			failed++
+			log.Warn("replay failed", "key", r.IdempotencyKey, "err", ingestErr)
+			if err := dlq.Put(ctx, r, ingestErr, attempts); err != nil {
+				return replayed, failed, err
+			}
+			continue
+		}
+		if err := dlq.Delete(ctx, r.IdempotencyKey); err != nil {
+			return replayed, failed, err
+		}
+		replayed++
+		log.Info("replayed", "key", r.IdempotencyKey)
+	}
+	refreshDLQDepth(ctx, dlq, log)
+	return replayed, failed, nil
+}
+
+// postgresDeadLetters stores dead letters in ingestion_dead_letters.
+type postgresDeadLetters struct {
+	pool *pgxpool.Pool
+}
+
+func (p *postgresDeadLetters) Put(ctx context.Context, r IngestRecord, cause error, attempts int) error {
+	_, err := p.pool.Exec(ctx,
+		`INSERT INTO ingestion_dead_letters (idempotency_key, chain_id, block_number, data, error, attempts)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (idempotency_key) DO UPDATE SET
+			error = EXCLUDED.error,
+			attempts = ingestion_dead_letters.attempts + EXCLUDED.attempts,
+			last_failed_at = NOW()`,
+		r.IdempotencyKey, r.ChainID, int64(r.BlockNumber), r.Data, cause.Error(), attempts,
+	)
+	return err
+}
+
+func (p *postgresDeadLetters) List(ctx context.Context, limit int) ([]deadLetter, error) {
+	rows, err := p.pool.Query(ctx,
+		`SELECT idempotency_key, chain_id, block_number, data, error, attempts, first_failed_at, last_failed_at
+		 FROM ingestion_dead_letters ORDER BY first_failed_at, idempotency_key LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (deadLetter, error) {
+		var dl deadLetter
+		var block int64
+		err := row.Scan(&dl.Record.IdempotencyKey, &dl.Record.ChainID, &block, &dl.Record.Data,
+			&dl.Error, &dl.Attempts, &dl.FirstFailedAt, &dl.LastFailedAt)
+		dl.Record.BlockNumber = uint64(block)
+		return dl, err
+	})
+}
+
+func (p *postgresDeadLetters) Delete(ctx context.Context, key string) error {
+	_, err := p.pool.Exec(ctx, `DELETE FROM ingestion_dead_letters WHERE idempotency_key = $1`, key)
+	return err
+}
+
+func (p *postgresDeadLetters) Depth(ctx context.Context) (map[string]int, error) {
+	rows, err := p.pool.Query(ctx, `SELECT chain_id, COUNT(*) FROM ingestion_dead_letters GROUP BY chain_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	depth := map[string]int{}
+	for rows.Next() {
+		var chainID string
+		var n int
+		if err := rows.Scan(&chainID, &n); err != nil {
+			return nil, err
+		}
+		depth[chainID] = n
+	}
+	return depth, rows.Err()
+}
+
+// fileDeadLetters stores dead letters as JSON lines in a local file, so records survive even when
+// the database is what's failing. Put and Delete append a line (a delete as a tombstone) and
+// calls are served from an index read once. When superseded lines pass compactMinLines and
+// outnumber the live ones, the file is rewritten with only the live letters via atomic rename.
+// The file is read again if another process (replay-dlq next to serve) changed it.
+type fileDeadLetters struct {
+	path            string
+	compactMinLines int
+
+	mu      sync.Mutex
+	letters map[string]deadLetter // nil until read
+	lines   int                   // lines in the file, live or superseded
+	seen    os.FileInfo           // the file as last read or written; nil if there was none
+}
+
+// fileDeadLetterLine is one line of the file: a letter, or a tombstone for its key.
+type fileDeadLetterLine struct {
+	deadLetter
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func newFileDeadLetters(path string) (*fileDeadLetters, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return &fileDeadLetters{path: path, compactMinLines: 1000}, nil
+}
+
+func (f *fileDeadLetters) Put(ctx context.Context, r IngestRecord, cause error, attempts int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	letters, err := f.index()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	dl := deadLetter{Record: r, Error: cause.Error(), Attempts: attempts, FirstFailedAt: now, LastFailedAt: now}
+	if prev, ok := letters[r.IdempotencyKey]; ok {
+		dl.Attempts += prev.Attempts
+		dl.FirstFailedAt = prev.FirstFailedAt
+	}
+	return f.append(fileDeadLetterLine{deadLetter: dl})
+}
+
+func (f *fileDeadLetters) List(ctx context.Context, limit int) ([]deadLetter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	letters, err := f.index()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]deadLetter, 0, len(letters))
+	for _, dl := range letters {
+		out = append(out, dl)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].FirstFailedAt.Equal(out[j].FirstFailedAt) {
+			return out[i].FirstFailedAt.Before(out[j].FirstFailedAt)
+		}
+		return out[i].Record.IdempotencyKey < out[j].Record.IdempotencyKey
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (f *fileDeadLetters) Delete(ctx context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	letters, err := f.index()
+	if err != nil {
+		return err
+	}
+	if _, ok := letters[key]; !ok {
+		return nil
+	}
+	return f.append(fileDeadLetterLine{deadLetter: deadLetter{Record: IngestRecord{IdempotencyKey: key}}, Deleted: true})
+}
+
+func (f *fileDeadLetters) Depth(ctx context.Context) (map[string]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	letters, err := f.index()
+	if err != nil {
+		return nil, err
+	}
+	depth := map[string]int{}
+	for _, dl := range letters {
+		depth[dl.Record.ChainID]++
+	}
+	return depth, nil
+}
+
+// index returns the live letters, reading the file first unless it is still the one last read or
+// written. Caller holds f.mu.
+func (f *fileDeadLetters) index() (map[string]deadLetter, error) {
+	fi, err := os.Stat(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if f.letters == nil || f.seen != nil { // first use, or removed by someone else
+			f.letters, f.lines, f.seen = map[string]deadLetter{}, 0, nil
+		}
+		return f.letters, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.letters != nil && f.seen != nil && os.SameFile(fi, f.seen) && fi.Size() == f.seen.Size() {
+		return f.letters, nil
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.seen = fi
+	return f.letters, nil
+}
+
+// load reads the file; later lines for a key supersede earlier ones. Caller holds f.mu.
+func (f *fileDeadLetters) load() error {
+	letters, lines := map[string]deadLetter{}, 0
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024) // records carry whole block payloads
+	for sc.Scan() {
+		lines++
+		var l fileDeadLetterLine
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			return fmt.Errorf("%s:%d: %w", f.path, lines, err)
+		}
+		if l.Deleted {
+			delete(letters, l.Record.IdempotencyKey)
+		} else {
+			letters[l.Record.IdempotencyKey] = l.deadLetter
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	f.letters, f.lines = letters, lines
+	return nil
+}
+
+// append writes l to the file and the index, then compacts if it is due. Caller holds f.mu.
+func (f *fileDeadLetters) append(l fileDeadLetterLine) error {
+	line, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	fi, err := file.Stat()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	f.seen = fi
+	f.lines++
+	if l.Deleted {
+		delete(f.letters, l.Record.IdempotencyKey)
+	} else {
+		f.letters[l.Record.IdempotencyKey] = l.deadLetter
+	}
+	if superseded := f.lines - len(f.letters); superseded >= f.compactMinLines && superseded > len(f.letters) {
+		if err := f.compact(); err != nil {
+			os.Remove(f.path + ".tmp") // l is stored either way; the next append tries again
+		}
+	}
+	return nil
+}
+
+// compact rewrites the file with only the live letters. Caller holds f.mu.
+func (f *fileDeadLetters) compact() error {
+	tmp := f.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, dl := range f.letters {
+		if err := enc.Encode(dl); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.seen, f.lines = fi, len(f.letters)
+	return nil
+}
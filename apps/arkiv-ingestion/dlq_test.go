@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	dlq, err := newFileDeadLetters(filepath.Join(t.TempDir(), "sub", "dlq.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := IngestRecord{IdempotencyKey: "1-1", ChainID: "1", BlockNumber: 1, Data: []byte(`{"bad`)}
+	r2 := IngestRecord{IdempotencyKey: "1-2", ChainID: "1", BlockNumber: 2, Data: []byte(`{}`)}
+
+	if err := dlq.Put(ctx, r1, errors.New("first"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := dlq.Put(ctx, r2, errors.New("other"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := dlq.Put(ctx, r1, errors.New("second"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if depth, _ := dlq.Depth(ctx); depth["1"] != 2 {
+		t.Errorf("depth = %v, want 2 for chain 1", depth)
+	}
+
+	letters, err := dlq.List(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || letters[0].Record.IdempotencyKey != "1-1" {
+		t.Fatalf("list = %+v, want 1-1 first (oldest)", letters)
+	}
+	if letters[0].Attempts != 6 || letters[0].Error != "second" || string(letters[0].Record.Data) != `{"bad` {
+		t.Errorf("letter = %+v, want attempts 6, latest error, payload kept verbatim", letters[0])
+	}
+
+	if err := dlq.Delete(ctx, "1-1"); err != nil {
+		t.Fatal(err)
+	}
+	letters, _ = dlq.List(ctx, 10)
+	if len(letters) != 1 || letters[0].Record.IdempotencyKey != "1-2" {
+		t.Errorf("after delete list = %+v", letters)
+	}
+}
+
+func TestFileDeadLettersCompacts(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dlq.jsonl")
+	dlq, err := newFileDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlq.compactMinLines = 10
+	keep := IngestRecord{IdempotencyKey: "1-1", ChainID: "1", BlockNumber: 1, Data: []byte(`{}`)}
+	if err := dlq.Put(ctx, keep, errMock, 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ { // a block the gap scanner keeps dead-lettering, and a replayed one
+		if err := dlq.Put(ctx, IngestRecord{IdempotencyKey: "1-2", ChainID: "1", BlockNumber: 2, Data: []byte(`{}`)}, errMock, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := dlq.Delete(ctx, "1-2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, _ := os.ReadFile(path)
+	if lines := strings.Count(string(raw), "\n"); lines > 2*dlq.compactMinLines {
+		t.Fatalf("file has %d lines for 1 letter, want it compacted", lines)
+	}
+
+	// Another process (replay-dlq) changing the file is picked up; tombstones survive a reopen.
+	other, _ := newFileDeadLetters(path)
+	if err := other.Delete(ctx, "1-1"); err != nil {
+		t.Fatal(err)
+	}
+	if letters, _ := dlq.List(ctx, 10); len(letters) != 0 {
+		t.Fatalf("list = %+v after another process deleted 1-1", letters)
+	}
+	if err := dlq.Put(ctx, keep, errMock, 1); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _ := newFileDeadLetters(path)
+	if letters, _ := reopened.List(ctx, 10); len(letters) != 1 || letters[0].Attempts != 1 {
+		t.Fatalf("reopened list = %+v, want 1-1 once with 1 attempt", letters)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	dlq, err := newFileDeadLetters(filepath.Join(t.TempDir(), "dlq.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"ok", "poison"} {
+		r := IngestRecord{IdempotencyKey: key, ChainID: "1", Data: []byte("{}")}
+		if err := dlq.Put(ctx, r, errMock, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ing := &recordingIngester{fail: map[string]bool{"poison": true}}
+
+	replayed, failed, err := replayDeadLetters(ctx, dlq, ing, testRetryPolicy, 10, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 || failed != 1 {
+		t.Errorf("replayed/failed = %d/%d, want 1/1", replayed, failed)
+	}
+	letters, _ := dlq.List(ctx, 10)
+	if len(letters) != 1 || letters[0].Record.IdempotencyKey != "poison" || letters[0].Attempts != 3+testRetryPolicy.maxAttempts {
+		t.Errorf("remaining = %+v, want poison with attempts bumped", letters)
+	}
+}
+
+func TestSchedulerDeadLettersFailedRecords(t *testing.T) {
+	dlq, err := newFileDeadLetters(filepath.Join(t.TempDir(), "dlq.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &scheduler{
+		fetcher:  &fakeFetcher{},
+		ingester: &recordingIngester{fail: map[string]bool{"k": true}},
+		retry:    testRetryPolicy,
+		dlq:      dlq,
+		log:      discardLogger(),
+	}
+	s.pending = []IngestRecord{{IdempotencyKey: "k", ChainID: "1", BlockNumber: 5}}
+	s.flush(context.Background())
+
+	letters, err := dlq.List(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Record.BlockNumber != 5 {
+		t.Errorf("dlq = %+v, want block 5", letters)
+	}
+}
+
+func TestSchedulerKeepsCanceledRecords(t *testing.T) {
+	dlq, err := newFileDeadLetters(filepath.Join(t.TempDir(), "dlq.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &recordingIngester{}
+	canceling := &mockIngester{ingest: func() error {
+		if ctx.Err() == nil {
+			cancel() // shutdown arrives mid-write
+		}
+		return ctx.Err()
+	}}
+	s := &scheduler{chainID: "1", fetcher: &fakeFetcher{}, ingester: canceling, retry: testRetryPolicy, dlq: dlq, log: discardLogger()}
+	s.pending = []IngestRecord{{IdempotencyKey: "1-1", ChainID: "1", BlockNumber: 1}, {IdempotencyKey: "1-2", ChainID: "1", BlockNumber: 2}}
+	if s.flush(ctx) {
+		t.Fatal("flush reported success")
+	}
+	if letters, _ := dlq.List(context.Background(), 10); len(letters) != 0 {
+		t.Fatalf("dlq = %+v, want canceled records kept out of it", letters)
+	}
+	if len(s.pending) != 2 {
+		t.Fatalf("pending = %d records, want both kept", len(s.pending))
+	}
+
+	// The shutdown flush writes them.
+	s.ingester = store
+	if !s.flush(context.Background()) || !reflect.DeepEqual(store.ingested, []string{"1-1", "1-2"}) {
+		t.Errorf("ingested %v, want [1-1 1-2]", store.ingested)
+	}
+}
+
+func TestSchedulerDeadLettersTimedOutWrites(t *testing.T) {
+	dlq, err := newFileDeadLetters(filepath.Join(t.TempDir(), "dlq.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tee := &teeIngester{log: discardLogger(), sinks: []sink{
+		{name: "t-ok", ingester: &recordingIngester{}, required: true, retry: testRetryPolicy},
+		{name: "t-slow", ingester: blockingIngester{}, required: true, retry: testRetryPolicy, timeout: 20 * time.Millisecond},
+	}}
+	s := &scheduler{chainID: "1", fetcher: &fakeFetcher{}, ingester: tee, retry: testRetryPolicy, dlq: dlq, log: discardLogger()}
+	s.pending = []IngestRecord{{IdempotencyKey: "1-1", ChainID: "1", BlockNumber: 1}}
+	if s.flush(context.Background()) {
+		t.Fatal("flush reported success")
+	}
+	if len(s.pending) != 0 {
+		t.Fatalf("pending = %d records, want the timed-out write dead-lettered, not kept", len(s.pending))
+	}
+	if letters, _ := dlq.List(context.Background(), 10); len(letters) != 1 || letters[0].Record.IdempotencyKey != "1-1" {
+		t.Fatalf("dlq = %+v, want 1-1", letters)
+	}
+}
+
+func TestSchedulerDeadLettersOnlyBadRecordsOfRejectedBatch(t *testing.T) {
+	dlq, err := newFileDeadLetters(filepath.Join(t.TempDir(), "dlq.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &batchRejecter{recordingIngester{fail: map[string]bool{"1-2": true}}}
+	s := &scheduler{chainID: "1", fetcher: &fakeFetcher{}, ingester: store, retry: testRetryPolicy, dlq: dlq, log: discardLogger()}
+	for n := uint64(1); n <= 3; n++ {
+		s.pending = append(s.pending, IngestRecord{IdempotencyKey: fmt.Sprintf("1-%d", n), ChainID: "1", BlockNumber: n})
+	}
+	if s.flush(context.Background()) {
+		t.Error("flush reported success with a bad record")
+	}
+	if !reflect.DeepEqual(store.ingested, []string{"1-1", "1-3"}) {
+		t.Errorf("ingested %v, want [1-1 1-3]", store.ingested)
+	}
+	letters, _ := dlq.List(context.Background(), 10)
+	if len(letters) != 1 || letters[0].Record.IdempotencyKey != "1-2" {
+		t.Errorf("dlq = %+v, want only 1-2", letters)
+	}
+}
+
+// batchRejecter fails a whole batch permanently if any of its records would fail, like a COPY
+// hitting one malformed payload.
+type batchRejecter struct{ recordingIngester }
+
+func (b *batchRejecter) Ingest(ctx context.Context, rec IngestRecord) error {
+	if b.fail[rec.IdempotencyKey] {
+		return fmt.Errorf("%w: %s", errInvalidPayload, rec.IdempotencyKey)
+	}
+	return b.recordingIngester.Ingest(ctx, rec)
+}
+
+func (b *batchRejecter) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	for _, r := range records {
+		if b.fail[r.IdempotencyKey] {
+			return fmt.Errorf("%w: %s", errInvalidPayload, r.IdempotencyKey)
+		}
+	}
+	for _, r := range records {
+		b.ingested = append(b.ingested, r.IdempotencyKey)
+	}
+	return nil
+}
+
+// recordingIngester fails for keys in fail and records the rest.
+type recordingIngester struct {
+	fail     map[string]bool
+	ingested []string
+}
+
+func (r *recordingIngester) Ingest(ctx context.Context, rec IngestRecord) error {
+	if r.fail[rec.IdempotencyKey] {
+		return errMock
+	}
+	r.ingested = append(r.ingested, rec.IdempotencyKey)
+	return nil
+}
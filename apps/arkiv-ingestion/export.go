@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+)
+
+// exportRecords writes chainID's stored records with from <= block_number <= to to w, one JSON
+// object per line (as served by the read API), in block order, reading pageSize rows at a time.
+// Returns how many records were written.
+func exportRecords(ctx context.Context, store recordReader, chainID string, from, to uint64, pageSize int, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	written := 0
+	for from <= to {
+		page, err := store.ListBlocks(ctx, chainID, from, to, pageSize)
+		if err != nil {
+			return written, err
+		}
+		for i := range page {
+			if err := enc.Encode(&page[i]); err != nil {
+				return written, err
+			}
+			written++
+		}
+		if len(page) < pageSize {
+			break
+		}
+		last := page[len(page)-1].BlockNumber
+		if last == to {
+			break
+		}
+		from = last + 1
+	}
+	return written, bw.Flush()
+}
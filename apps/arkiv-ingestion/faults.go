@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault targets: the write path (every sink) and the chain fetchers.
+const (
+	faultIngester = "ingester"
+	faultFetcher  = "fetcher"
+)
+
+// errInjectedFault is returned for injected errors. It classifies as retryable, like an
+// unrecognized backend error.
+var errInjectedFault = errors.New("injected fault")
+
+// faultConfig is what to inject into one target's calls. The zero value injects nothing.
+type faultConfig struct {
+	ErrorRate float64 `json:"error_rate"` // share of calls failing with errInjectedFault
+	LatencyMS int     `json:"latency_ms"` // added to every call
+	Hang      bool    `json:"hang"`       // calls block until the fault is cleared or the caller gives up
+	DropRate  float64 `json:"drop_rate"`  // share of calls failing as if the connection was reset
+}
+
+func (c faultConfig) validate() error {
+	if c.ErrorRate < 0 || c.ErrorRate > 1 || c.DropRate < 0 || c.DropRate > 1 {
+		return errors.New("error_rate and drop_rate must be between 0 and 1")
+	}
+	if c.LatencyMS < 0 {
+		return errors.New("latency_ms can't be negative")
+	}
+	return nil
+}
+
+// faultInjector holds the faults for gameday rehearsals (FAULT_INJECTION), set from FAULTS at
+// startup and changed at runtime through the admin API.
+type faultInjector struct {
+	mu      sync.Mutex
+	faults  map[string]faultConfig // by target
+	changed chan struct{}          // closed on every change, to release hung calls
+	rnd     *rand.Rand
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{
+		faults:  map[string]faultConfig{},
+		changed: make(chan struct{}),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// set replaces the faults of the given targets; a zero faultConfig clears one.
+func (f *faultInjector) set(faults map[string]faultConfig) error {
+	for target, c := range faults {
+		if target != faultIngester && target != faultFetcher {
+			return fmt.Errorf("unknown fault target %q", target)
+		}
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for target, c := range faults {
+		if c == (faultConfig{}) {
+			delete(f.faults, target)
+		} else {
+			f.faults[target] = c
+		}
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return nil
+}
+
+func (f *faultInjector) snapshot() map[string]faultConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]faultConfig, len(f.faults))
+	for target, c := range f.faults {
+		out[target] = c
+	}
+	return out
+}
+
+// inject applies target's faults to one call: it hangs and sleeps as configured, then returns the
+// error the call should fail with, or nil to let it through.
+func (f *faultInjector) inject(ctx context.Context, target string) error {
+	for {
+		f.mu.Lock()
+		c, changed := f.faults[target], f.changed
+		roll := f.rnd.Float64()
+		f.mu.Unlock()
+
+		if c.Hang {
+			faultsInjected.WithLabelValues(target, "hang").Inc()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-changed:
+				continue // re-read: the hang may have been cleared
+			}
+		}
+		if c.LatencyMS > 0 {
+			faultsInjected.WithLabelValues(target, "latency").Inc()
+			t := time.NewTimer(time.Duration(c.LatencyMS) * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+		switch {
+		case roll < c.DropRate:
+			faultsInjected.WithLabelValues(target, "drop").Inc()
+			return &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+		case roll < c.DropRate+c.ErrorRate:
+			faultsInjected.WithLabelValues(target, "error").Inc()
+			return fmt.Errorf("%w (%s)", errInjectedFault, target)
+		}
+		return nil
+	}
+}
+
+// faultyIngester injects the ingester faults in front of the wrapped ingester.
+type faultyIngester struct {
+	ArkivIngester
+	faults *faultInjector
+}
+
+func (f *faultyIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	if err := f.faults.inject(ctx, faultIngester); err != nil {
+		return err
+	}
+	return f.ArkivIngester.Ingest(ctx, r)
+}
+
+func (f *faultyIngester) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	if err := f.faults.inject(ctx, faultIngester); err != nil {
+		return err
+	}
+	if b, ok := f.ArkivIngester.(BatchIngester); ok {
+		return b.IngestBatch(ctx, records)
+	}
+	for _, r := range records {
+		if err := f.ArkivIngester.Ingest(ctx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *faultyIngester) Overwrite(ctx context.Context, r IngestRecord) error {
+	if err := f.faults.inject(ctx, faultIngester); err != nil {
+		return err
+	}
+	return overwriteRecord(ctx, f.ArkivIngester, r)
+}
+
+// faultyFetcher injects the fetcher faults in front of the wrapped fetcher's Head and FetchBlock.
+type faultyFetcher struct {
+	Fetcher
+	faults *faultInjector
+}
+
+func (f *faultyFetcher) Head(ctx context.Context) (uint64, error) {
+	if err := f.faults.inject(ctx, faultFetcher); err != nil {
+		return 0, err
+	}
+	return f.Fetcher.Head(ctx)
+}
+
+func (f *faultyFetcher) FetchBlock(ctx context.Context, n uint64) (*IngestRecord, error) {
+	if err := f.faults.inject(ctx, faultFetcher); err != nil {
+		return nil, err
+	}
+	return f.Fetcher.FetchBlock(ctx, n)
+}
+
+// faultySubscribingFetcher keeps the wrapped fetcher's head subscription; pushed heads aren't
+// faulted, the Head and FetchBlock calls that follow them are.
+type faultySubscribingFetcher struct {
+	*faultyFetcher
+	headSubscriber
+}
+
+// withFaults wraps fetcher with the fetcher faults, keeping its head subscription if it has one.
+func withFaults(fetcher Fetcher, faults *faultInjector) Fetcher {
+	ff := &faultyFetcher{Fetcher: fetcher, faults: faults}
+	if hs, ok := fetcher.(headSubscriber); ok {
+		return &faultySubscribingFetcher{faultyFetcher: ff, headSubscriber: hs}
+	}
+	return ff
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	ctx := context.Background()
+	faults := newFaultInjector()
+	ing := &faultyIngester{ArkivIngester: &fakeBatchIngester{}, faults: faults}
+	rec := IngestRecord{IdempotencyKey: "1-1", ChainID: "1", BlockNumber: 1}
+
+	if err := ing.IngestBatch(ctx, []IngestRecord{rec}); err != nil {
+		t.Fatalf("no faults: %v", err)
+	}
+
+	faults.set(map[string]faultConfig{faultIngester: {ErrorRate: 1}})
+	err := ing.Ingest(ctx, rec)
+	if !errors.Is(err, errInjectedFault) || classifyError(err) != errClassRetryable {
+		t.Errorf("error_rate 1: err = %v, want a retryable injected fault", err)
+	}
+	if _, err := withFaults(&fakeFetcher{head: 5}, faults).Head(ctx); err != nil {
+		t.Errorf("fetcher has no faults: %v", err)
+	}
+
+	faults.set(map[string]faultConfig{faultIngester: {DropRate: 1}})
+	var opErr *net.OpError
+	if err := ing.IngestBatch(ctx, []IngestRecord{rec}); !errors.As(err, &opErr) {
+		t.Errorf("drop_rate 1: err = %v, want a connection error", err)
+	}
+
+	faults.set(map[string]faultConfig{faultIngester: {LatencyMS: 60_000}})
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := ing.Ingest(short, rec); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("latency: err = %v, want the caller's deadline", err)
+	}
+
+	faults.set(map[string]faultConfig{faultIngester: {Hang: true}})
+	done := make(chan error, 1)
+	go func() { done <- ing.Ingest(ctx, rec) }()
+	select {
+	case err := <-done:
+		t.Fatalf("hang returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	faults.set(map[string]faultConfig{faultIngester: {}})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("after clearing the hang: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hang not released when cleared")
+	}
+	if got := faults.snapshot(); len(got) != 0 {
+		t.Errorf("faults after clearing = %v", got)
+	}
+
+	for _, bad := range []map[string]faultConfig{
+		{"network": {ErrorRate: 0.1}},
+		{faultFetcher: {ErrorRate: 2}},
+		{faultFetcher: {LatencyMS: -1}},
+	} {
+		if err := faults.set(bad); err == nil {
+			t.Errorf("set(%v): want error", bad)
+		}
+	}
+}
+
+func TestWithFaultsKeepsHeadSubscription(t *testing.T) {
+	faults := newFaultInjector()
+	if _, ok := withFaults(subscribingFetcher{&fakeFetcher{}}, faults).(headSubscriber); !ok {
+		t.Error("wrapped subscribing fetcher lost SubscribeHeads")
+	}
+	if _, ok := withFaults(&fakeFetcher{}, faults).(headSubscriber); ok {
+		t.Error("wrapped polling fetcher claims SubscribeHeads")
+	}
+}
+
+func TestAdminFaults(t *testing.T) {
+	faults := newFaultInjector()
+	mux := http.NewServeMux()
+	(&adminAPI{token: "s3cret", faults: faults, log: discardLogger()}).register(mux)
+	do := func(method, token, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, "/admin/faults", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do("PUT", "wrong", `{"ingester":{"error_rate":1}}`); code != http.StatusUnauthorized {
+		t.Errorf("bad token: status %d", code)
+	}
+	if code := do("PUT", "s3cret", `{"ingester":{"error_rate":0.5,"latency_ms":100}}`); code != http.StatusOK {
+		t.Fatalf("put: status %d", code)
+	}
+	if got := faults.snapshot()[faultIngester]; got.ErrorRate != 0.5 || got.LatencyMS != 100 {
+		t.Errorf("ingester faults = %+v", got)
+	}
+	for _, bad := range []string{`{"ingester":{"error_rate":5}}`, `{"disk":{"hang":true}}`, `{"ingester":{"eror_rate":1}}`, `[]`} {
+		if code := do("PUT", "s3cret", bad); code != http.StatusBadRequest {
+			t.Errorf("put %s: status %d", bad, code)
+		}
+	}
+	if code := do("DELETE", "s3cret", ""); code != http.StatusOK || len(faults.snapshot()) != 0 {
+		t.Errorf("delete: status %d, faults %v", code, faults.snapshot())
+	}
+
+	mux = http.NewServeMux()
+	(&adminAPI{token: "s3cret", log: discardLogger()}).register(mux)
+	req, _ := http.NewRequest("GET", "/admin/faults", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("without FAULT_INJECTION: status %d, want 404", rec.Code)
+	}
+}
@@ -2,31 +2,119 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math/big"
+	"math/rand"
+	"sync"
 	"time"
 )
 
-// syntheticFetcher generates fake blocks for demo/testing. No external RPC calls.
+// syntheticFetcher generates fake ethBlock payloads for demos, tests and gamedays. No external RPC
+// calls. Every block is derived from (scenario seed, chain, number), so payloads are the same on
+// every run and every re-fetch; only the head moves with the clock, starting at startHead at the
+// start time (process start, or the scenario's start_unix) and advancing one block per blockTime. The scenario adds reorgs, unavailable blocks, slow
+// responses, malformed payloads and error bursts (see syntheticScenario).
 // IdempotencyKey format: {chainID}-{blockNum}.
 type syntheticFetcher struct {
 	chainID   string
-	nextBlock uint64
+	startHead uint64
+	blockTime time.Duration
+	started   time.Time
+	clock     func() time.Time // time.Now unless fixed by a test
+	scenario  syntheticScenario
+
+	mu       sync.Mutex
+	attempts map[uint64]int // fetches per block hit by the error or missing fault, until it is served
+}
+
+// syntheticScenario configures a syntheticFetcher (the chain's "scenario" in CHAINS, or
+// SYNTHETIC_SCENARIO). Rates are shares of blocks, picked by the seed, so the same blocks are
+// affected on every run.
+type syntheticScenario struct {
+	Seed            int64   `json:"seed"`
+	GenesisUnix     int64   `json:"genesis_unix"`     // timestamp of block 0; default syntheticGenesisUnix
+	StartUnix       int64   `json:"start_unix"`       // when the head was at SYNTHETIC_START_HEAD; 0 = process start
+	MeanTxs         int     `json:"mean_txs"`         // average transactions per block; default 120
+	ReorgEvery      uint64  `json:"reorg_every"`      // when head reaches a multiple of this, the blocks below it are replaced
+	ReorgDepth      int     `json:"reorg_depth"`      // how many blocks a reorg replaces; default 1
+	MissingRate     float64 `json:"missing_rate"`     // blocks the node doesn't have yet (nil) for their first MissingAttempts fetches
+	MissingAttempts int     `json:"missing_attempts"` // default 3
+	SlowRate        float64 `json:"slow_rate"`        // blocks whose every fetch takes SlowMS
+	SlowMS          int     `json:"slow_ms"`          // default 2000
+	MalformedRate   float64 `json:"malformed_rate"`   // blocks whose payload is invalid JSON or fails decodeBlock
+	ErrorRate       float64 `json:"error_rate"`       // blocks whose first ErrorBurst fetches fail
+	ErrorBurst      int     `json:"error_burst"`      // default 5
+}
+
+func (s syntheticScenario) validate() error {
+	for name, rate := range map[string]float64{
+		"missing_rate": s.MissingRate, "slow_rate": s.SlowRate, "malformed_rate": s.MalformedRate, "error_rate": s.ErrorRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("scenario %s must be between 0 and 1", name)
+		}
+	}
+	if s.MeanTxs < 0 || s.ReorgDepth < 0 || s.MissingAttempts < 0 || s.SlowMS < 0 || s.ErrorBurst < 0 {
+		return errors.New("scenario counts can't be negative")
+	}
+	if s.ReorgEvery > 0 && uint64(max(s.ReorgDepth, 1)) >= s.ReorgEvery {
+		return errors.New("scenario reorg_depth must be below reorg_every")
+	}
+	return nil
 }
 
+// errSyntheticBurst is returned during a scenario's error bursts.
+var errSyntheticBurst = errors.New("synthetic fetch error")
+
 func newSyntheticFetcher(chainID string) *syntheticFetcher {
-	return &syntheticFetcher{chainID: chainID, nextBlock: 0}
+	return &syntheticFetcher{chainID: chainID, blockTime: 30 * time.Second, started: time.Now(), clock: time.Now}
+}
+
+func (s *syntheticFetcher) Head(ctx context.Context) (uint64, error) {
+	if s.blockTime <= 0 {
+		return s.startHead, nil
+	}
+	return s.startHead + uint64(s.clock().Sub(s.started)/s.blockTime), nil
 }
 
-func (s *syntheticFetcher) FetchNext(ctx context.Context) (*IngestRecord, error) {
-	blockNum := s.nextBlock
-	s.nextBlock++
-	data, err := json.Marshal(map[string]interface{}{
-		"block": blockNum, "chain": s.chainID, "ts": time.Now().Unix(),
-	})
+func (s *syntheticFetcher) FetchBlock(ctx context.Context, blockNum uint64) (*IngestRecord, error) {
+	head, err := s.Head(ctx)
 	if err != nil {
 		return nil, err
 	}
+	sc := s.scenario
+	if s.affected(blockNum, "slow", sc.SlowRate) {
+		t := time.NewTimer(time.Duration(orDefault(sc.SlowMS, 2000)) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+	failing, missing := s.affected(blockNum, "error", sc.ErrorRate), s.affected(blockNum, "missing", sc.MissingRate)
+	if failing || missing {
+		attempt := s.attempt(blockNum)
+		if failing && attempt <= orDefault(sc.ErrorBurst, 5) {
+			return nil, fmt.Errorf("%w: block %d, attempt %d", errSyntheticBurst, blockNum, attempt)
+		}
+		if missing && attempt <= orDefault(sc.MissingAttempts, 3) {
+			return nil, nil
+		}
+		s.forget(blockNum) // served: a later fetch starts the fault over
+	}
+
+	var data []byte
+	if s.affected(blockNum, "malformed", sc.MalformedRate) {
+		data = s.malformed(blockNum)
+	} else if data, err = json.Marshal(s.block(blockNum, head)); err != nil {
+		return nil, err
+	}
 	return &IngestRecord{
 		IdempotencyKey: fmt.Sprintf("%s-%d", s.chainID, blockNum),
 		ChainID:        s.chainID,
@@ -34,3 +122,204 @@ func (s *syntheticFetcher) FetchNext(ctx context.Context) (*IngestRecord, error)
 		Data:           data,
 	}, nil
 }
+
+func orDefault(n, def int) int {
+	if n > 0 {
+		return n
+	}
+	return def
+}
+
+func (s *syntheticFetcher) attempt(n uint64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attempts == nil {
+		s.attempts = map[uint64]int{}
+	}
+	s.attempts[n]++
+	return s.attempts[n]
+}
+
+func (s *syntheticFetcher) forget(n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, n)
+}
+
+// rng returns a generator seeded by the scenario seed, the chain and key, so each block (and
+// fault decision) gets its own reproducible stream regardless of fetch order.
+func (s *syntheticFetcher) rng(key string, n, version uint64) *rand.Rand {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%s/%d/%d", s.scenario.Seed, s.chainID, key, n, version)
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+func (s *syntheticFetcher) affected(n uint64, fault string, rate float64) bool {
+	return rate > 0 && s.rng(fault, n, 0).Float64() < rate
+}
+
+// version counts the reorgs that have replaced block n by the time head was reached.
+func (s *syntheticFetcher) version(n, head uint64) uint64 {
+	every := s.scenario.ReorgEvery
+	if every == 0 {
+		return 0
+	}
+	depth := uint64(max(s.scenario.ReorgDepth, 1))
+	// The reorg at a multiple m of every (once head >= m) replaces blocks m-depth .. m-1; depth
+	// is below every, so at most one reorg covers n: the one at the next multiple above n.
+	m := (n/every + 1) * every
+	if n+depth >= m && head >= m {
+		return 1
+	}
+	return 0
+}
+
+// hash derives a stable fake block hash; block 0's parent (n wraps to MaxUint64) is the zero hash.
+// Blocks replaced by a reorg (version > 0) get a different one.
+func (s *syntheticFetcher) hash(n uint64, version ...uint64) string {
+	if n == ^uint64(0) {
+		return "0x" + hex.EncodeToString(make([]byte, 32))
+	}
+	key := fmt.Sprintf("%s-%d", s.chainID, n)
+	if len(version) > 0 && version[0] > 0 {
+		key += fmt.Sprintf("-v%d", version[0])
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "0x" + hex.EncodeToString(sum[:])
+}
+
+const (
+	syntheticDefaultBlockTime = 12 * time.Second
+	syntheticGenesisUnix      = 1_700_000_000 // 2023-11-14; fixed so restarts don't change timestamps
+)
+
+// timestamp of block n: genesis plus n block times.
+func (s *syntheticFetcher) timestamp(n uint64) int64 {
+	bt := s.blockTime
+	if bt <= 0 {
+		bt = syntheticDefaultBlockTime
+	}
+	genesis := s.scenario.GenesisUnix
+	if genesis == 0 {
+		genesis = syntheticGenesisUnix
+	}
+	return genesis + int64(n)*int64(bt/time.Second)
+}
+
+// Event signatures for generated logs: Transfer, Approval, Swap (Uniswap v2) and Sync.
+var syntheticTopics = []string{
+	"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef",
+	"0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925",
+	"0xd78ad95fa46c994b6551d0da85fc275fe613ce37657fb8d5e3d130840159d822",
+	"0x1c411e9a96e071241c2f21f7726b17ae89e3cab4c78be50e062b03a9fffbbad1",
+}
+
+// block generates block n as of head: a mainnet-like shape with transfers, contract calls and
+// creations, inputs of varying size and 0-4 logs per call.
+func (s *syntheticFetcher) block(n, head uint64) ethBlock {
+	v := s.version(n, head)
+	r := s.rng("block", n, v)
+	parent := uint64(0)
+	if n > 0 {
+		parent = s.version(n-1, head)
+	}
+	b := ethBlock{
+		Number:        hexUint64(n),
+		Hash:          s.hash(n, v),
+		ParentHash:    s.hash(n-1, parent),
+		Timestamp:     hexUint64(s.timestamp(n)),
+		Miner:         syntheticAddress("miner", r.Intn(8)),
+		GasLimit:      30_000_000,
+		BaseFeePerGas: gwei(5 + r.Float64()*45),
+		Transactions:  []ethTransaction{},
+	}
+
+	txs := 0
+	if r.Float64() >= 0.03 { // a few blocks are empty
+		mean := float64(orDefault(s.scenario.MeanTxs, 120))
+		txs = max(0, int(mean+r.NormFloat64()*mean/3))
+	}
+	var gasUsed uint64
+	for i := 0; i < txs; i++ {
+		hash := fmt.Sprintf("%s-%d-%d-%d", s.chainID, n, v, i)
+		sum := sha256.Sum256([]byte(hash))
+		tx := ethTransaction{
+			Hash:             "0x" + hex.EncodeToString(sum[:]),
+			TransactionIndex: hexUint64(i),
+			From:             syntheticAddress("eoa", r.Intn(5000)),
+			Nonce:            hexUint64(r.Intn(100_000)),
+			GasPrice:         gwei(5 + r.Float64()*60),
+			Input:            "0x",
+		}
+		to := syntheticAddress("eoa", r.Intn(5000))
+		switch kind := r.Float64(); {
+		case kind < 0.35: // plain transfer
+			tx.Gas = 21_000
+			tx.Value = *weiUpTo(r, 10)
+		case kind < 0.98: // contract call
+			to = syntheticAddress("contract", r.Intn(200))
+			tx.Gas = hexUint64(50_000 + r.Intn(450_000))
+			tx.Input = randomHex(r, 4+32*r.Intn(9))
+			if r.Float64() < 0.2 {
+				tx.Value = *weiUpTo(r, 1)
+			}
+			for j, logs := 0, r.Intn(5); j < logs; j++ {
+				b.Logs = append(b.Logs, ethLog{
+					LogIndex:        hexUint64(len(b.Logs)),
+					TransactionHash: tx.Hash,
+					Address:         to,
+					Topics:          []string{syntheticTopics[r.Intn(len(syntheticTopics))], randomHex(r, 32), randomHex(r, 32)},
+					Data:            randomHex(r, 32*r.Intn(4)),
+				})
+			}
+		default: // contract creation
+			tx.Gas = hexUint64(500_000 + r.Intn(2_500_000))
+			tx.Input = randomHex(r, 1000+r.Intn(8000))
+			to = ""
+		}
+		if to != "" {
+			tx.To = &to
+		}
+		used := uint64(float64(tx.Gas) * (0.6 + 0.4*r.Float64()))
+		if gasUsed+used > uint64(b.GasLimit) {
+			break
+		}
+		gasUsed += used
+		b.Transactions = append(b.Transactions, tx)
+	}
+	b.GasUsed = hexUint64(gasUsed)
+	return b
+}
+
+// malformed returns a payload that is either not JSON at all or JSON that decodeBlock rejects.
+func (s *syntheticFetcher) malformed(n uint64) []byte {
+	if s.rng("malformed-kind", n, 0).Intn(2) == 0 {
+		return []byte(fmt.Sprintf(`{"number":"0x%x","hash":"%s","transactions":[{`, n, s.hash(n)))
+	}
+	return []byte(fmt.Sprintf(`{"number":"block %d","transactions":null}`, n))
+}
+
+func syntheticAddress(kind string, i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", kind, i)))
+	return "0x" + hex.EncodeToString(sum[:20])
+}
+
+func randomHex(r *rand.Rand, n int) string {
+	b := make([]byte, n)
+	r.Read(b)
+	return "0x" + hex.EncodeToString(b)
+}
+
+func gwei(g float64) *hexBig {
+	v := new(hexBig)
+	v.SetUint64(uint64(g * 1e9))
+	return v
+}
+
+// weiUpTo returns a random amount below eth ether, in wei.
+func weiUpTo(r *rand.Rand, eth int64) *hexBig {
+	limit := new(big.Int).Mul(big.NewInt(eth), big.NewInt(1e18))
+	v := new(hexBig)
+	v.Rand(r, limit)
+	return v
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fixedSynthetic returns a synthetic fetcher whose head is at head until moved with the returned func.
+func fixedSynthetic(sc syntheticScenario, head uint64) (*syntheticFetcher, func(uint64)) {
+	f := newSyntheticFetcher("1")
+	f.scenario = sc
+	f.blockTime = 12 * time.Second
+	f.started = time.Unix(1_700_000_000, 0)
+	now := f.started.Add(time.Duration(head) * f.blockTime)
+	f.clock = func() time.Time { return now }
+	return f, func(h uint64) { now = f.started.Add(time.Duration(h) * f.blockTime) }
+}
+
+func TestSyntheticFetcherDeterministic(t *testing.T) {
+	sc := syntheticScenario{Seed: 42, GenesisUnix: 1_600_000_000}
+	a, _ := fixedSynthetic(sc, 100)
+	b, _ := fixedSynthetic(sc, 100)
+	b.started = time.Now() // genesis is fixed, so the start time doesn't matter
+	sc.Seed = 43
+	other, _ := fixedSynthetic(sc, 100)
+	for n := uint64(0); n < 20; n++ {
+		ra, _ := a.FetchBlock(context.Background(), n)
+		rb, _ := b.FetchBlock(context.Background(), n)
+		ro, _ := other.FetchBlock(context.Background(), n)
+		if !bytes.Equal(ra.Data, rb.Data) {
+			t.Fatalf("block %d differs between fetchers with the same seed", n)
+		}
+		if n > 0 && bytes.Equal(ra.Data, ro.Data) {
+			t.Errorf("block %d is the same for a different seed", n)
+		}
+	}
+	r, _ := a.FetchBlock(context.Background(), 10)
+	if blk, _ := decodeBlock(r.Data); blk.Timestamp != 1_600_000_120 {
+		t.Errorf("timestamp = %d, want genesis + 10 block times", blk.Timestamp)
+	}
+}
+
+func TestSyntheticFetcherSameAfterRestart(t *testing.T) {
+	before := newFetcher(chainConfig{ID: "1", Scenario: &syntheticScenario{Seed: 7}}, config{}, discardLogger()).(*syntheticFetcher)
+	after := newFetcher(chainConfig{ID: "1", Scenario: &syntheticScenario{Seed: 7}}, config{}, discardLogger()).(*syntheticFetcher)
+	after.started = before.started.Add(time.Hour) // a restart an hour later
+	ra, _ := before.FetchBlock(context.Background(), 0)
+	rb, _ := after.FetchBlock(context.Background(), 0)
+	if !bytes.Equal(ra.Data, rb.Data) {
+		t.Fatal("block 0 changed with the start time")
+	}
+	if blk, _ := decodeBlock(ra.Data); blk.Timestamp != syntheticGenesisUnix {
+		t.Errorf("timestamp = %d, want the default genesis", blk.Timestamp)
+	}
+
+	sc := &syntheticScenario{StartUnix: 1_800_000_000}
+	f := newFetcher(chainConfig{ID: "1", IntervalSec: 12, Scenario: sc}, config{syntheticStartHead: 5}, discardLogger()).(*syntheticFetcher)
+	f.clock = func() time.Time { return time.Unix(1_800_000_120, 0) }
+	if head, _ := f.Head(context.Background()); head != 15 {
+		t.Errorf("head = %d, want 5 + 10 blocks since start_unix", head)
+	}
+}
+
+func TestSyntheticFetcherBlockShape(t *testing.T) {
+	f, _ := fixedSynthetic(syntheticScenario{Seed: 1}, 1000)
+	var txs, logs, creations, empty int
+	for n := uint64(1); n <= 100; n++ {
+		r, err := f.FetchBlock(context.Background(), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := decodeBlock(r.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.ParentHash != f.hash(n-1) || uint64(b.GasUsed) > uint64(b.GasLimit) || b.BaseFeePerGas == nil {
+			t.Fatalf("block %d = %+v", n, b)
+		}
+		if len(b.Transactions) == 0 {
+			empty++
+		}
+		txs += len(b.Transactions)
+		logs += len(b.Logs)
+		for _, tx := range b.Transactions {
+			if tx.To == nil {
+				creations++
+			}
+		}
+	}
+	if txs < 100*80 || txs > 100*160 || logs < txs || creations == 0 || empty == 100 {
+		t.Errorf("100 blocks: %d txs, %d logs, %d creations, %d empty", txs, logs, creations, empty)
+	}
+}
+
+func TestSyntheticFetcherReorg(t *testing.T) {
+	f, setHead := fixedSynthetic(syntheticScenario{ReorgEvery: 10, ReorgDepth: 2}, 9)
+	fetch := func(n uint64) *ethBlock {
+		t.Helper()
+		r, err := f.FetchBlock(context.Background(), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := decodeBlock(r.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	before := []*ethBlock{fetch(7), fetch(8), fetch(9)}
+	setHead(10)
+	after := []*ethBlock{fetch(7), fetch(8), fetch(9)}
+	tip := fetch(10)
+	if after[0].Hash != before[0].Hash {
+		t.Error("block 7 is below the reorg depth and shouldn't change")
+	}
+	if after[1].Hash == before[1].Hash || after[2].Hash == before[2].Hash {
+		t.Error("blocks 8 and 9 should be replaced once head reaches 10")
+	}
+	if after[1].ParentHash != after[0].Hash || after[2].ParentHash != after[1].Hash || tip.ParentHash != after[2].Hash {
+		t.Error("replaced blocks should chain onto each other")
+	}
+}
+
+func TestSyntheticFetcherFaults(t *testing.T) {
+	ctx := context.Background()
+
+	f, _ := fixedSynthetic(syntheticScenario{ErrorRate: 1, ErrorBurst: 2, MissingRate: 1, MissingAttempts: 3}, 100)
+	for attempt := 1; attempt <= 4; attempt++ {
+		r, err := f.FetchBlock(ctx, 5)
+		switch {
+		case attempt <= 2 && !errors.Is(err, errSyntheticBurst):
+			t.Errorf("attempt %d: err = %v, want error burst", attempt, err)
+		case attempt == 3 && (err != nil || r != nil):
+			t.Errorf("attempt %d: want missing block, got %v, %v", attempt, r, err)
+		case attempt == 4 && (err != nil || r == nil):
+			t.Errorf("attempt %d: want the block, got %v, %v", attempt, r, err)
+		}
+	}
+	if len(f.attempts) != 0 {
+		t.Errorf("attempts = %v, want none kept once the block was served", f.attempts)
+	}
+	f, _ = fixedSynthetic(syntheticScenario{}, 100)
+	for n := uint64(0); n < 50; n++ {
+		if _, err := f.FetchBlock(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.attempts) != 0 {
+		t.Errorf("attempts tracked for %d unfaulted blocks", len(f.attempts))
+	}
+
+	f, _ = fixedSynthetic(syntheticScenario{MalformedRate: 1}, 100)
+	for n := uint64(0); n < 10; n++ {
+		r, err := f.FetchBlock(ctx, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decodeBlock(r.Data); !errors.Is(err, errInvalidPayload) {
+			t.Errorf("block %d: decode err = %v, want errInvalidPayload", n, err)
+		}
+	}
+
+	f, _ = fixedSynthetic(syntheticScenario{SlowRate: 1, SlowMS: 60_000}, 100)
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := f.FetchBlock(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow fetch err = %v, want deadline exceeded", err)
+	}
+}
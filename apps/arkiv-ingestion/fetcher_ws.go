@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsFetcher is an rpcFetcher that learns about new heads from eth_subscribe("newHeads") over
+// WebSocket instead of waiting for the next poll. Blocks are still fetched over HTTP. After a
+// dropped connection it reconnects with backoff and re-reads eth_blockNumber, so the scheduler
+// fetches whatever was missed meanwhile. After maxFailures consecutive failed connections the
+// scheduler is left to its polling, which runs alongside the subscription anyway, and reconnects
+// carry on in the background at the capped backoff until the subscription is back.
+type wsFetcher struct {
+	*rpcFetcher
+	wsURL       string
+	dialer      *websocket.Dialer
+	reconnect   retryPolicy
+	maxFailures int           // consecutive failures before warning that the worker is polling
+	idleTimeout time.Duration // reconnect if no head arrives for this long
+	log         *slog.Logger
+}
+
+func newWSFetcher(chainID string, rpc rpcCaller, wsURL string, log *slog.Logger) *wsFetcher {
+	return &wsFetcher{
+		rpcFetcher:  newRPCFetcher(chainID, rpc),
+		wsURL:       wsURL,
+		dialer:      &websocket.Dialer{HandshakeTimeout: 10 * time.Second},
+		reconnect:   retryPolicy{baseDelay: time.Second, maxDelay: 30 * time.Second},
+		maxFailures: 5,
+		idleTimeout: 2 * time.Minute,
+		log:         log.With("chain_id", chainID),
+	}
+}
+
+func (f *wsFetcher) SubscribeHeads(ctx context.Context) (<-chan uint64, error) {
+	heads := make(chan uint64, 1)
+	go func() {
+		defer close(heads)
+		failures := 0
+		for {
+			subscribed, err := f.session(ctx, heads)
+			if ctx.Err() != nil {
+				return
+			}
+			if subscribed {
+				failures = 0
+			}
+			failures++
+			delay := f.reconnect.backoff(failures - 1)
+			switch {
+			case failures < f.maxFailures:
+				f.log.Warn("newHeads subscription lost; reconnecting", "err", err, "in", delay)
+			case failures == f.maxFailures:
+				f.log.Warn("newHeads subscription keeps failing; polling while it reconnects", "err", err)
+			}
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return heads, nil
+}
+
+type wsMessage struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+	Params struct {
+		Subscription string `json:"subscription"`
+		Result       struct {
+			Number hexUint64 `json:"number"`
+		} `json:"result"`
+	} `json:"params"`
+}
+
+// session runs one connection until it fails or ctx is done. subscribed reports whether
+// eth_subscribe succeeded.
+func (f *wsFetcher) session(ctx context.Context, heads chan uint64) (subscribed bool, err error) {
+	conn, _, err := f.dialer.DialContext(ctx, f.wsURL, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() }) // unblock reads on shutdown
+	defer stop()
+
+	req := rpcRequest{JSONRPC: "2.0", ID: 1, Method: "eth_subscribe", Params: []any{"newHeads"}}
+	if err := conn.WriteJSON(req); err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Now().Add(f.idleTimeout))
+	var resp wsMessage
+	if err := conn.ReadJSON(&resp); err != nil {
+		return false, err
+	}
+	if resp.Error != nil {
+		return false, fmt.Errorf("eth_subscribe: %w", resp.Error)
+	}
+	var subID string
+	if err := json.Unmarshal(resp.Result, &subID); err != nil || subID == "" {
+		return false, errors.New("eth_subscribe: no subscription id")
+	}
+
+	f.log.Info("newHeads subscribed")
+	// Catch up on anything missed while disconnected.
+	if head, err := f.Head(ctx); err == nil {
+		offerHead(heads, head)
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(f.idleTimeout))
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return true, err
+		}
+		if msg.Method == "eth_subscription" && msg.Params.Subscription == subID {
+			offerHead(heads, uint64(msg.Params.Result.Number))
+		}
+	}
+}
+
+// offerHead replaces any unread head with h; only the latest head matters. Single producer.
+func offerHead(heads chan uint64, h uint64) {
+	select {
+	case heads <- h:
+		return
+	default:
+	}
+	select {
+	case <-heads:
+	default:
+	}
+	select {
+	case heads <- h:
+	default:
+	}
+}
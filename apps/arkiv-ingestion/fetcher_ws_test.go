@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// nodeStandIn is a local Ethereum node stand-in: JSON-RPC over HTTP POST and a newHeads
+// subscription over WebSocket. Heads sent on push are announced to the connected subscriber;
+// a value on drop closes the connection.
+type nodeStandIn struct {
+	head     atomic.Uint64
+	refuse   atomic.Bool // reject WebSocket upgrades
+	dials    atomic.Int32
+	push     chan uint64
+	drop     chan struct{}
+	upgrader websocket.Upgrader
+}
+
+func newNodeStandIn(t *testing.T) (*nodeStandIn, *httptest.Server) {
+	n := &nodeStandIn{push: make(chan uint64), drop: make(chan struct{})}
+	srv := httptest.NewServer(n)
+	t.Cleanup(srv.Close)
+	return n, srv
+}
+
+func (n *nodeStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		n.dials.Add(1)
+		if n.refuse.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		n.serveWS(w, r)
+		return
+	}
+	var req rpcRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	var result any
+	switch req.Method {
+	case "eth_blockNumber":
+		result = fmt.Sprintf("0x%x", n.head.Load())
+	case "eth_getBlockByNumber":
+		num, _ := strconv.ParseUint(strings.TrimPrefix(req.Params[0].(string), "0x"), 16, 64)
+		if num <= n.head.Load() {
+			result = map[string]any{"number": fmt.Sprintf("0x%x", num), "hash": fmt.Sprintf("0x%x", num+1000), "transactions": []any{}}
+		}
+	case "eth_getLogs":
+		result = []any{}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+}
+
+func (n *nodeStandIn) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := n.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var req rpcRequest
+	if err := conn.ReadJSON(&req); err != nil || req.Method != "eth_subscribe" {
+		return
+	}
+	conn.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": "0xsub"})
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-n.drop:
+			return
+		case h := <-n.push:
+			n.head.Store(h)
+			conn.WriteJSON(map[string]any{"jsonrpc": "2.0", "method": "eth_subscription",
+				"params": map[string]any{"subscription": "0xsub", "result": map[string]any{"number": fmt.Sprintf("0x%x", h)}}})
+		}
+	}
+}
+
+func testWSFetcher(srv *httptest.Server) *wsFetcher {
+	f := newWSFetcher("1", newRPCClient(srv.URL), "ws"+strings.TrimPrefix(srv.URL, "http"), discardLogger())
+	f.reconnect = testRetryPolicy
+	f.maxFailures = 3
+	return f
+}
+
+func nextHead(t *testing.T, heads <-chan uint64) uint64 {
+	t.Helper()
+	select {
+	case h, ok := <-heads:
+		if !ok {
+			t.Fatal("heads closed")
+		}
+		return h
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for head")
+		return 0
+	}
+}
+
+func TestWSFetcherReconnectsAndCatchesUp(t *testing.T) {
+	node, srv := newNodeStandIn(t)
+	node.head.Store(3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	heads, err := testWSFetcher(srv).SubscribeHeads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := nextHead(t, heads); h != 3 {
+		t.Fatalf("initial head %d, want 3 from eth_blockNumber", h)
+	}
+	node.push <- 4
+	if h := nextHead(t, heads); h != 4 {
+		t.Fatalf("pushed head %d", h)
+	}
+
+	node.drop <- struct{}{}
+	node.head.Store(9) // blocks 5..9 produced while disconnected
+	if h := nextHead(t, heads); h != 9 {
+		t.Fatalf("head after reconnect %d, want 9", h)
+	}
+	node.push <- 10
+	if h := nextHead(t, heads); h != 10 {
+		t.Fatalf("pushed head %d", h)
+	}
+	if d := node.dials.Load(); d != 2 {
+		t.Fatalf("dials = %d", d)
+	}
+}
+
+func TestWSFetcherKeepsReconnectingWhilePolling(t *testing.T) {
+	node, srv := newNodeStandIn(t)
+	node.refuse.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	heads, _ := testWSFetcher(srv).SubscribeHeads(ctx)
+	waitFor(t, func() bool { return node.dials.Load() > 3 }) // past maxFailures
+	select {
+	case h, ok := <-heads:
+		t.Fatalf("got head %d (open %v) while the node refuses", h, ok)
+	default:
+	}
+
+	node.head.Store(7)
+	node.refuse.Store(false)
+	if h := nextHead(t, heads); h != 7 {
+		t.Fatalf("head after the node came back %d, want 7", h)
+	}
+	node.push <- 8
+	if h := nextHead(t, heads); h != 8 {
+		t.Fatalf("pushed head %d", h)
+	}
+}
+
+func TestSchedulerWithWSFetcherFillsMissedBlocks(t *testing.T) {
+	node, srv := newNodeStandIn(t)
+	node.head.Store(2)
+	ing := &repairIngester{}
+	s := &scheduler{
+		chainID:      "1",
+		fetcher:      testWSFetcher(srv),
+		ingester:     ing,
+		pollInterval: time.Hour, // only the subscription can move it along
+		batchSize:    1,
+		log:          discardLogger(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	waitFor(t, func() bool { return ing.has(2) })
+	node.drop <- struct{}{}
+	node.head.Store(6)
+	waitFor(t, func() bool { return ing.has(6) })
+	for n := uint64(0); n <= 6; n++ {
+		if !ing.has(n) {
+			t.Fatalf("block %d missed", n)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// blockRange is an inclusive range of block numbers.
+type blockRange struct{ from, to uint64 }
+
+func (r blockRange) len() uint64 { return r.to - r.from + 1 }
+
+// gapFinder lists missing blocks of a chain at or above from, below its highest stored block.
+type gapFinder interface {
+	Gaps(ctx context.Context, chainID string, from uint64, limit int) ([]blockRange, error)
+}
+
+// gapsQuery finds holes with LAG over the distinct stored block numbers. from-1 is added as a
+// virtual row so a hole right after the start block is found too.
+func gapsQuery(table, column string) string {
+	return fmt.Sprintf(`
+		SELECT prev + 1, n - 1 FROM (
+			SELECT n, LAG(n) OVER (ORDER BY n) AS prev FROM (
+				SELECT DISTINCT %[2]s AS n FROM %[1]s WHERE chain_id = $1 AND %[2]s >= $2
+				UNION SELECT $2 - 1
+			) stored
+		) t
+		WHERE n > prev + 1
+		ORDER BY prev
+		LIMIT $3`, table, column)
+}
+
+func queryGaps(ctx context.Context, pool *pgxpool.Pool, query, chainID string, from uint64, limit int) ([]blockRange, error) {
+	rows, err := pool.Query(ctx, query, chainID, int64(from), limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (blockRange, error) {
+		var lo, hi int64
+		err := row.Scan(&lo, &hi)
+		return blockRange{from: uint64(lo), to: uint64(hi)}, err
+	})
+}
+
+func (p *postgresIngester) Gaps(ctx context.Context, chainID string, from uint64, limit int) ([]blockRange, error) {
+	if p.trimmed {
+		var lowest *int64
+		err := p.pool.QueryRow(ctx, `SELECT MIN(block_number) FROM ingestion_records WHERE chain_id = $1`, chainID).Scan(&lowest)
+		if err != nil {
+			return nil, err
+		}
+		if lowest != nil && uint64(*lowest) > from {
+			from = uint64(*lowest)
+		}
+	}
+	return queryGaps(ctx, p.pool, gapsQuery("ingestion_records", "block_number"), chainID, from, limit)
+}
+
+func (n *normalizedIngester) Gaps(ctx context.Context, chainID string, from uint64, limit int) ([]blockRange, error) {
+	return queryGaps(ctx, n.pool, gapsQuery("blocks", "number"), chainID, from, limit)
+}
+
+// gapScanLimit caps the ranges read per scan; the gauges undercount beyond it.
+const gapScanLimit = 1000
+
+// gapScanner periodically looks for holes in a chain's stored blocks (left by records that were
+// dead-lettered or lost) and hands them to the chain's scheduler, which re-fetches and ingests
+// them like any other block. Dead-lettered blocks are retried this way too.
+type gapScanner struct {
+	chainID   string
+	store     gapFinder
+	from      uint64 // chain start block
+	interval  time.Duration
+	maxRepair uint64 // blocks enqueued per scan
+	repairs   chan<- blockRange
+	log       *slog.Logger
+}
+
+func (g *gapScanner) run(ctx context.Context) {
+	t := time.NewTicker(g.interval)
+	defer t.Stop()
+	for {
+		if err := g.scan(ctx); err != nil && ctx.Err() == nil {
+			g.log.Warn("gap scan failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (g *gapScanner) scan(ctx context.Context) error {
+	gaps, err := g.store.Gaps(ctx, g.chainID, g.from, gapScanLimit)
+	if err != nil {
+		return err
+	}
+	var missing uint64
+	for _, r := range gaps {
+		missing += r.len()
+	}
+	ingestGaps.WithLabelValues(g.chainID).Set(float64(len(gaps)))
+	ingestGapBlocks.WithLabelValues(g.chainID).Set(float64(missing))
+	if len(gaps) > 0 {
+		g.log.Info("gaps found", "ranges", len(gaps), "blocks", missing, "first", gaps[0].from)
+	}
+
+	if len(g.repairs) > 0 {
+		return nil // scheduler still busy with the previous scan's repairs
+	}
+	budget := g.maxRepair
+	for _, r := range gaps {
+		if budget == 0 {
+			break
+		}
+		if r.len() > budget {
+			r.to = r.from + budget - 1
+		}
+		select {
+		case g.repairs <- r:
+			budget -= r.len()
+		default:
+			return nil // queue full; the next scan picks up the rest
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeGapFinder struct{ gaps []blockRange }
+
+func (f *fakeGapFinder) Gaps(ctx context.Context, chainID string, from uint64, limit int) ([]blockRange, error) {
+	return f.gaps, nil
+}
+
+func TestGapScannerEnqueuesWithinBudget(t *testing.T) {
+	repairs := make(chan blockRange, 4)
+	g := &gapScanner{
+		chainID:   "gaps-1",
+		store:     &fakeGapFinder{gaps: []blockRange{{3, 4}, {10, 19}, {30, 30}}},
+		maxRepair: 5,
+		repairs:   repairs,
+		log:       discardLogger(),
+	}
+	if err := g.scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(ingestGaps.WithLabelValues("gaps-1")); got != 3 {
+		t.Errorf("gaps = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(ingestGapBlocks.WithLabelValues("gaps-1")); got != 13 {
+		t.Errorf("gap blocks = %v, want 13", got)
+	}
+	if r := <-repairs; r != (blockRange{3, 4}) {
+		t.Fatalf("first repair %v", r)
+	}
+	if r := <-repairs; r != (blockRange{10, 12}) {
+		t.Fatalf("second repair %v, want budget-capped 10..12", r)
+	}
+	if len(repairs) != 0 {
+		t.Fatalf("budget exceeded: %d more queued", len(repairs))
+	}
+
+	repairs <- blockRange{1, 1} // scheduler hasn't caught up yet
+	g.scan(context.Background())
+	if len(repairs) != 1 {
+		t.Fatal("scan enqueued on top of unfinished repairs")
+	}
+}
+
+// repairIngester records the block numbers it ingests.
+type repairIngester struct {
+	mu     sync.Mutex
+	blocks []uint64
+}
+
+func (r *repairIngester) Ingest(ctx context.Context, rec IngestRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blocks = append(r.blocks, rec.BlockNumber)
+	return nil
+}
+
+func (r *repairIngester) has(n uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, b := range r.blocks {
+		if b == n {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSchedulerRepairsGapsWithoutMovingCursor(t *testing.T) {
+	f := &fakeFetcher{head: 19}
+	ing := &repairIngester{}
+	repairs := make(chan blockRange, 1)
+	s := &scheduler{
+		chainID:      "gaps-2",
+		fetcher:      f,
+		ingester:     ing,
+		next:         20, // caught up
+		pollInterval: time.Hour,
+		batchSize:    2,
+		repairs:      repairs,
+		log:          discardLogger(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	repairs <- blockRange{5, 7}
+	waitFor(t, func() bool { return ing.has(5) && ing.has(6) && ing.has(7) })
+	cancel()
+	<-done
+	if s.next != 20 {
+		t.Fatalf("cursor moved to %d", s.next)
+	}
+}
+
+func TestPostgresGaps(t *testing.T) {
+	ing := testDBIngester(t)
+	ctx := context.Background()
+	chainID := fmt.Sprintf("gaps-%d", time.Now().UnixNano())
+	for _, n := range []uint64{2, 3, 6, 9} {
+		r := IngestRecord{IdempotencyKey: fmt.Sprintf("%s-%d", chainID, n), ChainID: chainID, BlockNumber: n, Data: []byte(`{}`)}
+		if err := ing.Ingest(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gaps, err := ing.Gaps(ctx, chainID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []blockRange{{0, 1}, {4, 5}, {7, 8}}; fmt.Sprint(gaps) != fmt.Sprint(want) {
+		t.Fatalf("gaps %v, want %v", gaps, want)
+	}
+	if gaps, _ := ing.Gaps(ctx, chainID, 3, 10); fmt.Sprint(gaps) != "[{4 5} {7 8}]" {
+		t.Fatalf("from 3: %v", gaps)
+	}
+}
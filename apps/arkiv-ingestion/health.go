@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pinger is the part of *pgxpool.Pool the readiness check uses.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// readiness serves GET /readyz: 200 only if the database answers and every chain worker is making
+// progress and keeping up with head. The body breaks down each check so on-call can see which failed.
+// With leader election, chains this replica is standby for are reported but not checked, so
+// standbys stay ready (and serve reads); the same goes for chains paused via the admin API.
+type readiness struct {
+	db        pinger
+	chains    []*chainState
+	dbTimeout time.Duration
+	maxStall  time.Duration // max time since a chain last made progress
+	maxLag    uint64        // max blocks behind head; 0 disables the check
+}
+
+type checkResult struct {
+	Status string `json:"status"` // "ok" or "fail"
+	Detail string `json:"detail,omitempty"`
+}
+
+type readinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+func (rd *readiness) check(ctx context.Context) readinessReport {
+	report := readinessReport{Status: "ok", Checks: map[string]checkResult{}}
+	add := func(name string, ok bool, detail string) {
+		res := checkResult{Status: "ok", Detail: detail}
+		if !ok {
+			res.Status = "fail"
+			report.Status = "fail"
+		}
+		report.Checks[name] = res
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, rd.dbTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := rd.db.Ping(pingCtx); err != nil {
+		add("database", false, err.Error())
+	} else {
+		add("database", true, fmt.Sprintf("ping %dms", time.Since(start).Milliseconds()))
+	}
+
+	now := time.Now()
+	for _, cs := range rd.chains {
+		snap := cs.snapshot()
+		if snap.Role != "" {
+			add("leader:"+snap.ChainID, true, snap.Role)
+		}
+		if snap.Role == "standby" {
+			continue
+		}
+		if snap.Paused {
+			add("paused:"+snap.ChainID, true, "paused via admin API")
+			continue
+		}
+		since := snap.LastProgress
+		if since.IsZero() {
+			since = snap.Started // grace period after startup
+		}
+		stall := now.Sub(since).Truncate(time.Second)
+		detail := fmt.Sprintf("last progress %s ago", stall)
+		if snap.LastError != "" {
+			detail += "; last error: " + snap.LastError
+		}
+		add("progress:"+snap.ChainID, stall <= rd.maxStall, detail)
+		if rd.maxLag > 0 {
+			lag := snap.Lag()
+			add("lag:"+snap.ChainID, lag <= rd.maxLag, fmt.Sprintf("%d blocks behind head %d (max %d)", lag, snap.Head, rd.maxLag))
+		}
+	}
+	return report
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := rd.check(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// liveness wraps handleHealthz and fails if any chain worker's loop has stopped iterating for
+// longer than maxStall, so the kubelet restarts a wedged pod. Database outages don't fail it:
+// the worker keeps looping (and backing off) while Postgres is down.
+func liveness(chains []*chainState, maxStall time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, cs := range chains {
+			snap := cs.snapshot()
+			if since := time.Since(snap.LastBeat); since > maxStall {
+				http.Error(w, fmt.Sprintf("chain %s worker stalled for %s", snap.ChainID, since.Truncate(time.Second)), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		handleHealthz(w, r)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakePinger struct{ err error }
+
+func (f fakePinger) Ping(ctx context.Context) error { return f.err }
+
+func getReadyz(t *testing.T, rd *readiness) (int, readinessReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	rd.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report readinessReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestReadyz(t *testing.T) {
+	cs := newChainState("1")
+	cs.position(100, 95)
+	cs.progressed()
+	rd := &readiness{db: fakePinger{}, chains: []*chainState{cs}, dbTimeout: time.Second, maxStall: time.Minute, maxLag: 10}
+
+	code, report := getReadyz(t, rd)
+	if code != http.StatusOK || report.Status != "ok" || report.Checks["lag:1"].Status != "ok" {
+		t.Errorf("healthy: %d %+v", code, report)
+	}
+
+	rd.db = fakePinger{err: errors.New("connection refused")}
+	code, report = getReadyz(t, rd)
+	if code != http.StatusServiceUnavailable || report.Checks["database"].Status != "fail" || report.Checks["progress:1"].Status != "ok" {
+		t.Errorf("db down: %d %+v", code, report)
+	}
+
+	rd.db = fakePinger{}
+	cs.position(1000, 95)
+	code, report = getReadyz(t, rd)
+	if code != http.StatusServiceUnavailable || report.Checks["lag:1"].Status != "fail" {
+		t.Errorf("lagging: %d %+v", code, report)
+	}
+
+	cs.position(100, 95)
+	cs.mu.Lock()
+	cs.lastProgress = time.Now().Add(-2 * time.Minute)
+	cs.mu.Unlock()
+	code, report = getReadyz(t, rd)
+	if code != http.StatusServiceUnavailable || report.Checks["progress:1"].Status != "fail" {
+		t.Errorf("stalled: %d %+v", code, report)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	cs := newChainState("1")
+	h := liveness([]*chainState{cs}, time.Minute)
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("fresh worker: %d, want 200", rec.Code)
+	}
+
+	cs.mu.Lock()
+	cs.lastBeat = time.Now().Add(-2 * time.Minute)
+	cs.mu.Unlock()
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("wedged worker: %d, want 503", rec.Code)
+	}
+}
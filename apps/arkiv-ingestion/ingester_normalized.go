@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// normalizedIngester decodes the ethBlock payload into blocks, transactions and logs, written in
+// one transaction per block. A block already stored for (chain_id, number) is skipped entirely,
+// matching postgresIngester's ON CONFLICT DO NOTHING semantics.
+type normalizedIngester struct {
+	pool *pgxpool.Pool
+}
+
+func (n *normalizedIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	return n.write(ctx, r, false)
+}
+
+// Overwrite replaces the stored block with r's version. The old block row is deleted, taking its
+// transactions and logs with it (ON DELETE CASCADE), in the same transaction as the insert.
+func (n *normalizedIngester) Overwrite(ctx context.Context, r IngestRecord) error {
+	return n.write(ctx, r, true)
+}
+
+func (n *normalizedIngester) write(ctx context.Context, r IngestRecord, replace bool) error {
+	b, err := decodeBlock(r.Data)
+	if err != nil {
+		return err
+	}
+	if uint64(b.Number) != r.BlockNumber {
+		return fmt.Errorf("%w: block %d: payload has number %d", errInvalidPayload, r.BlockNumber, uint64(b.Number))
+	}
+
+	tx, err := n.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no-op after Commit
+
+	if replace {
+		if _, err := tx.Exec(ctx, `DELETE FROM blocks WHERE chain_id = $1 AND number = $2`, r.ChainID, int64(b.Number)); err != nil {
+			return fmt.Errorf("delete block: %w", err)
+		}
+	}
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO blocks (chain_id, number, hash, parent_hash, timestamp, miner, gas_used, gas_limit, base_fee_per_gas, tx_count)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		 ON CONFLICT (chain_id, number) DO NOTHING`,
+		r.ChainID, int64(b.Number), strings.ToLower(b.Hash), strings.ToLower(b.ParentHash),
+		time.Unix(int64(b.Timestamp), 0).UTC(), nullableHex(b.Miner), int64(b.GasUsed), int64(b.GasLimit),
+		numericOrNull(b.BaseFeePerGas), len(b.Transactions),
+	)
+	if err != nil {
+		return fmt.Errorf("insert block: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		if err := tx.Commit(ctx); err != nil { // already ingested
+			return err
+		}
+		reportInserted(ctx)
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, t := range b.Transactions {
+		var to any
+		if t.To != nil {
+			to = strings.ToLower(*t.To)
+		}
+		batch.Queue(
+			`INSERT INTO transactions (chain_id, block_number, tx_index, hash, from_address, to_address, value, nonce, gas, gas_price, input)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			r.ChainID, int64(b.Number), int64(t.TransactionIndex), strings.ToLower(t.Hash), strings.ToLower(t.From), to,
+			numericOrNull(&t.Value), int64(t.Nonce), int64(t.Gas), numericOrNull(t.GasPrice), t.Input,
+		)
+	}
+	for _, l := range b.Logs {
+		var topics [4]any
+		for i := 0; i < len(l.Topics) && i < len(topics); i++ {
+			topics[i] = strings.ToLower(l.Topics[i])
+		}
+		batch.Queue(
+			`INSERT INTO logs (chain_id, block_number, log_index, tx_hash, address, topic0, topic1, topic2, topic3, data)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			r.ChainID, int64(b.Number), int64(l.LogIndex), strings.ToLower(l.TransactionHash), strings.ToLower(l.Address),
+			topics[0], topics[1], topics[2], topics[3], l.Data,
+		)
+	}
+	if batch.Len() > 0 {
+		if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+			return fmt.Errorf("insert transactions/logs: %w", err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	reportInserted(ctx, r.IdempotencyKey)
+	return nil
+}
+
+// Checkpoint returns the block after the highest one stored for chainID.
+func (n *normalizedIngester) Checkpoint(ctx context.Context, chainID string) (uint64, bool, error) {
+	var max *int64
+	err := n.pool.QueryRow(ctx, `SELECT MAX(number) FROM blocks WHERE chain_id = $1`, chainID).Scan(&max)
+	if err != nil || max == nil {
+		return 0, false, err
+	}
+	return uint64(*max) + 1, true, nil
+}
+
+func nullableHex(s string) any {
+	if s == "" {
+		return nil
+	}
+	return strings.ToLower(s)
+}
+
+func numericOrNull(h *hexBig) pgtype.Numeric {
+	if h == nil {
+		return pgtype.Numeric{}
+	}
+	return pgtype.Numeric{Int: new(big.Int).Set(&h.Int), Valid: true}
+}
@@ -5,15 +5,77 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// postgresIngester writes to ingestion_records. ON CONFLICT DO NOTHING ensures idempotency.
+// postgresIngester writes to ingestion_records. Rows whose idempotency key is already stored are
+// skipped: by ON CONFLICT DO NOTHING, and by an explicit check, since a partitioned table's
+// primary key also includes the partition column (see partitionConfig.convert). On a partitioned
+// table writers first lock the keys they write (see lockKeys), so the check holds across
+// partitions and concurrent writers. Each row actually inserted is announced with NOTIFY on
+// recordsChannel (see recordFeed) and reported to the caller's insertedKeys.
 type postgresIngester struct {
-	pool *pgxpool.Pool
+	pool        *pgxpool.Pool
+	partitioned bool // ingestion_records is partitioned: keys are locked before writing them
+	trimmed     bool // retention retires old partitions: blocks below a chain's lowest are not gaps
 }
 
-func newPostgresIngester(ctx context.Context, connStr string) (*postgresIngester, error) {
+// recordKeyLockClass is the first key of the pg_advisory_xact_lock(int, int) locks taken per
+// idempotency key, keeping them apart from the single-key locks used elsewhere.
+const recordKeyLockClass int32 = 0x61726b6b // "arkk"
+
+// newPostgresIngester connects and brings the schema up to date. With autoMigrate false it only
+// checks the schema and fails if migrations are pending (run `arkiv-ingestion migrate up` first).
+// Either way it refuses to start against a database migrated by a newer binary. partition selects
+// the partition_ingestion_records migration.
+func newPostgresIngester(ctx context.Context, connStr string, autoMigrate bool, partition partitionConfig) (*postgresIngester, error) {
+	pool, err := newPostgresPool(ctx, connStr)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMigrator(pool, partition)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	if autoMigrate {
+		_, err = m.up(ctx)
+	} else {
+		var pending []migration
+		pending, err = m.pending(ctx)
+		if err == nil && len(pending) > 0 {
+			err = fmt.Errorf("%d migration(s) pending, first is %d (%s)", len(pending), pending[0].version, pending[0].name)
+		}
+	}
+	var by string
+	if err == nil {
+		by, err = partitionedBy(ctx, pool)
+	}
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	return &postgresIngester{pool: pool, partitioned: by != ""}, nil
+}
+
+// lockKeys takes a transaction-scoped lock on each key when the table is partitioned, in key
+// order so two writers can't deadlock. Statements run after it see the rows other holders
+// committed, so the NOT EXISTS checks in Ingest, IngestBatch and Overwrite can't both pass.
+func (p *postgresIngester) lockKeys(ctx context.Context, tx pgx.Tx, keys ...string) error {
+	if !p.partitioned {
+		return nil
+	}
+	_, err := tx.Exec(ctx,
+		`SELECT pg_advisory_xact_lock($1, hashtext(k)) FROM (SELECT DISTINCT unnest($2::text[]) AS k ORDER BY 1) s`,
+		recordKeyLockClass, keys)
+	if err != nil {
+		return fmt.Errorf("lock keys: %w", err)
+	}
+	return nil
+}
+
+func newPostgresPool(ctx context.Context, connStr string) (*pgxpool.Pool, error) {
 	cfg, err := pgxpool.ParseConfig(connStr)
 	if err != nil {
 		return nil, err
@@ -23,29 +85,211 @@ func newPostgresIngester(ctx context.Context, connStr string) (*postgresIngester
 		return nil, err
 	}
 	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, err
 	}
-	_, err = pool.Exec(ctx, `
-		CREATE TABLE IF NOT EXISTS ingestion_records (
-			idempotency_key TEXT PRIMARY KEY,
+	return pool, nil
+}
+
+// Checkpoint returns the block after the highest one stored for chainID.
+func (p *postgresIngester) Checkpoint(ctx context.Context, chainID string) (uint64, bool, error) {
+	var max *int64
+	err := p.pool.QueryRow(ctx, `SELECT MAX(block_number) FROM ingestion_records WHERE chain_id = $1`, chainID).Scan(&max)
+	if err != nil || max == nil {
+		return 0, false, err
+	}
+	return uint64(*max) + 1, true, nil
+}
+
+func (p *postgresIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no-op after Commit
+	if err := p.lockKeys(ctx, tx, r.IdempotencyKey); err != nil {
+		return err
+	}
+	rows, err := tx.Query(ctx,
+		`WITH ins AS (
+		   INSERT INTO ingestion_records (idempotency_key, chain_id, block_number, data)
+		   SELECT $1::text, $2::text, $3::bigint, $4::jsonb
+		   WHERE NOT EXISTS (SELECT 1 FROM ingestion_records WHERE idempotency_key = $1)
+		   ON CONFLICT DO NOTHING
+		   RETURNING idempotency_key
+		 )
+		 SELECT ins.idempotency_key FROM ins, pg_notify($5, ins.idempotency_key)`,
+		r.IdempotencyKey, r.ChainID, r.BlockNumber, json.RawMessage(r.Data), recordsChannel,
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	reportInserted(ctx, inserted...)
+	return nil
+}
+
+// Overwrite replaces the payload stored under r's idempotency key, inserting the row if it is
+// missing, and announces it like a new row.
+func (p *postgresIngester) Overwrite(ctx context.Context, r IngestRecord) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no-op after Commit
+	if err := p.lockKeys(ctx, tx, r.IdempotencyKey); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`WITH up AS (
+		   UPDATE ingestion_records SET data = $4::jsonb WHERE idempotency_key = $1::text
+		   RETURNING idempotency_key
+		 ), ins AS (
+		   INSERT INTO ingestion_records (idempotency_key, chain_id, block_number, data)
+		   SELECT $1, $2::text, $3::bigint, $4
+		   WHERE NOT EXISTS (SELECT 1 FROM up)
+		   ON CONFLICT DO NOTHING
+		   RETURNING idempotency_key
+		 )
+		 SELECT pg_notify($5, idempotency_key) FROM (SELECT idempotency_key FROM up UNION ALL SELECT idempotency_key FROM ins) k`,
+		r.IdempotencyKey, r.ChainID, r.BlockNumber, json.RawMessage(r.Data), recordsChannel,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// IngestBatch COPYs records into a per-transaction staging table, then moves them into
+// ingestion_records with ON CONFLICT DO NOTHING, so duplicates are skipped (and not notified)
+// as in Ingest. Notifications are delivered on commit, in block order.
+func (p *postgresIngester) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no-op after Commit
+
+	_, err = tx.Exec(ctx, `
+		CREATE TEMP TABLE ingestion_records_staging (
+			idempotency_key TEXT,
 			chain_id TEXT,
 			block_number BIGINT,
-			data JSONB,
-			created_at TIMESTAMPTZ DEFAULT NOW()
-		)
+			data JSONB
+		) ON COMMIT DROP
 	`)
 	if err != nil {
-		return nil, fmt.Errorf("create table: %w", err)
+		return fmt.Errorf("create staging table: %w", err)
+	}
+	rows := make([][]any, len(records))
+	keys := make([]string, len(records))
+	for i, r := range records {
+		rows[i] = []any{r.IdempotencyKey, r.ChainID, int64(r.BlockNumber), json.RawMessage(r.Data)}
+		keys[i] = r.IdempotencyKey
+	}
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"ingestion_records_staging"},
+		[]string{"idempotency_key", "chain_id", "block_number", "data"},
+		pgx.CopyFromRows(rows),
+	)
+	if err != nil {
+		return fmt.Errorf("copy to staging: %w", err)
+	}
+	if err := p.lockKeys(ctx, tx, keys...); err != nil {
+		return err
 	}
-	return &postgresIngester{pool: pool}, nil
+	insRows, err := tx.Query(ctx, `
+		WITH ins AS (
+			INSERT INTO ingestion_records (idempotency_key, chain_id, block_number, data)
+			SELECT idempotency_key, chain_id, block_number, data FROM (
+				SELECT DISTINCT ON (idempotency_key) * FROM ingestion_records_staging s
+				WHERE NOT EXISTS (SELECT 1 FROM ingestion_records r WHERE r.idempotency_key = s.idempotency_key)
+				ORDER BY idempotency_key
+			) fresh
+			ORDER BY chain_id, block_number
+			ON CONFLICT DO NOTHING
+			RETURNING idempotency_key
+		)
+		SELECT ins.idempotency_key FROM ins, pg_notify($1, ins.idempotency_key)
+	`, recordsChannel)
+	if err != nil {
+		return fmt.Errorf("insert from staging: %w", err)
+	}
+	inserted, err := pgx.CollectRows(insRows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("insert from staging: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	reportInserted(ctx, inserted...)
+	return nil
 }
 
-func (p *postgresIngester) Ingest(ctx context.Context, r IngestRecord) error {
-	_, err := p.pool.Exec(ctx,
-		`INSERT INTO ingestion_records (idempotency_key, chain_id, block_number, data)
-		 VALUES ($1, $2, $3, $4)
-		 ON CONFLICT (idempotency_key) DO NOTHING`,
-		r.IdempotencyKey, r.ChainID, r.BlockNumber, json.RawMessage(r.Data),
-	)
-	return err
+func (p *postgresIngester) GetBlock(ctx context.Context, chainID string, number uint64) (*storedRecord, error) {
+	rows, err := p.pool.Query(ctx,
+		`SELECT chain_id, block_number, idempotency_key, created_at, data
+		 FROM ingestion_records WHERE chain_id = $1 AND block_number = $2
+		 ORDER BY created_at LIMIT 1`, chainID, int64(number))
+	if err != nil {
+		return nil, err
+	}
+	recs, err := pgx.CollectRows(rows, scanStoredRecord)
+	if err != nil || len(recs) == 0 {
+		return nil, err
+	}
+	return &recs[0], nil
+}
+
+// RecordByKey returns nil if no record has key.
+func (p *postgresIngester) RecordByKey(ctx context.Context, key string) (*storedRecord, error) {
+	rows, err := p.pool.Query(ctx,
+		`SELECT chain_id, block_number, idempotency_key, created_at, data
+		 FROM ingestion_records WHERE idempotency_key = $1`, key)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := pgx.CollectRows(rows, scanStoredRecord)
+	if err != nil || len(recs) == 0 {
+		return nil, err
+	}
+	return &recs[0], nil
+}
+
+func (p *postgresIngester) ListBlocks(ctx context.Context, chainID string, from, to uint64, limit int) ([]storedRecord, error) {
+	rows, err := p.pool.Query(ctx,
+		`SELECT chain_id, block_number, idempotency_key, created_at, data
+		 FROM ingestion_records WHERE chain_id = $1 AND block_number BETWEEN $2 AND $3
+		 ORDER BY block_number LIMIT $4`, chainID, int64(from), int64(to), limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanStoredRecord)
+}
+
+func (p *postgresIngester) Head(ctx context.Context, chainID string) (uint64, bool, error) {
+	next, ok, err := p.Checkpoint(ctx, chainID)
+	if !ok || err != nil {
+		return 0, false, err
+	}
+	return next - 1, true, nil
+}
+
+func scanStoredRecord(row pgx.CollectableRow) (storedRecord, error) {
+	var r storedRecord
+	var block int64
+	var data []byte
+	err := row.Scan(&r.ChainID, &block, &r.IdempotencyKey, &r.CreatedAt, &data)
+	r.BlockNumber = uint64(block)
+	r.Data = data
+	return r, err
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Benchmarks and database tests need a disposable database:
+// ARKIV_TEST_DATABASE_URL=postgres://... go test -bench Ingest -run ^$
+func testDBIngester(tb testing.TB) *postgresIngester {
+	tb.Helper()
+	url := os.Getenv("ARKIV_TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("ARKIV_TEST_DATABASE_URL not set")
+	}
+	ing, err := newPostgresIngester(context.Background(), url, true, partitionConfig{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(ing.pool.Close)
+	return ing
+}
+
+// benchRecords returns n records with keys unique to this run so every insert does real work.
+func benchRecords(n int) []IngestRecord {
+	prefix := fmt.Sprintf("bench-%d", time.Now().UnixNano())
+	out := make([]IngestRecord, n)
+	for i := range out {
+		out[i] = IngestRecord{
+			IdempotencyKey: fmt.Sprintf("%s-%d", prefix, i),
+			ChainID:        "bench",
+			BlockNumber:    uint64(i),
+			Data:           []byte(`{"block":1,"chain":"bench","ts":0}`),
+		}
+	}
+	return out
+}
+
+func BenchmarkIngestSingle(b *testing.B) {
+	ing := testDBIngester(b)
+	records := benchRecords(b.N)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := range records {
+		if err := ing.Ingest(ctx, records[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIngestBatch(b *testing.B) {
+	for _, size := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			ing := testDBIngester(b)
+			records := benchRecords(b.N)
+			ctx := context.Background()
+			b.ResetTimer()
+			for start := 0; start < len(records); start += size {
+				end := min(start+size, len(records))
+				if err := ing.IngestBatch(ctx, records[start:end]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizedOverwrite(t *testing.T) {
+	pg := testDBIngester(t)
+	n := &normalizedIngester{pool: pg.pool}
+	ctx := context.Background()
+	chainID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	version := func(seed int64) (IngestRecord, ethBlock) {
+		f := newSyntheticFetcher(chainID)
+		f.scenario = syntheticScenario{Seed: seed, MeanTxs: 20}
+		r, err := f.FetchBlock(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := decodeBlock(r.Data)
+		return *r, *b
+	}
+	old, _ := version(1)
+	if err := n.Ingest(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	fresh, want := version(2)
+	if err := n.Overwrite(ctx, fresh); err != nil {
+		t.Fatal(err)
+	}
+	var txs int
+	var from *string
+	err := pg.pool.QueryRow(ctx, `SELECT (SELECT COUNT(*) FROM transactions WHERE chain_id = $1 AND block_number = 0),
+		(SELECT from_address FROM transactions WHERE chain_id = $1 AND block_number = 0 AND tx_index = 0)`, chainID).Scan(&txs, &from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txs != len(want.Transactions) {
+		t.Fatalf("stored %d transactions, want the new version's %d", txs, len(want.Transactions))
+	}
+	if txs > 0 && (from == nil || *from != strings.ToLower(want.Transactions[0].From)) {
+		t.Errorf("transaction 0 from %v, want the new version's %s", from, want.Transactions[0].From)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// lockSession is a database session that can hold session-level advisory locks.
+type lockSession interface {
+	tryLock(ctx context.Context, key int64) (bool, error)
+	ping(ctx context.Context) error
+	close()
+}
+
+// leaderElection lets one replica per chain run that chain's worker. The leader holds
+// pg_try_advisory_lock(leaderLockKey(chain)) on a dedicated session; Postgres drops the lock when
+// that session ends, so standbys, retrying every interval, take over within about interval of a
+// leader dying. A leader that can't reach its session for interval stops its worker.
+type leaderElection struct {
+	connect  func(ctx context.Context) (lockSession, error)
+	interval time.Duration
+	log      *slog.Logger
+}
+
+func newLeaderElection(pool *pgxpool.Pool, interval time.Duration, log *slog.Logger) *leaderElection {
+	return &leaderElection{
+		connect: func(ctx context.Context) (lockSession, error) {
+			c, err := pool.Acquire(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return pgLockSession{c.Hijack()}, nil // the lock lives as long as this connection
+		},
+		interval: interval,
+		log:      log,
+	}
+}
+
+func leaderLockKey(chainID string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("arkiv-ingestion/leader/" + chainID))
+	return int64(h.Sum64())
+}
+
+// lead wraps a chain worker so it only runs while this replica is the chain's leader. The
+// returned func blocks as standby until the lock is won, then runs work until it returns or
+// leadership is lost (an error, so superviseChain starts over as standby).
+func (e *leaderElection) lead(chainID string, state *chainState, work func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		sess, err := e.acquire(ctx, chainID, state)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			sess.close()
+			e.setLeader(chainID, state, false)
+		}()
+		e.log.Info("became leader", "chain_id", chainID)
+		e.setLeader(chainID, state, true)
+
+		workCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		lost := make(chan error, 1)
+		go func() {
+			err := e.hold(workCtx, sess)
+			cancel() // stop work as soon as the lock may be gone
+			lost <- err
+		}()
+		err = work(workCtx)
+		cancel()
+		if herr := <-lost; herr != nil && ctx.Err() == nil {
+			return fmt.Errorf("leadership lost: %w", herr)
+		}
+		return err
+	}
+}
+
+// acquire retries the chain's lock every interval until it is held or ctx is done.
+func (e *leaderElection) acquire(ctx context.Context, chainID string, state *chainState) (lockSession, error) {
+	e.setLeader(chainID, state, false)
+	key := leaderLockKey(chainID)
+	var sess lockSession
+	for {
+		state.beat() // standing by is not a wedged worker
+		var err error
+		if sess == nil {
+			sess, err = e.connect(ctx)
+		}
+		if err == nil {
+			var ok bool
+			if ok, err = sess.tryLock(ctx, key); err == nil && ok {
+				return sess, nil
+			}
+		}
+		if err != nil {
+			e.log.Warn("leader election failed", "chain_id", chainID, "err", err)
+			state.failed(err)
+			if sess != nil {
+				sess.close()
+				sess = nil
+			}
+		}
+		t := time.NewTimer(e.interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			if sess != nil {
+				sess.close()
+			}
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// hold checks the lock's session every interval; it returns nil when ctx is done, or the error
+// once the session is unreachable and the lock must be presumed gone.
+func (e *leaderElection) hold(ctx context.Context, sess lockSession) error {
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, e.interval)
+		err := sess.ping(pingCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+}
+
+func (e *leaderElection) setLeader(chainID string, state *chainState, leader bool) {
+	state.setRole(leader)
+	v := 0.0
+	if leader {
+		v = 1
+	}
+	ingestIsLeader.WithLabelValues(chainID).Set(v)
+}
+
+type pgLockSession struct{ conn *pgx.Conn }
+
+func (s pgLockSession) tryLock(ctx context.Context, key int64) (bool, error) {
+	var ok bool
+	err := s.conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&ok)
+	return ok, err
+}
+
+func (s pgLockSession) ping(ctx context.Context) error { return s.conn.Ping(ctx) }
+
+func (s pgLockSession) close() { s.conn.Close(context.Background()) }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeLocks emulates advisory locks shared by sessions of several replicas.
+type fakeLocks struct {
+	mu      sync.Mutex
+	holders map[int64]*fakeLockSession
+}
+
+type fakeLockSession struct {
+	locks  *fakeLocks
+	broken atomic.Bool
+}
+
+func (s *fakeLockSession) tryLock(ctx context.Context, key int64) (bool, error) {
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	if h := s.locks.holders[key]; h != nil && h != s {
+		return false, nil
+	}
+	s.locks.holders[key] = s
+	return true, nil
+}
+
+func (s *fakeLockSession) ping(ctx context.Context) error {
+	if s.broken.Load() {
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+func (s *fakeLockSession) close() {
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	for k, h := range s.locks.holders {
+		if h == s {
+			delete(s.locks.holders, k)
+		}
+	}
+}
+
+func (l *fakeLocks) election(sessions chan<- *fakeLockSession) *leaderElection {
+	return &leaderElection{
+		connect: func(ctx context.Context) (lockSession, error) {
+			s := &fakeLockSession{locks: l}
+			if sessions != nil {
+				sessions <- s
+			}
+			return s, nil
+		},
+		interval: 10 * time.Millisecond,
+		log:      discardLogger(),
+	}
+}
+
+func TestLeaderElectionOneLeaderAndFailover(t *testing.T) {
+	locks := &fakeLocks{holders: map[int64]*fakeLockSession{}}
+	var running atomic.Int32
+	work := func(ctx context.Context) error {
+		if running.Add(1) > 1 {
+			t.Error("two leaders")
+		}
+		<-ctx.Done()
+		running.Add(-1)
+		return nil
+	}
+
+	stateA, stateB := newChainState("le-1"), newChainState("le-1")
+	ctxA, cancelA := context.WithCancel(context.Background())
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	doneA := make(chan struct{})
+	go func() {
+		locks.election(nil).lead("le-1", stateA, work)(ctxA)
+		close(doneA)
+	}()
+	waitFor(t, func() bool { return stateA.snapshot().Role == "leader" })
+	go locks.election(nil).lead("le-1", stateB, work)(ctxB)
+	waitFor(t, func() bool { return stateB.snapshot().Role == "standby" })
+	time.Sleep(30 * time.Millisecond)
+	if running.Load() != 1 || stateA.snapshot().Role != "leader" {
+		t.Fatal("standby took over from a live leader")
+	}
+
+	cancelA() // leader dies: its session closes, releasing the lock
+	<-doneA
+	waitFor(t, func() bool { return stateB.snapshot().Role == "leader" })
+	waitFor(t, func() bool { return running.Load() == 1 })
+	if got := testutil.ToFloat64(ingestIsLeader.WithLabelValues("le-1")); got != 1 {
+		t.Fatalf("is_leader = %v", got)
+	}
+}
+
+func TestLeaderStopsWorkWhenSessionLost(t *testing.T) {
+	locks := &fakeLocks{holders: map[int64]*fakeLockSession{}}
+	sessions := make(chan *fakeLockSession, 1)
+	stopped := make(chan struct{})
+	work := func(ctx context.Context) error {
+		<-ctx.Done()
+		close(stopped)
+		return nil
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- locks.election(sessions).lead("le-2", newChainState("le-2"), work)(context.Background())
+	}()
+
+	(<-sessions).broken.Store(true)
+	<-stopped
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "leadership lost") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestReadinessSkipsStandbyChains(t *testing.T) {
+	standby := newChainState("le-3")
+	standby.setRole(false)
+	standby.started = time.Now().Add(-time.Hour) // would fail the progress check
+	rd := &readiness{db: &fakePinger{}, chains: []*chainState{standby}, dbTimeout: time.Second, maxStall: time.Minute, maxLag: 1}
+	report := rd.check(context.Background())
+	if report.Status != "ok" || report.Checks["leader:le-3"].Detail != "standby" {
+		t.Fatalf("report: %+v", report)
+	}
+	if _, ok := report.Checks["progress:le-3"]; ok {
+		t.Fatal("standby chain progress checked")
+	}
+
+	standby.setRole(true) // taking over starts a fresh grace period
+	if report := rd.check(context.Background()); report.Status != "ok" {
+		t.Fatalf("new leader: %+v", report)
+	}
+}
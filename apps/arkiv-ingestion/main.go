@@ -1,18 +1,27 @@
-// Arkiv-ingestion: Fetches chain data, ingests into Postgres. Uses synthetic fetcher (no RPC).
-// Endpoints: GET /healthz, GET /metrics. Idempotent via ON CONFLICT DO NOTHING.
+// Arkiv-ingestion: Fetches chain data, ingests into Postgres. One supervised worker per chain
+// (CHAINS / CHAINS_FILE, else CHAIN_ID); each uses the synthetic fetcher or an Ethereum JSON-RPC node.
+// INGEST_MODE=raw (default) stores one JSONB row per block; normalized writes blocks/transactions/logs.
+// Catches up to head at INGEST_CATCHUP_RATE blocks/s, then polls every INGEST_INTERVAL_SEC.
+// Endpoints: GET /healthz, GET /readyz, GET /metrics, read API under GET /v1/chains/{chain}/, SSE at GET /v1/stream.
+// Idempotent via ON CONFLICT DO NOTHING.
+// Subcommands (see cli.go): serve (the default), migrate up|status, backfill, verify, replay-dlq,
+// export. Schema is managed by embedded migrations; records that exhaust retries go to a
+// dead-letter store for replay-dlq.
 package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"log/slog"
 	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -20,11 +29,11 @@ import (
 var (
 	ingestTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "arkiv_ingest_total", Help: "Ingestion attempts"},
-		[]string{"status"},
+		[]string{"chain_id", "status"},
 	)
 	ingestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{Name: "arkiv_ingest_duration_seconds", Help: "Ingest latency", Buckets: prometheus.DefBuckets},
-		[]string{"status"},
+		prometheus.HistogramOpts{Name: "arkiv_ingest_duration_seconds", Help: "Write stage: time to store a record or batch, including retries", Buckets: prometheus.DefBuckets},
+		[]string{"chain_id", "status"},
 	)
 	httpRequestsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "http_requests_total", Help: "HTTP requests"},
@@ -34,32 +43,329 @@ var (
 		prometheus.HistogramOpts{Name: "http_request_duration_seconds", Help: "Request latency", Buckets: prometheus.DefBuckets},
 		[]string{"method", "path"},
 	)
+	ingestHeadBlock = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_ingest_head_block", Help: "Latest block reported by the fetcher"},
+		[]string{"chain_id"},
+	)
+	ingestBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "arkiv_ingest_batch_size", Help: "Records per ingest flush", Buckets: prometheus.ExponentialBuckets(1, 2, 10)},
+		[]string{"chain_id"},
+	)
+	fetchDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "arkiv_fetch_duration_seconds", Help: "Fetch stage: time to fetch a block from the source; status ok, missing (not available yet) or error", Buckets: prometheus.DefBuckets},
+		[]string{"chain_id", "status"},
+	)
+	payloadBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "arkiv_payload_bytes", Help: "Size of fetched block payloads", Buckets: prometheus.ExponentialBuckets(256, 4, 10)},
+		[]string{"chain_id"},
+	)
+	ingestFreshness = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "arkiv_ingest_freshness_seconds", Help: "Time from a block's timestamp to it being stored, for blocks that advance the chain's tip", Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}},
+		[]string{"chain_id"},
+	)
+	lastIngestedBlock = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_last_ingested_block", Help: "Highest block stored by this worker"},
+		[]string{"chain_id"},
+	)
+	lastIngestedBlockTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_last_ingested_block_timestamp_seconds", Help: "Timestamp of the highest block stored; time() minus this is the chain's freshness"},
+		[]string{"chain_id"},
+	)
+	lastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_last_success_timestamp_seconds", Help: "When this worker last stored a record"},
+		[]string{"chain_id"},
+	)
+	ingestDLQDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_ingest_dlq_depth", Help: "Records waiting in the dead-letter store"},
+		[]string{"chain_id"},
+	)
+	ingestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_ingest_errors_total", Help: "Ingest attempt failures by class (retryable, permanent, canceled)"},
+		[]string{"chain_id", "class"},
+	)
+	ingestRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_ingest_retries_total", Help: "Ingest attempts retried after a retryable error"},
+		[]string{"chain_id"},
+	)
+	ingestLagBlocks = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_ingest_lag_blocks", Help: "Blocks between the ingestion cursor and head"},
+		[]string{"chain_id"},
+	)
+	ingestWorkerRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_ingest_worker_restarts_total", Help: "Chain worker restarts after an error or panic"},
+		[]string{"chain_id"},
+	)
+	streamSubscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "arkiv_stream_subscribers", Help: "Connected /v1/stream subscribers"},
+	)
+	ingestIsLeader = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_ingest_is_leader", Help: "1 if this replica holds the chain's leader lock (LEADER_ELECTION=true)"},
+		[]string{"chain_id"},
+	)
+	ingestPaused = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_ingest_paused", Help: "1 while the chain's worker is paused via the admin API"},
+		[]string{"chain_id"},
+	)
+	ingestGaps = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_ingest_gaps", Help: "Missing block ranges below the highest stored block, as of the last gap scan"},
+		[]string{"chain_id"},
+	)
+	ingestGapBlocks = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_ingest_gap_blocks", Help: "Missing blocks below the highest stored block, as of the last gap scan"},
+		[]string{"chain_id"},
+	)
+	ingestGapRepairs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_ingest_gap_repairs_total", Help: "Blocks re-fetched to fill gaps"},
+		[]string{"chain_id"},
+	)
+	verifyChecked = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_verify_checked_total", Help: "Stored blocks re-fetched and compared with the source"},
+		[]string{"chain_id"},
+	)
+	verifyMismatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_verify_mismatches_total", Help: "Stored blocks that differ from the source, by kind"},
+		[]string{"chain_id", "kind"},
+	)
+	verifyRepaired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_verify_repaired_total", Help: "Mismatched blocks overwritten with the source's version"},
+		[]string{"chain_id"},
+	)
+	verifyLastRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_verify_last_run_timestamp_seconds", Help: "When the background verifier last completed a sample"},
+		[]string{"chain_id"},
+	)
+	sinkWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_sink_writes_total", Help: "Records written per sink, after that sink's retries"},
+		[]string{"sink", "status"},
+	)
+	sinkWriteDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "arkiv_sink_write_duration_seconds", Help: "Sink write duration including retries", Buckets: prometheus.DefBuckets},
+		[]string{"sink"},
+	)
+	sinkRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_sink_retries_total", Help: "Sink write attempts retried"},
+		[]string{"sink"},
+	)
+	rpcRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_rpc_requests_total", Help: "JSON-RPC requests per upstream endpoint (ok, error, rpc_error, rate_limited, canceled)"},
+		[]string{"endpoint", "method", "status"},
+	)
+	rpcRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "arkiv_rpc_request_duration_seconds", Help: "JSON-RPC request duration per upstream endpoint", Buckets: prometheus.DefBuckets},
+		[]string{"endpoint", "method"},
+	)
+	rpcEndpointUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "arkiv_rpc_endpoint_up", Help: "0 while an RPC endpoint is cooling down after failures"},
+		[]string{"endpoint"},
+	)
+	recordsTableBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "arkiv_records_table_bytes", Help: "Size of ingestion_records with indexes, over all partitions"},
+	)
+	recordsPartitions = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "arkiv_records_partitions", Help: "Partitions attached to ingestion_records, including the default one"},
+	)
+	recordsPartitionsCreated = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "arkiv_records_partitions_created_total", Help: "Upcoming ingestion_records partitions created"},
+	)
+	recordsPartitionsRetired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_records_partitions_retired_total", Help: "ingestion_records partitions past retention, by action (detach, drop)"},
+		[]string{"action"},
+	)
+	recordsPartitionErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "arkiv_records_partition_errors_total", Help: "Partition maintenance rounds that failed"},
+	)
+	storeCircuitState = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "arkiv_store_circuit_state", Help: "Store circuit breaker: 0 closed, 1 half-open (probing), 2 open (writes and fetching paused)"},
+	)
+	storeCircuitOpened = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "arkiv_store_circuit_opened_total", Help: "Times the store circuit breaker opened"},
+	)
+	faultsInjected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "arkiv_faults_injected_total", Help: "Faults injected into calls (FAULT_INJECTION), by target and fault"},
+		[]string{"target", "fault"},
+	)
+	streamDroppedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "arkiv_stream_dropped_events_total", Help: "Stream events dropped because a subscriber's buffer was full (the subscriber is disconnected)"},
+	)
 )
 
 func init() {
-	prometheus.MustRegister(ingestTotal, ingestDuration, httpRequestsTotal, httpRequestDuration)
+	prometheus.MustRegister(ingestTotal, ingestDuration, fetchDuration, payloadBytes, ingestFreshness, lastIngestedBlock, lastIngestedBlockTime, lastSuccess, httpRequestsTotal, httpRequestDuration, ingestHeadBlock, ingestLagBlocks, ingestBatchSize, ingestDLQDepth, ingestErrors, ingestRetries, ingestWorkerRestarts, ingestIsLeader, ingestPaused, ingestGaps, ingestGapBlocks, ingestGapRepairs, verifyChecked, verifyMismatches, verifyRepaired, verifyLastRun, sinkWrites, sinkWriteDuration, sinkRetries, streamSubscribers, streamDroppedEvents, rpcRequestsTotal, rpcRequestDuration, rpcEndpointUp, recordsTableBytes, recordsPartitions, recordsPartitionsCreated, recordsPartitionsRetired, recordsPartitionErrors, storeCircuitState, storeCircuitOpened, faultsInjected)
 }
 
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logOut := os.Stdout
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		logOut = os.Stderr // leave stdout to the command's output (reports, exports)
+	}
+	logger := slog.New(slog.NewJSONHandler(logOut, &slog.HandlerOptions{Level: slog.LevelInfo}))
 	slog.SetDefault(logger)
+	os.Exit(run(os.Args[1:], logger))
+}
 
-	cfg := configFromEnv()
-	ingester, err := newPostgresIngester(context.Background(), cfg.databaseURL)
+// runServe implements `arkiv-ingestion serve`, the default command: one supervised worker per
+// chain plus the HTTP server, until SIGINT/SIGTERM.
+func runServe(ctx context.Context, cfg config, args []string, logger *slog.Logger) int {
+	if code, ok := parseFlags(flag.NewFlagSet("serve", flag.ContinueOnError), args); !ok {
+		return code
+	}
+	if cfg.verifyInterval > 0 {
+		if err := requireRawMode(cfg, "VERIFY_INTERVAL_SEC"); err != nil {
+			logger.Error("start", "err", err)
+			return exitCode(err)
+		}
+	}
+	app, err := newApp(ctx, cfg, logger, true)
 	if err != nil {
-		slog.Error("create ingester", "err", err)
-		os.Exit(1)
+		slog.Error("start", "err", err)
+		return exitCode(err)
 	}
-
-	fetcher := newSyntheticFetcher(cfg.chainID)
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer app.close()
+	pg, store, ingester, hub, dlq, chains := app.pg, app.store, app.ingester, app.hub, app.dlq, app.chains
+	refreshDLQDepth(ctx, dlq, logger)
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	go runWorker(ctx, ingester, fetcher, cfg.interval, logger)
+	partitions := newPartitionManager(pg.pool, cfg.partition, chains, logger)
+	if err := partitions.prepare(ctx); err != nil {
+		slog.Error("partition ingestion_records", "err", err)
+		return exitFailure
+	}
+	pg.trimmed = cfg.partition.by != "" && cfg.partition.retention > 0
+	if err := partitions.maintain(ctx); err != nil {
+		// Not fatal: rows without a partition land in the default one meanwhile.
+		slog.Warn("partition maintenance failed", "err", err)
+		recordsPartitionErrors.Inc()
+	}
+	go partitions.run(ctx)
+
+	if cfg.streamSource == "notify" {
+		// Stream every row inserted by any replica, not just this one's (raw mode only).
+		go func() {
+			for rec := range newRecordFeed(pg, logger).subscribe(ctx, cfg.streamBuffer) {
+				hub.publish(IngestRecord{IdempotencyKey: rec.IdempotencyKey, ChainID: rec.ChainID, BlockNumber: rec.BlockNumber, Data: rec.Data})
+			}
+		}()
+	}
+
+	var faults *faultInjector
+	if cfg.faultInjection {
+		faults = newFaultInjector()
+		if cfg.faults != "" {
+			var initial map[string]faultConfig
+			if err := json.Unmarshal([]byte(cfg.faults), &initial); err != nil {
+				slog.Error("parse FAULTS", "err", err)
+				return exitUsage
+			}
+			if err := faults.set(initial); err != nil {
+				slog.Error("FAULTS", "err", err)
+				return exitUsage
+			}
+		}
+		ingester = &faultyIngester{ArkivIngester: ingester, faults: faults}
+		logger.Warn("fault injection enabled", "faults", faults.snapshot())
+	}
+
+	var election *leaderElection
+	if cfg.leaderElection {
+		election = newLeaderElection(pg.pool, cfg.leaderInterval, logger)
+	}
+	var workers sync.WaitGroup
+	states := make([]*chainState, 0, len(chains))
+	admin := &adminAPI{token: cfg.adminToken, chains: map[string]*adminChain{}, maxReingest: cfg.adminMaxReingest, faults: faults, log: logger}
+	// Overwrites (admin re-ingests, verifier repairs) go through the whole write path, like new blocks.
+	rewriter, _ := ingester.(overwriter)
+	for _, c := range chains {
+		c := c
+		fetcher := newFetcher(c, cfg, logger)
+		if faults != nil {
+			fetcher = withFaults(fetcher, faults)
+		}
+		state := newChainState(c.ID)
+		states = append(states, state)
+		repairs := make(chan blockRange, 16)
+		reingests := make(chan blockRange, 1)
+		overwrites := make(chan overwriteRequest)
+		admin.chains[c.ID] = &adminChain{state: state, reingests: reingests}
+		var scanner *gapScanner
+		if gf, ok := store.(gapFinder); ok && cfg.gapScanInterval > 0 {
+			scanner = &gapScanner{
+				chainID:   c.ID,
+				store:     gf,
+				from:      c.StartBlock,
+				interval:  cfg.gapScanInterval,
+				maxRepair: cfg.gapRepairMaxBlocks,
+				repairs:   repairs,
+				log:       logger.With("chain_id", c.ID),
+			}
+		}
+		run := func(ctx context.Context) error {
+			next, err := resumeFrom(ctx, store, c)
+			if err != nil {
+				return err
+			}
+			logger.Info("chain worker starting", "chain_id", c.ID, "fetcher", c.Fetcher, "from", next)
+			sched := &scheduler{
+				chainID:      c.ID,
+				fetcher:      fetcher,
+				ingester:     ingester,
+				next:         next,
+				pollInterval: c.interval(),
+				catchupRate:  cfg.catchupRate,
+				batchSize:    cfg.batchSize,
+				batchMaxWait: cfg.batchMaxWait,
+				retry:        cfg.retry,
+				dlq:          dlq,
+				state:        state,
+				repairs:      repairs,
+				reingests:    reingests,
+				overwrites:   overwrites,
+				overwriter:   rewriter,
+				breaker:      app.breaker,
+				log:          logger.With("chain_id", c.ID),
+			}
+			// Background jobs run alongside the worker (so only on the leader) and stop with it.
+			jobCtx, stopJobs := context.WithCancel(ctx)
+			defer stopJobs()
+			if scanner != nil {
+				go scanner.run(jobCtx)
+			}
+			if cfg.verifyInterval > 0 {
+				v := &verifier{chainID: c.ID, fetcher: fetcher, store: pg, full: cfg.verifyFull, log: logger.With("chain_id", c.ID)}
+				if cfg.verifyRepair {
+					v.repair = queuedOverwriter(overwrites) // run by the worker, not racing its writes
+				}
+				go v.run(jobCtx, c.StartBlock, cfg.verifySample, cfg.verifyInterval)
+			}
+			sched.run(ctx)
+			return nil
+		}
+		if election != nil {
+			run = election.lead(c.ID, state, run)
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			superviseChain(ctx, c.ID, run, retryPolicy{baseDelay: time.Second, maxDelay: time.Minute}, logger)
+		}()
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/healthz", liveness(states, cfg.livenessMaxStall))
+	mux.Handle("/readyz", &readiness{
+		db:        pg.pool,
+		chains:    states,
+		dbTimeout: cfg.readyDBTimeout,
+		maxStall:  cfg.readyMaxStall,
+		maxLag:    cfg.readyMaxLag,
+	})
 	mux.Handle("/metrics", promhttp.Handler())
+	api := &queryAPI{store: pg, timeout: cfg.queryTimeout, maxLimit: cfg.queryMaxLimit}
+	api.register(mux)
+	mux.Handle("GET /v1/stream", &streamHandler{hub: hub, store: pg, keepalive: 15 * time.Second, log: logger})
+	if cfg.adminToken != "" {
+		admin.register(mux)
+	}
 
 	addr := ":8080"
 	if p := os.Getenv("PORT"); p != "" {
@@ -71,10 +377,13 @@ func main() {
 
 	// Use http.Server for graceful shutdown on SIGTERM/SIGINT.
 	srv := &http.Server{Addr: addr, Handler: instrument(mux)}
+	srv.RegisterOnShutdown(hub.close) // end open streams; Shutdown does not interrupt them
+	serverFailed := make(chan struct{})
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			slog.Error("server stopped", "err", err)
-			cancel() // trigger shutdown so main can exit
+			close(serverFailed)
+			cancel() // trigger shutdown so serve can return
 		}
 	}()
 	slog.Info("starting", "addr", addr)
@@ -86,63 +395,74 @@ func main() {
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		slog.Error("shutdown", "err", err)
 	}
+	workers.Wait() // let workers flush pending records; app.close then completes open archive files
+	select {
+	case <-serverFailed:
+		return exitFailure
+	default:
+		return exitOK
+	}
 }
 
-// runWorker fetches records at interval and ingests them; exits on ctx.Done().
-func runWorker(ctx context.Context, ingester ArkivIngester, fetcher *syntheticFetcher, interval time.Duration, log *slog.Logger) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			record, err := fetcher.FetchNext(ctx)
-			if err != nil {
-				log.Warn("fetch failed", "err", err)
-				ingestTotal.WithLabelValues("error").Inc()
-				continue
-			}
-			if record == nil {
-				continue
-			}
-			start := time.Now()
-			ingestErr := ingestWithRetry(ctx, ingester, record)
-			duration := time.Since(start).Seconds()
-			status := "ok"
-			if ingestErr != nil {
-				status = "error"
-				log.Warn("ingest failed", "key", record.IdempotencyKey, "err", ingestErr)
-			}
-			ingestTotal.WithLabelValues(status).Inc()
-			ingestDuration.WithLabelValues(status).Observe(duration)
-		}
+func newDeadLetterStore(cfg config, pool *pgxpool.Pool) (deadLetterStore, error) {
+	if cfg.dlqBackend == "file" {
+		return newFileDeadLetters(cfg.dlqPath)
 	}
+	return &postgresDeadLetters{pool: pool}, nil
 }
 
-// ingestWithRetry tries up to 3 times with exponential backoff (1s, 2s, 3s).
-func ingestWithRetry(ctx context.Context, ingester ArkivIngester, r *IngestRecord) error {
-	var lastErr error
-	for attempt := 0; attempt < 3; attempt++ {
-		err := ingester.Ingest(ctx, *r)
-		if err == nil {
-			return nil
-		}
-		lastErr = err
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(time.Duration(attempt+1) * time.Second):
-		}
-	}
-	return lastErr
+// ingestWithRetry ingests r under policy. It returns the attempts made and the last error.
+func ingestWithRetry(ctx context.Context, policy retryPolicy, ingester ArkivIngester, r *IngestRecord) (int, error) {
+	return policy.do(ctx, r.ChainID, func() error { return ingester.Ingest(ctx, *r) })
+}
+
+// ingestBatchWithRetry is ingestWithRetry for a whole batch of one chain's records.
+func ingestBatchWithRetry(ctx context.Context, policy retryPolicy, ingester BatchIngester, records []IngestRecord) (int, error) {
+	return policy.do(ctx, records[0].ChainID, func() error { return ingester.IngestBatch(ctx, records) })
 }
 
 // config holds env-derived settings. DATABASE_URL must be set for real deployments.
 type config struct {
-	databaseURL string
-	chainID     string
-	interval    time.Duration
+	databaseURL        string
+	chainID            string
+	interval           time.Duration // poll interval once caught up with head
+	catchupRate        float64       // max blocks/sec while behind head
+	syntheticStartHead uint64        // synthetic head at startup, to simulate a backlog
+	syntheticScenario  string        // default scenario JSON for synthetic chains (SYNTHETIC_SCENARIO)
+	batchSize          int           // records per IngestBatch while catching up; 1 disables batching
+	batchMaxWait       time.Duration // flush a partial batch after this long
+	migrateOnStart     bool          // apply pending migrations at startup; else refuse to start
+	mode               string        // "raw" (JSONB ingestion_records) or "normalized" (blocks/transactions/logs)
+	dlqBackend         string        // "postgres" (ingestion_dead_letters) or "file"
+	dlqPath            string        // JSON-lines file for the file backend
+	retry              retryPolicy
+	breakerFailures    int           // consecutive store failures that open the circuit; 0 disables the breaker
+	breakerOpen        time.Duration // how long the circuit stays open before a probe
+	chainsJSON         string        // CHAINS: JSON array of chainConfig; overrides CHAIN_ID
+	chainsFile         string        // CHAINS_FILE: path to the same JSON, e.g. a mounted ConfigMap
+	sinksJSON          string        // INGEST_SINKS: JSON array of sinkConfig written alongside the primary store
+	gapScanInterval    time.Duration // how often to look for missing blocks; 0 = off
+	gapRepairMaxBlocks uint64        // blocks re-fetched per gap scan
+	verifyInterval     time.Duration // background verification of a sample of stored blocks; 0 = off
+	verifySample       int           // blocks per background verification
+	verifyFull         bool          // compare canonical JSON, not just block hashes
+	verifyRepair       bool          // overwrite mismatched rows with the source's version
+	leaderElection     bool          // run a chain only on the replica holding its advisory lock
+	leaderInterval     time.Duration // standby retry / leader session check interval
+	readyDBTimeout     time.Duration
+	readyMaxStall      time.Duration // /readyz fails if a chain made no progress for this long
+	readyMaxLag        uint64        // /readyz fails if a chain is this many blocks behind; 0 = off
+	livenessMaxStall   time.Duration // /healthz fails if a worker loop stopped for this long
+	queryTimeout       time.Duration // per-request timeout for /v1 read queries
+	queryMaxLimit      int           // max page size for /v1 list queries
+	streamBuffer       int           // events buffered per /v1/stream subscriber before it is dropped
+	streamSource       string        // "local" (this process's ingests) or "notify" (LISTEN on recordsChannel)
+	adminToken         string        // bearer token for /admin; empty disables it
+	adminMaxReingest   uint64        // largest block range one admin re-ingest may cover
+	faultInjection     bool          // wrap the ingester and fetchers with a faultInjector (gamedays only)
+	faults             string        // FAULTS: initial faults as JSON, by target
+
+	partition partitionConfig // ingestion_records partitioning and retention (RECORDS_*)
 }
 
 // configFromEnv reads settings from env. REDACTED default is for tests only; real runs need DATABASE_URL.
@@ -161,10 +481,228 @@ func configFromEnv() config {
 	if chainID == "" {
 		chainID = "1"
 	}
+	catchupRate := 20.0
+	if s := os.Getenv("INGEST_CATCHUP_RATE"); s != "" {
+		if n, err := strconv.ParseFloat(s, 64); err == nil && n >= 0 {
+			catchupRate = n
+		}
+	}
+	var startHead uint64
+	if s := os.Getenv("SYNTHETIC_START_HEAD"); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			startHead = n
+		}
+	}
+	batchSize := 100
+	if s := os.Getenv("INGEST_BATCH_SIZE"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			batchSize = n
+		}
+	}
+	batchMaxWait := 2 * time.Second
+	if s := os.Getenv("INGEST_BATCH_MAX_WAIT_MS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			batchMaxWait = time.Duration(n) * time.Millisecond
+		}
+	}
+	migrateOnStart := os.Getenv("MIGRATE_ON_START") != "false"
+	mode := "raw"
+	if os.Getenv("INGEST_MODE") == "normalized" {
+		mode = "normalized"
+	}
+	dlqBackend := "postgres"
+	if os.Getenv("DLQ_BACKEND") == "file" {
+		dlqBackend = "file"
+	}
+	dlqPath := os.Getenv("DLQ_PATH")
+	if dlqPath == "" {
+		dlqPath = "/var/lib/arkiv-ingestion/dlq.jsonl"
+	}
+	retry := retryPolicy{maxAttempts: 3, baseDelay: time.Second, maxDelay: 30 * time.Second, maxElapsed: time.Minute}
+	if s := os.Getenv("INGEST_RETRY_MAX_ATTEMPTS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			retry.maxAttempts = n
+		}
+	}
+	if s := os.Getenv("INGEST_RETRY_BASE_DELAY_MS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			retry.baseDelay = time.Duration(n) * time.Millisecond
+		}
+	}
+	if s := os.Getenv("INGEST_RETRY_MAX_DELAY_MS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			retry.maxDelay = time.Duration(n) * time.Millisecond
+		}
+	}
+	if s := os.Getenv("INGEST_RETRY_MAX_ELAPSED_SEC"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			retry.maxElapsed = time.Duration(n) * time.Second
+		}
+	}
+	breakerFailures := 5
+	if s := os.Getenv("INGEST_BREAKER_FAILURES"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			breakerFailures = n
+		}
+	}
+	breakerOpen := 30 * time.Second
+	if s := os.Getenv("INGEST_BREAKER_OPEN_SEC"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			breakerOpen = time.Duration(n) * time.Second
+		}
+	}
+	readyDBTimeout := 2 * time.Second
+	if s := os.Getenv("READY_DB_TIMEOUT_MS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			readyDBTimeout = time.Duration(n) * time.Millisecond
+		}
+	}
+	readyMaxStall := 5 * time.Minute
+	if s := os.Getenv("READY_MAX_STALL_SEC"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			readyMaxStall = time.Duration(n) * time.Second
+		}
+	}
+	readyMaxLag := uint64(10000)
+	if s := os.Getenv("READY_MAX_LAG_BLOCKS"); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			readyMaxLag = n
+		}
+	}
+	livenessMaxStall := 10 * time.Minute
+	if s := os.Getenv("LIVENESS_MAX_STALL_SEC"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			livenessMaxStall = time.Duration(n) * time.Second
+		}
+	}
+	queryTimeout := 5 * time.Second
+	if s := os.Getenv("QUERY_TIMEOUT_MS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			queryTimeout = time.Duration(n) * time.Millisecond
+		}
+	}
+	queryMaxLimit := 1000
+	if s := os.Getenv("QUERY_MAX_LIMIT"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			queryMaxLimit = n
+		}
+	}
+	streamBuffer := 256
+	if s := os.Getenv("STREAM_BUFFER"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			streamBuffer = n
+		}
+	}
+	gapScanInterval := 5 * time.Minute
+	if s := os.Getenv("GAP_SCAN_INTERVAL_SEC"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			gapScanInterval = time.Duration(n) * time.Second
+		}
+	}
+	gapRepairMaxBlocks := uint64(1000)
+	if s := os.Getenv("GAP_REPAIR_MAX_BLOCKS"); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil && n > 0 {
+			gapRepairMaxBlocks = n
+		}
+	}
+	var verifyInterval time.Duration
+	if s := os.Getenv("VERIFY_INTERVAL_SEC"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			verifyInterval = time.Duration(n) * time.Second
+		}
+	}
+	verifySample := 100
+	if s := os.Getenv("VERIFY_SAMPLE"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			verifySample = n
+		}
+	}
+	leaderInterval := 5 * time.Second
+	if s := os.Getenv("LEADER_ELECTION_INTERVAL_SEC"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			leaderInterval = time.Duration(n) * time.Second
+		}
+	}
+	streamSource := "local"
+	if s := os.Getenv("STREAM_SOURCE"); s == "notify" {
+		streamSource = s
+	}
+	partition := partitionConfig{blocks: 1_000_000, period: 24 * time.Hour, premake: 3, interval: time.Hour}
+	if s := os.Getenv("RECORDS_PARTITION_BY"); s == "block_number" || s == "created_at" {
+		partition.by = s
+	}
+	if s := os.Getenv("RECORDS_PARTITION_BLOCKS"); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil && n > 0 {
+			partition.blocks = n
+		}
+	}
+	if s := os.Getenv("RECORDS_PARTITION_HOURS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			partition.period = time.Duration(n) * time.Hour
+		}
+	}
+	if s := os.Getenv("RECORDS_PARTITION_PREMAKE"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			partition.premake = n
+		}
+	}
+	if s := os.Getenv("RECORDS_PARTITION_INTERVAL_SEC"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			partition.interval = time.Duration(n) * time.Second
+		}
+	}
+	if s := os.Getenv("RECORDS_RETENTION_DAYS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			partition.retention = time.Duration(n) * 24 * time.Hour
+		}
+	}
+	partition.drop = os.Getenv("RECORDS_RETENTION_ACTION") == "drop"
+	adminMaxReingest := uint64(10000)
+	if s := os.Getenv("ADMIN_REINGEST_MAX_BLOCKS"); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil && n > 0 {
+			adminMaxReingest = n
+		}
+	}
 	return config{
-		databaseURL: pg,
-		chainID:     chainID,
-		interval:    interval,
+		databaseURL:        pg,
+		chainID:            chainID,
+		interval:           interval,
+		catchupRate:        catchupRate,
+		syntheticStartHead: startHead,
+		syntheticScenario:  os.Getenv("SYNTHETIC_SCENARIO"),
+		batchSize:          batchSize,
+		batchMaxWait:       batchMaxWait,
+		migrateOnStart:     migrateOnStart,
+		mode:               mode,
+		dlqBackend:         dlqBackend,
+		dlqPath:            dlqPath,
+		retry:              retry,
+		breakerFailures:    breakerFailures,
+		breakerOpen:        breakerOpen,
+		chainsJSON:         os.Getenv("CHAINS"),
+		chainsFile:         os.Getenv("CHAINS_FILE"),
+		sinksJSON:          os.Getenv("INGEST_SINKS"),
+		gapScanInterval:    gapScanInterval,
+		gapRepairMaxBlocks: gapRepairMaxBlocks,
+		verifyInterval:     verifyInterval,
+		verifySample:       verifySample,
+		verifyFull:         os.Getenv("VERIFY_FULL") == "true",
+		verifyRepair:       os.Getenv("VERIFY_REPAIR") == "true",
+		leaderElection:     os.Getenv("LEADER_ELECTION") == "true",
+		leaderInterval:     leaderInterval,
+		readyDBTimeout:     readyDBTimeout,
+		readyMaxStall:      readyMaxStall,
+		readyMaxLag:        readyMaxLag,
+		livenessMaxStall:   livenessMaxStall,
+		queryTimeout:       queryTimeout,
+		queryMaxLimit:      queryMaxLimit,
+		streamBuffer:       streamBuffer,
+		streamSource:       streamSource,
+		partition:          partition,
+		adminToken:         os.Getenv("ADMIN_TOKEN"),
+		adminMaxReingest:   adminMaxReingest,
+		faultInjection:     os.Getenv("FAULT_INJECTION") == "true",
+		faults:             os.Getenv("FAULTS"),
 	}
 }
 
@@ -178,11 +716,16 @@ func handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
-// instrument wraps handlers to record Prometheus metrics.
+// instrument wraps handlers to record Prometheus metrics. When next is a ServeMux the path label is
+// the matched route pattern (e.g. /v1/chains/{chain}/head), keeping label cardinality bounded.
 func instrument(next http.Handler) http.Handler {
+	mux, _ := next.(*http.ServeMux)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		path := r.URL.Path
+		if mux != nil {
+			path = routeLabel(mux, r)
+		}
 		method := r.Method
 		ww := &responseWriter{ResponseWriter: w, status: 200}
 		next.ServeHTTP(ww, r)
@@ -192,6 +735,17 @@ func instrument(next http.Handler) http.Handler {
 	})
 }
 
+func routeLabel(mux *http.ServeMux, r *http.Request) string {
+	_, pattern := mux.Handler(r)
+	if pattern == "" {
+		return "unmatched"
+	}
+	if _, path, ok := strings.Cut(pattern, " "); ok { // drop "GET " method prefix
+		return path
+	}
+	return pattern
+}
+
 // responseWriter captures status code for Prometheus labeling.
 type responseWriter struct {
 	http.ResponseWriter
@@ -203,6 +757,9 @@ func (w *responseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer (Flush for /v1/stream).
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
 func statusLabel(code int) string {
 	switch {
 	case code >= 500:
@@ -12,7 +12,7 @@ import (
 
 func TestSyntheticFetcher(t *testing.T) {
 	f := newSyntheticFetcher("1")
-	r1, err := f.FetchNext(context.Background())
+	r1, err := f.FetchBlock(context.Background(), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -25,7 +25,7 @@ func TestSyntheticFetcher(t *testing.T) {
 	if r1.IdempotencyKey == "" {
 		t.Error("idempotency key required")
 	}
-	r2, err := f.FetchNext(context.Background())
+	r2, err := f.FetchBlock(context.Background(), 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -34,6 +34,20 @@ func TestSyntheticFetcher(t *testing.T) {
 	}
 }
 
+func TestSyntheticFetcherHead(t *testing.T) {
+	f := newSyntheticFetcher("1")
+	f.startHead = 100
+	f.blockTime = time.Second
+	f.started = time.Now().Add(-5 * time.Second)
+	head, err := f.Head(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != 105 {
+		t.Errorf("head = %d, want 105", head)
+	}
+}
+
 func TestStatusLabel(t *testing.T) {
 	tests := []struct {
 		code int
@@ -76,7 +90,7 @@ func TestIngestWithRetry(t *testing.T) {
 		}
 		return nil
 	}}
-	err := ingestWithRetry(ctx, mock, r)
+	_, err := ingestWithRetry(ctx, testRetryPolicy, mock, r)
 	if err != nil {
 		t.Errorf("ingestWithRetry = %v, want nil (succeeds on attempt 3)", err)
 	}
@@ -90,7 +104,7 @@ func TestIngestWithRetryExhausted(t *testing.T) {
 	r := &IngestRecord{IdempotencyKey: "k2", ChainID: "1", BlockNumber: 2, Data: []byte("{}")}
 
 	mock := &mockIngester{ingest: func() error { return errMock }}
-	err := ingestWithRetry(ctx, mock, r)
+	_, err := ingestWithRetry(ctx, testRetryPolicy, mock, r)
 	if err != errMock {
 		t.Errorf("ingestWithRetry = %v, want errMock", err)
 	}
@@ -102,12 +116,15 @@ func TestIngestWithRetryContextCanceled(t *testing.T) {
 	r := &IngestRecord{IdempotencyKey: "k3", ChainID: "1", BlockNumber: 3, Data: []byte("{}")}
 
 	mock := &mockIngester{ingest: func() error { return errMock }}
-	err := ingestWithRetry(ctx, mock, r)
+	_, err := ingestWithRetry(ctx, testRetryPolicy, mock, r)
 	if err != context.Canceled {
 		t.Errorf("ingestWithRetry = %v, want context.Canceled", err)
 	}
 }
 
+// testRetryPolicy keeps the production attempt count with millisecond sleeps.
+var testRetryPolicy = retryPolicy{maxAttempts: 3, baseDelay: time.Millisecond, maxDelay: 10 * time.Millisecond}
+
 type mockIngester struct {
 	ingest func() error
 }
@@ -122,10 +139,16 @@ func TestConfigFromEnv(t *testing.T) {
 	os.Setenv("CHAIN_ID", "42")
 	os.Setenv("DATABASE_URL", "postgres://a:b@c/d")
 	os.Setenv("INGEST_INTERVAL_SEC", "60")
+	os.Setenv("INGEST_CATCHUP_RATE", "100")
+	os.Setenv("INGEST_RETRY_MAX_ATTEMPTS", "5")
+	os.Setenv("INGEST_RETRY_BASE_DELAY_MS", "250")
 	defer func() {
+		os.Unsetenv("INGEST_RETRY_MAX_ATTEMPTS")
+		os.Unsetenv("INGEST_RETRY_BASE_DELAY_MS")
 		os.Unsetenv("CHAIN_ID")
 		os.Unsetenv("DATABASE_URL")
 		os.Unsetenv("INGEST_INTERVAL_SEC")
+		os.Unsetenv("INGEST_CATCHUP_RATE")
 	}()
 	cfg := configFromEnv()
 	if cfg.chainID != "42" {
@@ -137,4 +160,58 @@ func TestConfigFromEnv(t *testing.T) {
 	if cfg.interval != 60*time.Second {
 		t.Errorf("interval = %v, want 60s", cfg.interval)
 	}
+	if cfg.catchupRate != 100 {
+		t.Errorf("catchupRate = %v, want 100", cfg.catchupRate)
+	}
+	if cfg.retry.maxAttempts != 5 || cfg.retry.baseDelay != 250*time.Millisecond {
+		t.Errorf("retry = %+v, want 5 attempts from 250ms", cfg.retry)
+	}
+}
+
+func TestDecodeBlock(t *testing.T) {
+	payload := []byte(`{
+		"number": "0x10", "hash": "0xAB", "parentHash": "0xaa", "timestamp": "0x5f5e100",
+		"gasUsed": "0x5208", "gasLimit": "0x1c9c380", "baseFeePerGas": "0x3b9aca00",
+		"transactions": [{"hash": "0xt1", "transactionIndex": "0x0", "from": "0xF1", "to": null,
+			"value": "0xde0b6b3a7640000", "nonce": "0x1", "gas": "0x5208", "input": "0x"}],
+		"logs": [{"logIndex": "0x2", "transactionHash": "0xt1", "address": "0xc0", "topics": ["0xdd"], "data": "0x"}]
+	}`)
+	b, err := decodeBlock(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Number != 16 || b.Timestamp != 100000000 || b.GasUsed != 21000 {
+		t.Errorf("number/timestamp/gasUsed = %d/%d/%d", b.Number, b.Timestamp, b.GasUsed)
+	}
+	if len(b.Transactions) != 1 || b.Transactions[0].To != nil {
+		t.Fatalf("transactions = %+v, want one contract creation", b.Transactions)
+	}
+	if got := b.Transactions[0].Value.String(); got != "1000000000000000000" {
+		t.Errorf("value = %s, want 1 ether in wei", got)
+	}
+	if len(b.Logs) != 1 || b.Logs[0].LogIndex != 2 || b.Logs[0].Topics[0] != "0xdd" {
+		t.Errorf("logs = %+v", b.Logs)
+	}
+
+	if _, err := decodeBlock([]byte(`{"number": "0x1"}`)); err == nil {
+		t.Error("want error for block without hash")
+	}
+	if _, err := decodeBlock([]byte(`{"number": "zz", "hash": "0x1"}`)); err == nil {
+		t.Error("want error for malformed quantity")
+	}
+}
+
+func TestSyntheticFetcherPayloadDecodes(t *testing.T) {
+	f := newSyntheticFetcher("1")
+	r, err := f.FetchBlock(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := decodeBlock(r.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(b.Number) != 7 || b.ParentHash != f.hash(6) {
+		t.Errorf("block = %+v, want number 7 chained to block 6", b)
+	}
 }
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations are embedded SQL files named NNNN_description.sql, applied in version order, plus
+// the Go migrations registered in newMigrator, whose effect depends on the configuration.
+// Applied files must never be edited: the stored checksum is verified on every run.
+//
+// A file starting with noTxMarker runs outside a transaction, for statements Postgres refuses in
+// one (CREATE INDEX CONCURRENTLY). Its statements run one at a time, and all of them again if it
+// fails midway, so they must be safe to repeat.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const noTxMarker = "-- migrate: no-transaction"
+
+// migrationLockKey is the pg_advisory_lock key serializing migrations across replicas.
+const migrationLockKey int64 = 0x61726b6976 // "arkiv"
+
+var errDatabaseAhead = errors.New("database schema is newer than this binary")
+
+type migration struct {
+	version  int
+	name     string
+	sql      string
+	checksum string                                     // hex sha256 of sql, or of a Go migration's settings
+	apply    func(ctx context.Context, tx pgx.Tx) error // a Go migration, run instead of sql
+	optional bool                                       // unwanted by this configuration: never pending, checksum not verified
+	noTx     bool                                       // run outside a transaction (noTxMarker)
+}
+
+// appliedMigration is a row of schema_migrations.
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	paths, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var out []migration
+	seen := map[int]string{}
+	for _, p := range paths {
+		base := strings.TrimSuffix(path.Base(p), ".sql")
+		num, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: want NNNN_description.sql", p)
+		}
+		if prev, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migration version %d used by %s and %s", version, prev, p)
+		}
+		seen[version] = p
+		body, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(body)
+		out = append(out, migration{
+			version:  version,
+			name:     name,
+			sql:      string(body),
+			checksum: hex.EncodeToString(sum[:]),
+			noTx:     strings.HasPrefix(string(body), noTxMarker+"\n"),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].version < out[j].version })
+	return out, nil
+}
+
+// addMigrations merges Go migrations into ms, keeping version order.
+func addMigrations(ms []migration, extra ...migration) ([]migration, error) {
+	out := append([]migration(nil), ms...)
+	for _, e := range extra {
+		for _, m := range out {
+			if m.version == e.version {
+				return nil, fmt.Errorf("migration version %d used by %s and %s", e.version, m.name, e.name)
+			}
+		}
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].version < out[j].version })
+	return out, nil
+}
+
+// planMigrations returns the migrations still to apply, leaving out optional ones. It fails if the
+// database has a version this binary doesn't know (errDatabaseAhead) or an applied migration's
+// checksum has changed.
+func planMigrations(known []migration, applied []appliedMigration) ([]migration, error) {
+	byVersion := make(map[int]migration, len(known))
+	for _, m := range known {
+		byVersion[m.version] = m
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		m, ok := byVersion[a.version]
+		if !ok {
+			return nil, fmt.Errorf("%w: version %d (%s) is not embedded", errDatabaseAhead, a.version, a.name)
+		}
+		if !m.optional && m.checksum != a.checksum {
+			return nil, fmt.Errorf("migration %d (%s) was modified after it was applied", a.version, a.name)
+		}
+		done[a.version] = true
+	}
+	var pending []migration
+	for _, m := range known {
+		if !done[m.version] && !m.optional {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrator applies embedded migrations to a database, holding an advisory lock so concurrent
+// replicas starting together don't race.
+type migrator struct {
+	pool       *pgxpool.Pool
+	migrations []migration
+}
+
+// newMigrator loads the embedded migrations and the Go ones, which follow partition.
+func newMigrator(pool *pgxpool.Pool, partition partitionConfig) (*migrator, error) {
+	ms, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	ms, err = addMigrations(ms, partitionMigration(partition))
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{pool: pool, migrations: ms}, nil
+}
+
+// up applies pending migrations, each in its own transaction unless marked with noTxMarker, and
+// returns those applied.
+func (m *migrator) up(ctx context.Context) ([]migration, error) {
+	var applied []migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		_, err := conn.Exec(ctx, `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version INTEGER PRIMARY KEY,
+				name TEXT NOT NULL,
+				checksum TEXT NOT NULL,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)
+		`)
+		if err != nil {
+			return fmt.Errorf("create schema_migrations: %w", err)
+		}
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		pending, err := planMigrations(m.migrations, done)
+		if err != nil {
+			return err
+		}
+		for _, mig := range pending {
+			if err := applyMigration(ctx, conn, mig); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", mig.version, mig.name, err)
+			}
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// pending returns migrations not yet applied, without applying them or creating anything.
+func (m *migrator) pending(ctx context.Context) ([]migration, error) {
+	var pending []migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		pending, err = planMigrations(m.migrations, done)
+		return err
+	})
+	return pending, err
+}
+
+// status writes one line per known or applied migration.
+func (m *migrator) status(ctx context.Context, w io.Writer) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		byVersion := make(map[int]appliedMigration, len(done))
+		for _, a := range done {
+			byVersion[a.version] = a
+		}
+		fmt.Fprintf(w, "%-8s %-32s %-10s %s\n", "VERSION", "NAME", "STATE", "APPLIED")
+		for _, mig := range m.migrations {
+			a, ok := byVersion[mig.version]
+			switch {
+			case !ok && mig.optional:
+				fmt.Fprintf(w, "%-8d %-32s %-10s %s\n", mig.version, mig.name, "skipped", "-")
+			case !ok:
+				fmt.Fprintf(w, "%-8d %-32s %-10s %s\n", mig.version, mig.name, "pending", "-")
+			case a.checksum != mig.checksum && !mig.optional:
+				fmt.Fprintf(w, "%-8d %-32s %-10s %s\n", mig.version, mig.name, "modified", a.appliedAt.Format(time.RFC3339))
+			default:
+				fmt.Fprintf(w, "%-8d %-32s %-10s %s\n", mig.version, mig.name, "applied", a.appliedAt.Format(time.RFC3339))
+			}
+			delete(byVersion, mig.version)
+		}
+		for _, a := range done {
+			if _, unknown := byVersion[a.version]; unknown {
+				fmt.Fprintf(w, "%-8d %-32s %-10s %s\n", a.version, a.name, "unknown", a.appliedAt.Format(time.RFC3339))
+			}
+		}
+		return nil
+	})
+}
+
+func (m *migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	// Unlock with a fresh context so a canceled ctx doesn't leave the session holding the lock.
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	return fn(conn)
+}
+
+// applied reads schema_migrations; only up creates it, so checks leave a fresh database as is.
+func (m *migrator) applied(ctx context.Context, conn *pgxpool.Conn) ([]appliedMigration, error) {
+	var exists bool
+	if err := conn.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (appliedMigration, error) {
+		var a appliedMigration
+		err := row.Scan(&a.version, &a.name, &a.checksum, &a.appliedAt)
+		return a, err
+	})
+}
+
+func applyMigration(ctx context.Context, conn *pgxpool.Conn, mig migration) error {
+	if mig.noTx {
+		for _, stmt := range splitStatements(mig.sql) {
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		_, err := conn.Exec(ctx,
+			`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+			mig.version, mig.name, mig.checksum,
+		)
+		return err
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no-op after Commit
+	if mig.apply != nil {
+		err = mig.apply(ctx, tx)
+	} else {
+		_, err = tx.Exec(ctx, mig.sql)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+		mig.version, mig.name, mig.checksum,
+	); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// splitStatements splits a no-transaction migration into statements, each ending with ";" at the
+// end of a line. Comment-only chunks are dropped.
+func splitStatements(sql string) []string {
+	var out []string
+	for _, chunk := range strings.SplitAfter(sql, ";\n") {
+		code := false
+		for _, line := range strings.Split(chunk, "\n") {
+			if l := strings.TrimSpace(line); l != "" && !strings.HasPrefix(l, "--") {
+				code = true
+			}
+		}
+		if code {
+			out = append(out, strings.TrimSpace(chunk))
+		}
+	}
+	return out
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrationsEmbedded(t *testing.T) {
+	ms, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) == 0 || ms[0].version != 1 {
+		t.Fatalf("want embedded migrations starting at 1, got %+v", ms)
+	}
+	for i := 1; i < len(ms); i++ {
+		if ms[i].version <= ms[i-1].version {
+			t.Errorf("migrations not ordered: %d after %d", ms[i].version, ms[i-1].version)
+		}
+	}
+}
+
+func TestLoadMigrationsOrderAndValidation(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0010_later.sql":  {Data: []byte("SELECT 10;")},
+		"migrations/0002_second.sql": {Data: []byte("SELECT 2;")},
+	}
+	ms, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].version != 2 || ms[1].version != 10 || ms[0].name != "second" {
+		t.Errorf("got %+v", ms)
+	}
+	if ms[0].checksum == ms[1].checksum {
+		t.Error("different bodies should have different checksums")
+	}
+
+	bad := fstest.MapFS{"migrations/init.sql": {Data: []byte("SELECT 1;")}}
+	if _, err := loadMigrations(bad); err == nil {
+		t.Error("want error for unversioned file name")
+	}
+	dup := fstest.MapFS{
+		"migrations/0001_a.sql": {Data: []byte("SELECT 1;")},
+		"migrations/001_b.sql":  {Data: []byte("SELECT 2;")},
+	}
+	if _, err := loadMigrations(dup); err == nil {
+		t.Error("want error for duplicate version")
+	}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	known := []migration{
+		{version: 1, name: "a", checksum: "c1"},
+		{version: 2, name: "b", checksum: "c2"},
+	}
+
+	pending, err := planMigrations(known, []appliedMigration{{version: 1, name: "a", checksum: "c1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].version != 2 {
+		t.Errorf("pending = %+v, want [2]", pending)
+	}
+
+	_, err = planMigrations(known, []appliedMigration{{version: 3, name: "future", checksum: "c3"}})
+	if !errors.Is(err, errDatabaseAhead) {
+		t.Errorf("err = %v, want errDatabaseAhead", err)
+	}
+
+	_, err = planMigrations(known, []appliedMigration{{version: 1, name: "a", checksum: "edited"}})
+	if err == nil {
+		t.Error("want checksum mismatch error")
+	}
+}
+
+func TestOptionalMigrations(t *testing.T) {
+	ms, err := addMigrations([]migration{{version: 1, name: "a", checksum: "c1"}, {version: 3, name: "c", checksum: "c3"}},
+		migration{version: 2, name: "b", checksum: "c2", optional: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 3 || ms[1].name != "b" {
+		t.Fatalf("merged = %+v", ms)
+	}
+	if _, err := addMigrations(ms, migration{version: 3, name: "d"}); err == nil {
+		t.Error("want error for duplicate version")
+	}
+
+	pending, err := planMigrations(ms, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].version != 1 || pending[1].version != 3 {
+		t.Errorf("pending = %+v, want [1 3]", pending)
+	}
+	// Applied under another configuration: not checked while unwanted.
+	if _, err := planMigrations(ms, []appliedMigration{{version: 2, name: "b", checksum: "other"}}); err != nil {
+		t.Errorf("optional checksum checked: %v", err)
+	}
+}
+
+func TestPartitionMigration(t *testing.T) {
+	for _, by := range []string{"", "block_number", "created_at"} {
+		m, err := newMigrator(nil, partitionConfig{by: by})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found *migration
+		for i := range m.migrations {
+			if m.migrations[i].version == partitionMigrationVersion {
+				found = &m.migrations[i]
+			}
+		}
+		if found == nil || found.apply == nil || found.optional != (by == "") {
+			t.Fatalf("by %q: partition migration = %+v", by, found)
+		}
+	}
+	blocks, times := partitionMigration(partitionConfig{by: "block_number"}), partitionMigration(partitionConfig{by: "created_at"})
+	if blocks.checksum == times.checksum {
+		t.Error("switching the partition column should change the checksum")
+	}
+}
+
+func TestNoTransactionMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0001_tx.sql":   {Data: []byte("CREATE TABLE t (id INT);\n")},
+		"migrations/0002_notx.sql": {Data: []byte(noTxMarker + "\n-- rebuild\nDROP INDEX CONCURRENTLY IF EXISTS i;\nCREATE INDEX CONCURRENTLY i\n  ON t (id);\n")},
+	}
+	ms, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms[0].noTx || !ms[1].noTx {
+		t.Fatalf("noTx = %v, %v", ms[0].noTx, ms[1].noTx)
+	}
+	got := splitStatements(ms[1].sql)
+	want := []string{"-- rebuild\nDROP INDEX CONCURRENTLY IF EXISTS i;", "CREATE INDEX CONCURRENTLY i\n  ON t (id);"}
+	if len(got) != len(want) {
+		t.Fatalf("statements = %q", got)
+	}
+	for i := range want {
+		if !strings.HasSuffix(got[i], want[i]) {
+			t.Errorf("statement %d = %q, want suffix %q", i, got[i], want[i])
+		}
+	}
+
+	embedded, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range embedded {
+		if strings.Contains(m.sql, "CONCURRENTLY") && !m.noTx {
+			t.Errorf("migration %d builds concurrently inside a transaction", m.version)
+		}
+	}
+}
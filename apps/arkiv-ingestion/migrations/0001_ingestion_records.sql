@@ -0,0 +1,8 @@
+-- Baseline: the table previously created inline by newPostgresIngester.
+CREATE TABLE IF NOT EXISTS ingestion_records (
+	idempotency_key TEXT PRIMARY KEY,
+	chain_id TEXT,
+	block_number BIGINT,
+	data JSONB,
+	created_at TIMESTAMPTZ DEFAULT NOW()
+);
@@ -0,0 +1,54 @@
+-- Normalized chain data written by normalizedIngester (INGEST_MODE=normalized).
+-- Hashes and addresses are lowercase 0x-prefixed hex; wei amounts are NUMERIC(78,0) (fits uint256).
+CREATE TABLE IF NOT EXISTS blocks (
+	chain_id TEXT NOT NULL,
+	number BIGINT NOT NULL,
+	hash TEXT NOT NULL,
+	parent_hash TEXT NOT NULL,
+	timestamp TIMESTAMPTZ NOT NULL,
+	miner TEXT,
+	gas_used BIGINT NOT NULL,
+	gas_limit BIGINT NOT NULL,
+	base_fee_per_gas NUMERIC(78, 0),
+	tx_count INTEGER NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (chain_id, number)
+);
+CREATE INDEX IF NOT EXISTS blocks_hash_idx ON blocks (chain_id, hash);
+
+CREATE TABLE IF NOT EXISTS transactions (
+	chain_id TEXT NOT NULL,
+	block_number BIGINT NOT NULL,
+	tx_index INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	from_address TEXT NOT NULL,
+	to_address TEXT,
+	value NUMERIC(78, 0) NOT NULL,
+	nonce BIGINT NOT NULL,
+	gas BIGINT NOT NULL,
+	gas_price NUMERIC(78, 0),
+	input TEXT NOT NULL,
+	PRIMARY KEY (chain_id, block_number, tx_index),
+	FOREIGN KEY (chain_id, block_number) REFERENCES blocks (chain_id, number) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS transactions_hash_idx ON transactions (chain_id, hash);
+CREATE INDEX IF NOT EXISTS transactions_from_idx ON transactions (chain_id, from_address);
+CREATE INDEX IF NOT EXISTS transactions_to_idx ON transactions (chain_id, to_address);
+
+CREATE TABLE IF NOT EXISTS logs (
+	chain_id TEXT NOT NULL,
+	block_number BIGINT NOT NULL,
+	log_index INTEGER NOT NULL,
+	tx_hash TEXT NOT NULL,
+	address TEXT NOT NULL,
+	topic0 TEXT,
+	topic1 TEXT,
+	topic2 TEXT,
+	topic3 TEXT,
+	data TEXT NOT NULL,
+	PRIMARY KEY (chain_id, block_number, log_index),
+	FOREIGN KEY (chain_id, block_number) REFERENCES blocks (chain_id, number) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS logs_address_idx ON logs (chain_id, address);
+CREATE INDEX IF NOT EXISTS logs_topic0_idx ON logs (chain_id, topic0);
+CREATE INDEX IF NOT EXISTS logs_tx_hash_idx ON logs (chain_id, tx_hash);
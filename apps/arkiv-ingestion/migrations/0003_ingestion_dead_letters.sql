@@ -0,0 +1,12 @@
+-- Records that exhausted ingest retries. data is BYTEA: a malformed payload must still be storable.
+CREATE TABLE IF NOT EXISTS ingestion_dead_letters (
+	idempotency_key TEXT PRIMARY KEY,
+	chain_id TEXT NOT NULL,
+	block_number BIGINT NOT NULL,
+	data BYTEA NOT NULL,
+	error TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	first_failed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	last_failed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS ingestion_dead_letters_chain_block_idx ON ingestion_dead_letters (chain_id, block_number);
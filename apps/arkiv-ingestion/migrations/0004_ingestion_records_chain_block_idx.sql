@@ -0,0 +1,6 @@
+-- migrate: no-transaction
+-- Per-chain lookups by block number: checkpoints (MAX per chain) and range reads. Built
+-- concurrently so ingestion keeps writing meanwhile; a failed build leaves an invalid index
+-- behind, which the retry drops first.
+DROP INDEX CONCURRENTLY IF EXISTS ingestion_records_chain_block_idx;
+CREATE INDEX CONCURRENTLY ingestion_records_chain_block_idx ON ingestion_records (chain_id, block_number);
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// recordsChannel is the NOTIFY channel postgresIngester announces inserted rows on; the payload
+// is the row's idempotency key.
+const recordsChannel = "arkiv_ingestion_records"
+
+// notificationConn is a connection already LISTENing on recordsChannel (*pgx.Conn in production).
+type notificationConn interface {
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+	Close(ctx context.Context) error
+}
+
+// feedStore resolves notified keys to records and backfills after a reconnect.
+type feedStore interface {
+	RecordByKey(ctx context.Context, key string) (*storedRecord, error)
+	ListBlocks(ctx context.Context, chainID string, from, to uint64, limit int) ([]storedRecord, error)
+}
+
+// recordFeed turns ingestion_records notifications into a channel of records for in-process
+// consumers, in any replica. Notifications sent while disconnected are lost, so after a
+// reconnect it re-reads blocks above the last one delivered for each chain it has seen.
+// Consumers may therefore see a record twice and must be idempotent.
+type recordFeed struct {
+	listen func(ctx context.Context) (notificationConn, error)
+	store  feedStore
+	retry  retryPolicy // reconnect backoff
+	log    *slog.Logger
+}
+
+func newRecordFeed(p *postgresIngester, log *slog.Logger) *recordFeed {
+	return &recordFeed{
+		listen: p.listen,
+		store:  p,
+		retry:  retryPolicy{baseDelay: time.Second, maxDelay: 30 * time.Second},
+		log:    log,
+	}
+}
+
+// listen takes a connection out of the pool for good; it is closed, not returned, when done.
+func (p *postgresIngester) listen(ctx context.Context) (notificationConn, error) {
+	c, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.Hijack()
+	if _, err := conn.Exec(ctx, "LISTEN "+recordsChannel); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// subscribe delivers records until ctx is done, then closes the channel. A consumer that stops
+// reading stalls the feed; Postgres queues notifications in the meantime.
+func (f *recordFeed) subscribe(ctx context.Context, buffer int) <-chan storedRecord {
+	out := make(chan storedRecord, buffer)
+	go func() {
+		defer close(out)
+		last := map[string]uint64{} // highest block delivered per chain
+		for attempt := 0; ; attempt++ {
+			connected, err := f.run(ctx, out, last, attempt > 0)
+			if ctx.Err() != nil {
+				return
+			}
+			if connected {
+				attempt = 0
+			}
+			f.log.Warn("record feed disconnected", "err", err)
+			t := time.NewTimer(f.retry.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return out
+}
+
+// run listens on one connection until it fails. connected reports whether LISTEN succeeded.
+func (f *recordFeed) run(ctx context.Context, out chan<- storedRecord, last map[string]uint64, reconnect bool) (connected bool, err error) {
+	conn, err := f.listen(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+
+	if reconnect {
+		for chainID, block := range last {
+			if err := f.backfill(ctx, out, last, chainID, block+1); err != nil {
+				return true, err
+			}
+		}
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		rec, err := f.store.RecordByKey(ctx, n.Payload)
+		if err != nil {
+			return true, err
+		}
+		if rec == nil {
+			continue // removed since (e.g. retention)
+		}
+		if !deliver(ctx, out, last, *rec) {
+			return true, ctx.Err()
+		}
+	}
+}
+
+func (f *recordFeed) backfill(ctx context.Context, out chan<- storedRecord, last map[string]uint64, chainID string, from uint64) error {
+	const page = 500
+	for {
+		recs, err := f.store.ListBlocks(ctx, chainID, from, ^uint64(0)>>1, page)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if !deliver(ctx, out, last, rec) {
+				return ctx.Err()
+			}
+		}
+		if len(recs) < page {
+			return nil
+		}
+		from = recs[len(recs)-1].BlockNumber + 1
+	}
+}
+
+func deliver(ctx context.Context, out chan<- storedRecord, last map[string]uint64, rec storedRecord) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case out <- rec:
+	}
+	if b, ok := last[rec.ChainID]; !ok || rec.BlockNumber > b {
+		last[rec.ChainID] = rec.BlockNumber
+	}
+	return true
+}
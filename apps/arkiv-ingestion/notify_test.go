@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeNotifyConn yields payloads, then fails with err (or blocks until ctx is done if err is nil).
+type fakeNotifyConn struct {
+	payloads []string
+	err      error
+}
+
+func (c *fakeNotifyConn) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	if len(c.payloads) > 0 {
+		p := c.payloads[0]
+		c.payloads = c.payloads[1:]
+		return &pgconn.Notification{Channel: recordsChannel, Payload: p}, nil
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *fakeNotifyConn) Close(context.Context) error { return nil }
+
+// feedReader resolves keys "1-<n>" against memReader.
+type feedReader struct{ memReader }
+
+func (f *feedReader) RecordByKey(ctx context.Context, key string) (*storedRecord, error) {
+	var n uint64
+	if _, err := fmt.Sscanf(key, "1-%d", &n); err != nil {
+		return nil, nil
+	}
+	return f.GetBlock(ctx, "1", n)
+}
+
+func feedWith(store feedStore, conns ...*fakeNotifyConn) *recordFeed {
+	return &recordFeed{
+		listen: func(ctx context.Context) (notificationConn, error) {
+			if len(conns) == 0 {
+				return nil, errors.New("no more connections")
+			}
+			c := conns[0]
+			conns = conns[1:]
+			return c, nil
+		},
+		store: store,
+		retry: testRetryPolicy,
+		log:   discardLogger(),
+	}
+}
+
+func receiveBlocks(t *testing.T, ch <-chan storedRecord, n int) []uint64 {
+	t.Helper()
+	var got []uint64
+	for len(got) < n {
+		select {
+		case r := <-ch:
+			got = append(got, r.BlockNumber)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out after %v", got)
+		}
+	}
+	return got
+}
+
+func TestRecordFeedDeliversNotifiedRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	feed := feedWith(&feedReader{memReader{n: 10}}, &fakeNotifyConn{payloads: []string{"1-3", "1-99", "1-4"}})
+	ch := feed.subscribe(ctx, 0)
+	if got := receiveBlocks(t, ch, 2); got[0] != 3 || got[1] != 4 {
+		t.Fatalf("got %v, want [3 4] (unknown key skipped)", got)
+	}
+	cancel()
+	for range ch {
+	}
+}
+
+func TestRecordFeedBackfillsAfterReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	feed := feedWith(&feedReader{memReader{n: 8}},
+		&fakeNotifyConn{payloads: []string{"1-5"}, err: errors.New("connection reset")},
+		&fakeNotifyConn{payloads: []string{"1-7"}},
+	)
+	// 6 and 7 were inserted while disconnected: backfilled, then 7 arrives again live.
+	got := receiveBlocks(t, feed.subscribe(ctx, 0), 4)
+	if fmt.Sprint(got) != "[5 6 7 7]" {
+		t.Fatalf("got %v, want [5 6 7 7]", got)
+	}
+}
+
+func TestIngestNotifiesOnlyNewRows(t *testing.T) {
+	ing := testDBIngester(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := ing.listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	r := benchRecords(1)[0]
+	for i := 0; i < 2; i++ {
+		if err := ing.Ingest(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := conn.WaitForNotification(ctx)
+	if err != nil || n.Payload != r.IdempotencyKey {
+		t.Fatalf("notification %v, %v", n, err)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if n, err := conn.WaitForNotification(short); err == nil {
+		t.Fatalf("duplicate insert notified: %v", n)
+	}
+}
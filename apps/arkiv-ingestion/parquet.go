@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+)
+
+// Minimal Parquet writer for the archive schema: four REQUIRED flat columns, PLAIN encoding,
+// one row group per file, optional GZIP. Covers what the archive needs without pulling in a
+// Parquet library; see https://parquet.apache.org/docs/file-format/ and parquet.thrift. Tests
+// read its output back with parquet-go, a test-only dependency.
+
+const (
+	parquetMagic    = "PAR1"
+	parquetPageRows = 8192 // rows per data page
+
+	parquetInt64     = 2 // Type
+	parquetByteArray = 6
+	parquetUTF8      = 0  // ConvertedType
+	parquetJSON      = 19 // ConvertedType
+	parquetPlain     = 0  // Encoding
+	parquetRLE       = 3
+	parquetCodecNone = 0 // CompressionCodec
+	parquetCodecGzip = 2
+)
+
+// parquetRows buffers archive rows by column until the file is written.
+type parquetRows struct {
+	chainID []string
+	block   []int64
+	key     []string
+	data    [][]byte
+	size    int64 // approximate encoded size, for rotation
+}
+
+func (p *parquetRows) add(r IngestRecord) {
+	p.chainID = append(p.chainID, r.ChainID)
+	p.block = append(p.block, int64(r.BlockNumber))
+	p.key = append(p.key, r.IdempotencyKey)
+	p.data = append(p.data, append([]byte(nil), r.Data...))
+	p.size += int64(len(r.ChainID)+len(r.IdempotencyKey)+len(r.Data)) + 3*4 + 8
+}
+
+func (p *parquetRows) len() int { return len(p.block) }
+
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32 // -1 = none
+	plain     func(buf *bytes.Buffer, row int)
+}
+
+func (p *parquetRows) columns() []parquetColumn {
+	str := func(vals []string) func(*bytes.Buffer, int) {
+		return func(buf *bytes.Buffer, i int) {
+			buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(vals[i]))))
+			buf.WriteString(vals[i])
+		}
+	}
+	return []parquetColumn{
+		{"chain_id", parquetByteArray, parquetUTF8, str(p.chainID)},
+		{"block_number", parquetInt64, -1, func(buf *bytes.Buffer, i int) {
+			buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(p.block[i])))
+		}},
+		{"idempotency_key", parquetByteArray, parquetUTF8, str(p.key)},
+		{"data", parquetByteArray, parquetJSON, func(buf *bytes.Buffer, i int) {
+			buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(p.data[i]))))
+			buf.Write(p.data[i])
+		}},
+	}
+}
+
+type parquetChunkMeta struct {
+	col                            parquetColumn
+	offset                         int64
+	uncompressedSize, compressedSz int64
+}
+
+// writeTo writes a complete Parquet file. There must be at least one row.
+func (p *parquetRows) writeTo(w io.Writer, gzipped bool) error {
+	cw := &countingWriter{w: w}
+	if _, err := io.WriteString(cw, parquetMagic); err != nil {
+		return err
+	}
+	codec := int32(parquetCodecNone)
+	if gzipped {
+		codec = parquetCodecGzip
+	}
+	rows := p.len()
+	var chunks []parquetChunkMeta
+	for _, col := range p.columns() {
+		meta := parquetChunkMeta{col: col, offset: cw.n}
+		for start := 0; start < rows; start += parquetPageRows {
+			end := min(start+parquetPageRows, rows)
+			var page bytes.Buffer
+			for i := start; i < end; i++ {
+				col.plain(&page, i)
+			}
+			body := page.Bytes()
+			if gzipped {
+				var z bytes.Buffer
+				zw := gzip.NewWriter(&z)
+				zw.Write(body)
+				if err := zw.Close(); err != nil {
+					return err
+				}
+				body = z.Bytes()
+			}
+			header := encodePageHeader(end-start, page.Len(), len(body))
+			if _, err := cw.Write(header); err != nil {
+				return err
+			}
+			if _, err := cw.Write(body); err != nil {
+				return err
+			}
+			meta.uncompressedSize += int64(len(header) + page.Len())
+			meta.compressedSz += int64(len(header) + len(body))
+		}
+		chunks = append(chunks, meta)
+	}
+	footer := encodeFileMetaData(rows, chunks, codec)
+	if _, err := cw.Write(footer); err != nil {
+		return err
+	}
+	if _, err := cw.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(footer)))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(cw, parquetMagic)
+	return err
+}
+
+func encodePageHeader(values, uncompressed, compressed int) []byte {
+	var t thriftCompact
+	t.i32(1, 0) // DATA_PAGE
+	t.i32(2, int32(uncompressed))
+	t.i32(3, int32(compressed))
+	t.beginStruct(5) // DataPageHeader
+	t.i32(1, int32(values))
+	t.i32(2, parquetPlain)
+	t.i32(3, parquetRLE)
+	t.i32(4, parquetRLE)
+	t.endStruct()
+	t.stop()
+	return t.buf.Bytes()
+}
+
+func encodeFileMetaData(rows int, chunks []parquetChunkMeta, codec int32) []byte {
+	var t thriftCompact
+	t.i32(1, 1) // version
+	t.beginList(2, thriftStruct, len(chunks)+1)
+	t.beginElem() // root
+	t.binary(4, []byte("schema"))
+	t.i32(5, int32(len(chunks)))
+	t.endStruct()
+	for _, c := range chunks {
+		t.beginElem()
+		t.i32(1, c.col.typ)
+		t.i32(3, 0) // REQUIRED
+		t.binary(4, []byte(c.col.name))
+		if c.col.converted >= 0 {
+			t.i32(6, c.col.converted)
+		}
+		t.endStruct()
+	}
+	t.i64(3, int64(rows))
+	t.beginList(4, thriftStruct, 1) // one row group
+	t.beginElem()
+	t.beginList(1, thriftStruct, len(chunks))
+	var total int64
+	for _, c := range chunks {
+		t.beginElem() // ColumnChunk
+		t.i64(2, c.offset)
+		t.beginStruct(3) // ColumnMetaData
+		t.i32(1, c.col.typ)
+		t.beginList(2, thriftI32, 1)
+		t.varint(parquetPlain)
+		t.beginList(3, thriftBinary, 1)
+		t.rawBinary([]byte(c.col.name))
+		t.i32(4, codec)
+		t.i64(5, int64(rows))
+		t.i64(6, c.uncompressedSize)
+		t.i64(7, c.compressedSz)
+		t.i64(9, c.offset)
+		t.endStruct()
+		t.endStruct()
+		total += c.uncompressedSize
+	}
+	t.i64(2, total)
+	t.i64(3, int64(rows))
+	t.endStruct()
+	t.binary(6, []byte("arkiv-ingestion"))
+	t.stop()
+	return t.buf.Bytes()
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftCompact encodes structs in the Thrift compact protocol, which Parquet uses for metadata.
+type thriftCompact struct {
+	buf    bytes.Buffer
+	lastID int16
+	stack  []int16
+}
+
+func (t *thriftCompact) field(id int16, typ byte) {
+	if d := id - t.lastID; d > 0 && d <= 15 {
+		t.buf.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.lastID = id
+}
+
+// varint writes a zigzag varint (i16/i32/i64).
+func (t *thriftCompact) varint(v int64) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(v<<1)^uint64(v>>63)))
+}
+
+func (t *thriftCompact) i32(id int16, v int32) { t.field(id, thriftI32); t.varint(int64(v)) }
+func (t *thriftCompact) i64(id int16, v int64) { t.field(id, thriftI64); t.varint(v) }
+
+func (t *thriftCompact) binary(id int16, b []byte) {
+	t.field(id, thriftBinary)
+	t.rawBinary(b)
+}
+
+func (t *thriftCompact) rawBinary(b []byte) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	t.buf.Write(b)
+}
+
+func (t *thriftCompact) beginList(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+	}
+}
+
+func (t *thriftCompact) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElem()
+}
+
+// beginElem starts a struct that is a list element (no field header).
+func (t *thriftCompact) beginElem() {
+	t.stack = append(t.stack, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftCompact) endStruct() {
+	t.stop()
+	t.lastID = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftCompact) stop() { t.buf.WriteByte(0) }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ingestion_records can be range-partitioned by block_number or created_at (RECORDS_PARTITION_BY).
+// The partition_ingestion_records migration converts the plain table in place (see
+// partitionConfig.convert); partitionManager creates upcoming partitions ahead of
+// ingestion and retires partitions past the retention age by detaching or dropping them. Managed
+// partitions are named after their bounds (ingestion_records_b<lo>_<hi> for blocks,
+// ingestion_records_t<lo>_<hi> for UTC times); rows no partition covers land in
+// ingestion_records_default.
+
+// partitionLockKey is the advisory lock key held by the replica doing partition maintenance.
+const partitionLockKey int64 = 0x61726b6970 // "arkip"
+
+type partitionConfig struct {
+	by        string        // "" (plain table), "block_number" or "created_at"
+	blocks    uint64        // partition span when by block_number
+	period    time.Duration // partition span when by created_at
+	premake   int           // partitions created ahead of the current one
+	retention time.Duration // partitions older than this are retired; 0 keeps everything
+	drop      bool          // drop retired partitions; else detach them as standalone tables
+	interval  time.Duration // maintenance interval
+}
+
+// span is a partition's width: blocks, or seconds for created_at.
+func (c partitionConfig) span() int64 {
+	if c.by == "created_at" {
+		return int64(c.period / time.Second)
+	}
+	return int64(c.blocks)
+}
+
+// partRange is a partition's bounds [lo, hi): block numbers, or unix seconds for created_at. lo
+// is math.MinInt64 for the partition holding the rows from before the table was partitioned.
+type partRange struct{ lo, hi int64 }
+
+func (r partRange) contains(v int64) bool { return r.lo <= v && v < r.hi }
+
+const partitionTimeLayout = "20060102t1504"
+
+func (c partitionConfig) name(r partRange) string {
+	format := func(v int64) string { return strconv.FormatInt(v, 10) }
+	prefix := "ingestion_records_b"
+	if c.by == "created_at" {
+		format = func(v int64) string { return time.Unix(v, 0).UTC().Format(partitionTimeLayout) }
+		prefix = "ingestion_records_t"
+	}
+	lo := "min"
+	if r.lo != math.MinInt64 {
+		lo = format(r.lo)
+	}
+	return prefix + lo + "_" + format(r.hi)
+}
+
+// parseName returns the bounds of a partition named by name; ok is false for other tables.
+func (c partitionConfig) parseName(name string) (r partRange, ok bool) {
+	parse := func(s string) (int64, error) { return strconv.ParseInt(s, 10, 64) }
+	prefix := "ingestion_records_b"
+	if c.by == "created_at" {
+		parse = func(s string) (int64, error) {
+			t, err := time.Parse(partitionTimeLayout, s)
+			return t.Unix(), err
+		}
+		prefix = "ingestion_records_t"
+	}
+	rest, ok := strings.CutPrefix(name, prefix)
+	lo, hi, cut := strings.Cut(rest, "_")
+	if !ok || !cut {
+		return partRange{}, false
+	}
+	var err error
+	r.lo = math.MinInt64
+	if lo != "min" {
+		if r.lo, err = parse(lo); err != nil {
+			return partRange{}, false
+		}
+	}
+	if r.hi, err = parse(hi); err != nil {
+		return partRange{}, false
+	}
+	return r, r.lo < r.hi
+}
+
+// bound formats v as a partition bound.
+func (c partitionConfig) bound(v int64) string {
+	switch {
+	case v == math.MinInt64:
+		return "MINVALUE"
+	case c.by == "created_at":
+		return "'" + time.Unix(v, 0).UTC().Format("2006-01-02 15:04:05+00") + "'"
+	default:
+		return strconv.FormatInt(v, 10)
+	}
+}
+
+// wanted returns the partitions that should exist for frontiers (each chain's next block, or now
+// for created_at): the one holding each frontier and premake after it, in order.
+func (c partitionConfig) wanted(frontiers []int64) []partRange {
+	span := c.span()
+	seen := map[int64]bool{}
+	var out []partRange
+	for _, f := range frontiers {
+		first := f - f%span
+		for i := 0; i <= c.premake; i++ {
+			lo := first + int64(i)*span
+			if !seen[lo] {
+				seen[lo] = true
+				out = append(out, partRange{lo, lo + span})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].lo < out[j].lo })
+	return out
+}
+
+// missingRanges returns the ranges in want that overlap none of have.
+func missingRanges(want, have []partRange) []partRange {
+	var out []partRange
+	for _, w := range want {
+		overlaps := false
+		for _, h := range have {
+			if w.lo < h.hi && h.lo < w.hi {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// pgQuerier is what partitionedBy needs from a pool, connection or transaction.
+type pgQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// partitionedBy returns the column ingestion_records is range-partitioned by, or "" for a plain
+// table.
+func partitionedBy(ctx context.Context, q pgQuerier) (string, error) {
+	var column string
+	err := q.QueryRow(ctx, `
+		SELECT a.attname FROM pg_partitioned_table p
+		JOIN pg_attribute a ON a.attrelid = p.partrelid AND a.attnum = p.partattrs[0]
+		WHERE p.partrelid = 'ingestion_records'::regclass`).Scan(&column)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return column, err
+}
+
+// partitionManager keeps ingestion_records partitioned as configured; see partitionConfig.
+type partitionManager struct {
+	pool   *pgxpool.Pool
+	cfg    partitionConfig
+	chains []chainConfig // whose next partitions to create and newest rows to keep
+	now    func() time.Time
+	log    *slog.Logger
+}
+
+func newPartitionManager(pool *pgxpool.Pool, cfg partitionConfig, chains []chainConfig, log *slog.Logger) *partitionManager {
+	return &partitionManager{pool: pool, cfg: cfg, chains: chains, now: time.Now, log: log}
+}
+
+// prepare checks ingestion_records against the configured partitioning, which the
+// partition_ingestion_records migration applies.
+func (m *partitionManager) prepare(ctx context.Context) error {
+	by, err := partitionedBy(ctx, m.pool)
+	switch {
+	case err != nil:
+		return err
+	case by == m.cfg.by:
+		return nil
+	case m.cfg.by == "":
+		m.log.Warn("ingestion_records is partitioned but RECORDS_PARTITION_BY is unset; new rows may land in the default partition", "by", by)
+		return nil
+	case by != "":
+		return fmt.Errorf("ingestion_records is partitioned by %s, not %s", by, m.cfg.by)
+	}
+	return errors.New("ingestion_records is not partitioned yet; run `arkiv-ingestion migrate up` to convert it")
+}
+
+// partitionMigrationVersion numbers partitionMigration among the embedded migrations.
+const partitionMigrationVersion = 5
+
+// partitionMigration converts ingestion_records as cfg asks; it is optional while cfg.by is unset.
+// Its checksum covers the partition column, so switching columns once it has run fails like an
+// edited migration.
+func partitionMigration(cfg partitionConfig) migration {
+	sum := sha256.Sum256([]byte("partition ingestion_records by " + cfg.by))
+	return migration{
+		version:  partitionMigrationVersion,
+		name:     "partition_ingestion_records",
+		checksum: hex.EncodeToString(sum[:]),
+		optional: cfg.by == "",
+		apply: func(ctx context.Context, tx pgx.Tx) error {
+			return cfg.convert(ctx, tx, time.Now())
+		},
+	}
+}
+
+// convert turns the plain ingestion_records into a partitioned table within tx. The old table
+// becomes the first partition, from MINVALUE to the next span boundary, so no rows are copied;
+// attaching it scans it once to check the bound, and writes wait meanwhile. A table already
+// partitioned by c.by (converted before this was a migration) is left as is.
+func (c partitionConfig) convert(ctx context.Context, tx pgx.Tx, now time.Time) error {
+	switch by, err := partitionedBy(ctx, tx); {
+	case err != nil:
+		return err
+	case by == c.by:
+		return nil
+	case by != "":
+		return fmt.Errorf("ingestion_records is partitioned by %s, not %s", by, c.by)
+	}
+	if _, err := tx.Exec(ctx, `LOCK TABLE ingestion_records IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	span := c.span()
+	var boundary int64
+	if c.by == "block_number" {
+		var max *int64
+		if err := tx.QueryRow(ctx, `SELECT MAX(block_number) FROM ingestion_records`).Scan(&max); err != nil {
+			return err
+		}
+		if max != nil {
+			boundary = (*max/span + 1) * span
+		}
+	} else {
+		boundary = (now.Unix()/span + 1) * span
+	}
+	key := c.by
+	legacy := c.name(partRange{math.MinInt64, boundary})
+	stmts := []string{
+		`ALTER TABLE ingestion_records RENAME TO ` + legacy,
+		`ALTER TABLE ` + legacy + ` RENAME CONSTRAINT ingestion_records_pkey TO ` + legacy + `_pkey`,
+		`ALTER INDEX IF EXISTS ingestion_records_chain_block_idx RENAME TO ` + legacy + `_chain_block_idx`,
+		`ALTER TABLE ` + legacy + ` ALTER COLUMN ` + key + ` SET NOT NULL`,
+		// The primary key must include the partition column, so idempotency_key alone is no
+		// longer unique; inserts check for an existing key themselves (see postgresIngester).
+		`CREATE TABLE ingestion_records (
+			idempotency_key TEXT NOT NULL,
+			chain_id TEXT,
+			block_number BIGINT,
+			data JSONB,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (idempotency_key, ` + key + `)
+		) PARTITION BY RANGE (` + key + `)`,
+		`CREATE INDEX ingestion_records_chain_block_idx ON ingestion_records (chain_id, block_number)`,
+		`CREATE TABLE ingestion_records_default PARTITION OF ingestion_records DEFAULT`,
+	}
+	if key == "block_number" {
+		// Retention checks each partition's newest row.
+		stmts = append(stmts, `CREATE INDEX ingestion_records_created_at_idx ON ingestion_records (created_at)`)
+	}
+	stmts = append(stmts, fmt.Sprintf(`ALTER TABLE ingestion_records ATTACH PARTITION %s FOR VALUES FROM (MINVALUE) TO (%s)`, legacy, c.bound(boundary)))
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("partition ingestion_records: %w", err)
+		}
+	}
+	return nil
+}
+
+// run repeats maintain every interval; the caller runs the first round before ingesting.
+func (m *partitionManager) run(ctx context.Context) {
+	t := time.NewTicker(m.cfg.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := m.maintain(ctx); err != nil && ctx.Err() == nil {
+			m.log.Warn("partition maintenance failed", "err", err)
+			recordsPartitionErrors.Inc()
+		}
+	}
+}
+
+type managedPartition struct {
+	name string
+	partRange
+}
+
+// maintain creates missing upcoming partitions and retires expired ones, except any holding a
+// chain's newest row, so checkpoints never move back. One replica at a time does so (the others
+// skip the round); every replica refreshes the size metrics.
+func (m *partitionManager) maintain(ctx context.Context) error {
+	defer m.observe(ctx)
+	if m.cfg.by == "" {
+		return nil
+	}
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, partitionLockKey).Scan(&locked); err != nil || !locked {
+		return err
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, partitionLockKey)
+
+	have, err := m.partitions(ctx, conn)
+	if err != nil {
+		return err
+	}
+	keep, frontiers, err := m.newest(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if m.cfg.by == "created_at" {
+		frontiers = []int64{m.now().Unix()}
+	}
+	ranges := make([]partRange, len(have))
+	for i, p := range have {
+		ranges[i] = p.partRange
+	}
+	var errs []error
+	for _, r := range missingRanges(m.cfg.wanted(frontiers), ranges) {
+		name := m.cfg.name(r)
+		_, err := conn.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF ingestion_records FOR VALUES FROM (%s) TO (%s)`,
+			name, m.cfg.bound(r.lo), m.cfg.bound(r.hi)))
+		if err != nil {
+			// Typically rows for the range already sit in the default partition.
+			errs = append(errs, fmt.Errorf("create %s: %w", name, err))
+			continue
+		}
+		m.log.Info("created partition", "partition", name)
+		recordsPartitionsCreated.Inc()
+	}
+
+	if m.cfg.retention <= 0 {
+		return errors.Join(errs...)
+	}
+	cutoff := m.now().Add(-m.cfg.retention)
+	for _, p := range have {
+		if keepPartition(p.partRange, keep) {
+			continue
+		}
+		expired, err := m.expired(ctx, conn, p, cutoff)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("check %s: %w", p.name, err))
+			continue
+		}
+		if !expired {
+			continue
+		}
+		action, stmt := "detach", `ALTER TABLE ingestion_records DETACH PARTITION `+p.name
+		if m.cfg.drop {
+			action, stmt = "drop", `DROP TABLE `+p.name
+		}
+		if _, err := conn.Exec(ctx, stmt); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", action, p.name, err))
+			continue
+		}
+		m.log.Info("retired partition", "partition", p.name, "action", action)
+		recordsPartitionsRetired.WithLabelValues(action).Inc()
+	}
+	return errors.Join(errs...)
+}
+
+func keepPartition(r partRange, keep []int64) bool {
+	for _, v := range keep {
+		if r.contains(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// partitions lists the attached partitions named by partitionConfig.name.
+func (m *partitionManager) partitions(ctx context.Context, conn *pgxpool.Conn) ([]managedPartition, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'ingestion_records'::regclass`)
+	if err != nil {
+		return nil, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	var out []managedPartition
+	for _, name := range names {
+		if r, ok := m.cfg.parseName(name); ok {
+			out = append(out, managedPartition{name, r})
+		}
+	}
+	return out, nil
+}
+
+// newest returns, per configured chain with rows, the partition key of its newest row (keep) and
+// the next block to ingest (frontiers; the start block if nothing is stored yet).
+func (m *partitionManager) newest(ctx context.Context, conn *pgxpool.Conn) (keep, frontiers []int64, err error) {
+	for _, c := range m.chains {
+		var block int64
+		var created time.Time
+		err := conn.QueryRow(ctx,
+			`SELECT block_number, created_at FROM ingestion_records WHERE chain_id = $1
+			 ORDER BY block_number DESC LIMIT 1`, c.ID).Scan(&block, &created)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			frontiers = append(frontiers, int64(c.StartBlock))
+			continue
+		case err != nil:
+			return nil, nil, err
+		}
+		frontiers = append(frontiers, max(block+1, int64(c.StartBlock)))
+		if m.cfg.by == "created_at" {
+			keep = append(keep, created.Unix())
+		} else {
+			keep = append(keep, block)
+		}
+	}
+	return keep, frontiers, nil
+}
+
+// expired reports whether every row in p is older than cutoff: by its upper bound for created_at
+// partitions, by its newest row for block_number ones (an empty one may be upcoming: kept).
+func (m *partitionManager) expired(ctx context.Context, conn *pgxpool.Conn, p managedPartition, cutoff time.Time) (bool, error) {
+	if m.cfg.by == "created_at" {
+		return p.hi <= cutoff.Unix(), nil
+	}
+	var newest *time.Time
+	if err := conn.QueryRow(ctx, `SELECT MAX(created_at) FROM `+p.name).Scan(&newest); err != nil {
+		return false, err
+	}
+	return newest != nil && newest.Before(cutoff), nil
+}
+
+// observe refreshes arkiv_records_table_bytes and arkiv_records_partitions.
+func (m *partitionManager) observe(ctx context.Context) {
+	var size, parts int64
+	err := m.pool.QueryRow(ctx, `
+		SELECT COALESCE(SUM(pg_total_relation_size(oid)), 0)::bigint,
+		       COUNT(*) FILTER (WHERE oid <> 'ingestion_records'::regclass)
+		FROM pg_class
+		WHERE oid = 'ingestion_records'::regclass
+		   OR oid IN (SELECT inhrelid FROM pg_inherits WHERE inhparent = 'ingestion_records'::regclass)`).Scan(&size, &parts)
+	if err != nil {
+		m.log.Warn("read ingestion_records size", "err", err)
+		return
+	}
+	recordsTableBytes.Set(float64(size))
+	recordsPartitions.Set(float64(parts))
+}
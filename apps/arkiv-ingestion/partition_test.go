@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPartitionNames(t *testing.T) {
+	blocks := partitionConfig{by: "block_number", blocks: 1000}
+	days := partitionConfig{by: "created_at", period: 24 * time.Hour}
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC).Unix()
+	for _, tc := range []struct {
+		cfg   partitionConfig
+		r     partRange
+		name  string
+		lo    string
+		hi    string
+		other string // a name the config must not claim
+	}{
+		{blocks, partRange{2000, 3000}, "ingestion_records_b2000_3000", "2000", "3000", "ingestion_records_t20261019t0000_20261020t0000"},
+		{blocks, partRange{math.MinInt64, 1000}, "ingestion_records_bmin_1000", "MINVALUE", "1000", "ingestion_records_default"},
+		{days, partRange{day, day + 86400}, "ingestion_records_t20261019t0000_20261020t0000", "'2026-10-19 00:00:00+00'", "'2026-10-20 00:00:00+00'", "ingestion_records_b0_10"},
+		{days, partRange{math.MinInt64, day}, "ingestion_records_tmin_20261019t0000", "MINVALUE", "'2026-10-19 00:00:00+00'", "ingestion_records_tx_y"},
+	} {
+		if got := tc.cfg.name(tc.r); got != tc.name {
+			t.Errorf("name(%v) = %s, want %s", tc.r, got, tc.name)
+		}
+		if len(tc.name)+len("_chain_block_idx") > 63 {
+			t.Errorf("%s: too long for derived index names", tc.name)
+		}
+		if r, ok := tc.cfg.parseName(tc.name); !ok || r != tc.r {
+			t.Errorf("parseName(%s) = %v, %v", tc.name, r, ok)
+		}
+		if lo, hi := tc.cfg.bound(tc.r.lo), tc.cfg.bound(tc.r.hi); lo != tc.lo || hi != tc.hi {
+			t.Errorf("bounds of %v = %s, %s", tc.r, lo, hi)
+		}
+		if _, ok := tc.cfg.parseName(tc.other); ok {
+			t.Errorf("parseName(%s) claimed a foreign table", tc.other)
+		}
+	}
+}
+
+func TestPartitionPlanning(t *testing.T) {
+	cfg := partitionConfig{by: "block_number", blocks: 100, premake: 2}
+	want := cfg.wanted([]int64{250, 270, 1000})
+	if fmt.Sprint(want) != "[{200 300} {300 400} {400 500} {1000 1100} {1100 1200} {1200 1300}]" {
+		t.Fatalf("wanted = %v", want)
+	}
+	have := []partRange{{math.MinInt64, 300}, {400, 500}}
+	if got := missingRanges(want, have); fmt.Sprint(got) != "[{300 400} {1000 1100} {1100 1200} {1200 1300}]" {
+		t.Fatalf("missing = %v", got)
+	}
+	if !keepPartition(partRange{200, 300}, []int64{250}) || keepPartition(partRange{200, 300}, []int64{300}) {
+		t.Fatal("keepPartition bounds")
+	}
+}
+
+// isolatedDB returns an ingester on a fresh schema, so partitioning doesn't touch the shared one,
+// and the URL of that schema.
+func isolatedDB(t *testing.T) (*postgresIngester, string) {
+	shared := testDBIngester(t)
+	schema := fmt.Sprintf("arkiv_part_%d", time.Now().UnixNano())
+	ctx := context.Background()
+	if _, err := shared.pool.Exec(ctx, `CREATE SCHEMA `+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shared.pool.Exec(context.Background(), `DROP SCHEMA `+schema+` CASCADE`) })
+	url := os.Getenv("ARKIV_TEST_DATABASE_URL")
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	url += sep + "search_path=" + schema
+	ing, err := newPostgresIngester(ctx, url, true, partitionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ing.pool.Close)
+	return ing, url
+}
+
+func TestPostgresPartitioning(t *testing.T) {
+	for _, by := range []string{"block_number", "created_at"} {
+		t.Run(by, func(t *testing.T) {
+			plain, url := isolatedDB(t)
+			ctx := context.Background()
+			rec := func(n uint64) IngestRecord {
+				return IngestRecord{IdempotencyKey: fmt.Sprintf("p-%d", n), ChainID: "p", BlockNumber: n, Data: []byte(`{"v":1}`)}
+			}
+			for n := uint64(0); n < 5; n++ {
+				if err := plain.Ingest(ctx, rec(n)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := partitionConfig{by: by, blocks: 10, period: time.Hour, premake: 2, retention: time.Hour, interval: time.Hour}
+			m := newPartitionManager(plain.pool, cfg, []chainConfig{{ID: "p"}}, discardLogger())
+			if err := m.prepare(ctx); err == nil {
+				t.Fatal("prepare: want error for a plain table")
+			}
+			if _, err := newPostgresIngester(ctx, url, false, cfg); err == nil {
+				t.Fatal("want the partition migration pending")
+			}
+			ing, err := newPostgresIngester(ctx, url, true, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ing.pool.Close()
+			if !ing.partitioned {
+				t.Fatal("ingester doesn't lock keys on a partitioned table")
+			}
+			if got, _ := partitionedBy(ctx, ing.pool); got != by {
+				t.Fatalf("partitioned by %q", got)
+			}
+			if err := m.prepare(ctx); err != nil {
+				t.Fatal(err)
+			}
+			other := cfg
+			other.by = map[string]string{"block_number": "created_at", "created_at": "block_number"}[by]
+			if _, err := newPostgresIngester(ctx, url, true, other); err == nil {
+				t.Fatal("switching the partition column: want error")
+			}
+			if err := m.maintain(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// Idempotency still holds across the partitioned key.
+			dup := rec(3)
+			dup.Data = []byte(`{"v":2}`)
+			if err := ing.Ingest(ctx, dup); err != nil {
+				t.Fatal(err)
+			}
+			if err := ing.IngestBatch(ctx, []IngestRecord{rec(4), rec(25), rec(25)}); err != nil {
+				t.Fatal(err)
+			}
+			var rows int
+			ing.pool.QueryRow(ctx, `SELECT COUNT(*) FROM ingestion_records WHERE chain_id = 'p'`).Scan(&rows)
+			if rows != 6 {
+				t.Fatalf("rows = %d, want 6", rows)
+			}
+			if err := ing.Overwrite(ctx, dup); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ing.GetBlock(ctx, "p", 3); got == nil || string(got.Data) != `{"v": 2}` {
+				t.Fatalf("overwritten block = %+v", got)
+			}
+			var inDefault int
+			ing.pool.QueryRow(ctx, `SELECT COUNT(*) FROM ingestion_records_default`).Scan(&inDefault)
+			if inDefault != 0 {
+				t.Fatalf("%d rows in the default partition", inDefault)
+			}
+
+			// Concurrent writers of a new key store it once, whichever partition they'd target.
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ing.Ingest(ctx, IngestRecord{IdempotencyKey: "p-race", ChainID: "p", BlockNumber: 24, Data: []byte(`{}`)})
+				}()
+			}
+			wg.Wait()
+			var raced int
+			ing.pool.QueryRow(ctx, `SELECT COUNT(*) FROM ingestion_records WHERE idempotency_key = 'p-race'`).Scan(&raced)
+			if raced != 1 {
+				t.Fatalf("%d rows for one key", raced)
+			}
+
+			// Two days on, everything but the partition holding the chain's newest row is retired.
+			m.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+			if err := m.maintain(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if next, ok, _ := ing.Checkpoint(ctx, "p"); !ok || next != 26 {
+				t.Fatalf("checkpoint after retention = %d, %v", next, ok)
+			}
+			if by == "block_number" {
+				if got, _ := ing.GetBlock(ctx, "p", 0); got != nil {
+					t.Fatal("expired block partition still attached")
+				}
+			}
+		})
+	}
+}
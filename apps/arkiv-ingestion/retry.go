@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Error classes used for retry decisions and the class label on arkiv_ingest_errors_total.
+const (
+	errClassRetryable = "retryable" // transient: connection loss, serialization failure, resource limits
+	errClassPermanent = "permanent" // retrying can't help: constraint violation, bad payload, bad SQL
+	errClassCanceled  = "canceled"  // context canceled
+	errClassCircuit   = "circuit"   // the circuit breaker is open; the record is held, not retried
+)
+
+// errInvalidPayload marks records whose payload can't be decoded; always permanent.
+var errInvalidPayload = errors.New("invalid payload")
+
+// classifyError decides whether err is worth retrying. Postgres errors are classified by SQLSTATE
+// class; unknown errors are treated as retryable, as the old retry loop did.
+func classifyError(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return errClassCanceled
+	}
+	if errors.Is(err, errCircuitOpen) { // before errSinkFailed, which may wrap it
+		return errClassCircuit
+	}
+	if errors.Is(err, errInvalidPayload) || errors.Is(err, errSinkFailed) || errors.Is(err, errNoOverwrite) {
+		return errClassPermanent
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errClassRetryable // a write that ran out of time; a required sink's timeout is permanent above
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return errClassPermanent
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return classifySQLState(pgErr.Code)
+	}
+	// Network errors, connect failures and anything unrecognized.
+	return errClassRetryable
+}
+
+// classifySQLState maps a SQLSTATE to an error class. See
+// https://www.postgresql.org/docs/current/errcodes-appendix.html.
+func classifySQLState(code string) string {
+	switch code {
+	case "55P03": // lock_not_available
+		return errClassRetryable
+	}
+	if len(code) < 2 {
+		return errClassRetryable
+	}
+	switch code[:2] {
+	case "08", // connection exception
+		"40", // transaction rollback: serialization_failure, deadlock_detected
+		"53", // insufficient resources: disk full, out of memory, too many connections
+		"57", // operator intervention: admin/crash shutdown, cannot connect now, query_canceled (statement_timeout under load)
+		"58", // system error (I/O)
+		"XX": // internal error
+		return errClassRetryable
+	}
+	return errClassPermanent
+}
+
+// retryPolicy retries with exponential backoff and full jitter: before attempt n+1 it sleeps a
+// random duration in [0, min(maxDelay, baseDelay*2^n)). maxElapsed bounds the total time spent.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	maxElapsed  time.Duration  // 0 means no limit
+	jitter      func() float64 // returns [0,1); nil uses math/rand
+}
+
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.maxDelay
+	if attempt >= 0 && attempt < 32 { // avoid overflowing the shift
+		if d := p.baseDelay << attempt; d > 0 && (ceiling <= 0 || d < ceiling) {
+			ceiling = d
+		}
+	}
+	r := rand.Float64
+	if p.jitter != nil {
+		r = p.jitter
+	}
+	return time.Duration(r() * float64(ceiling))
+}
+
+// do calls op until it succeeds, fails permanently, attempts run out, or the next sleep would pass
+// maxElapsed. It returns the number of attempts made and the last error (ctx.Err() if canceled
+// while waiting). Each failure is counted in arkiv_ingest_errors_total by chain and class.
+func (p retryPolicy) do(ctx context.Context, chainID string, op func() error) (int, error) {
+	start := time.Now()
+	attempts := 0
+	for {
+		attempts++
+		err := op()
+		if err == nil {
+			return attempts, nil
+		}
+		class := classifyError(err)
+		ingestErrors.WithLabelValues(chainID, class).Inc()
+		if class != errClassRetryable || attempts >= p.maxAttempts {
+			return attempts, err
+		}
+		delay := p.backoff(attempts - 1)
+		if p.maxElapsed > 0 && time.Since(start)+delay > p.maxElapsed {
+			return attempts, err
+		}
+		ingestRetries.WithLabelValues(chainID).Inc()
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempts, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestClassifyError(t *testing.T) {
+	var syntaxErr error
+	if err := json.Unmarshal([]byte("{"), new(any)); err != nil {
+		syntaxErr = err
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"unique violation", &pgconn.PgError{Code: "23505"}, errClassPermanent},
+		{"invalid json input", &pgconn.PgError{Code: "22P02"}, errClassPermanent},
+		{"undefined table", &pgconn.PgError{Code: "42P01"}, errClassPermanent},
+		{"statement timeout", &pgconn.PgError{Code: "57014"}, errClassRetryable},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, errClassRetryable},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, errClassRetryable},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, errClassRetryable},
+		{"too many connections", &pgconn.PgError{Code: "53300"}, errClassRetryable},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, errClassRetryable},
+		{"lock not available", &pgconn.PgError{Code: "55P03"}, errClassRetryable},
+		{"wrapped pg error", fmt.Errorf("insert: %w", &pgconn.PgError{Code: "23502"}), errClassPermanent},
+		{"invalid payload", fmt.Errorf("%w: x", errInvalidPayload), errClassPermanent},
+		{"json syntax", syntaxErr, errClassPermanent},
+		{"canceled", context.Canceled, errClassCanceled},
+		{"deadline", fmt.Errorf("q: %w", context.DeadlineExceeded), errClassRetryable},
+		{"required sink timeout", fmt.Errorf("%w: %w", errSinkFailed, context.DeadlineExceeded), errClassPermanent},
+		{"unknown", errors.New("connection reset by peer"), errClassRetryable},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("%s: classifyError = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffFullJitter(t *testing.T) {
+	p := retryPolicy{baseDelay: 100 * time.Millisecond, maxDelay: time.Second, jitter: func() float64 { return 0.999999 }}
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		got := p.backoff(attempt)
+		want *= time.Millisecond
+		if got > want || got < want*99/100 {
+			t.Errorf("backoff(%d) = %v, want just under %v", attempt, got, want)
+		}
+	}
+	p.jitter = func() float64 { return 0 }
+	if got := p.backoff(3); got != 0 {
+		t.Errorf("backoff with zero jitter = %v, want 0", got)
+	}
+	if got := p.backoff(100); got > time.Second {
+		t.Errorf("backoff(100) = %v, want capped at maxDelay", got)
+	}
+}
+
+func TestRetryPolicyStopsOnPermanentError(t *testing.T) {
+	n := 0
+	attempts, err := testRetryPolicy.do(context.Background(), "1", func() error {
+		n++
+		return &pgconn.PgError{Code: "23505"}
+	})
+	if n != 1 || attempts != 1 || err == nil {
+		t.Errorf("calls/attempts/err = %d/%d/%v, want a single attempt", n, attempts, err)
+	}
+}
+
+func TestRetryPolicyMaxElapsed(t *testing.T) {
+	p := retryPolicy{maxAttempts: 100, baseDelay: 20 * time.Millisecond, maxDelay: 20 * time.Millisecond,
+		maxElapsed: 50 * time.Millisecond, jitter: func() float64 { return 0.999 }}
+	start := time.Now()
+	attempts, err := p.do(context.Background(), "1", func() error { return errMock })
+	if err != errMock {
+		t.Errorf("err = %v, want errMock", err)
+	}
+	if attempts > 4 || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("attempts = %d after %v, want stop before 50ms", attempts, time.Since(start))
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rpcCaller is what the fetchers need from a JSON-RPC client; rpcClient talks to one endpoint,
+// rpcPool spreads calls over several.
+type rpcCaller interface {
+	call(ctx context.Context, method string, params []any, out any) error
+}
+
+// rpcEndpointConfig is one entry of a chain's rpc_endpoints.
+type rpcEndpointConfig struct {
+	URL        string  `json:"url"`
+	Name       string  `json:"name"`         // endpoint label in metrics; default the URL's host
+	Weight     int     `json:"weight"`       // relative share of requests; default 1
+	RatePerSec float64 `json:"rate_per_sec"` // request budget; 0 means unlimited
+	Burst      int     `json:"burst"`        // default max(1, rate_per_sec)
+}
+
+func (c rpcEndpointConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if u, err := url.Parse(c.URL); err == nil && u.Host != "" {
+		return u.Host // not the full URL: provider keys often live in the path
+	}
+	return c.URL
+}
+
+// rpcEndpoint is one upstream of an rpcPool with its budget, health and latency.
+type rpcEndpoint struct {
+	name   string
+	client *rpcClient
+	weight int
+	budget *tokenBucket // nil means unlimited
+
+	mu        sync.Mutex
+	failures  int           // consecutive failed requests
+	downUntil time.Time     // skipped in favour of healthy endpoints until then
+	latency   time.Duration // moving average of successful requests
+}
+
+func (e *rpcEndpoint) until() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.downUntil
+}
+
+// score is the endpoint's pick weight: its configured weight divided by its average latency.
+func (e *rpcEndpoint) score() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return float64(e.weight) / max(e.latency, 10*time.Millisecond).Seconds()
+}
+
+// rpcPool is an rpcCaller over several endpoints. Each call goes to a healthy endpoint picked at
+// random by score, and fails over to the next one on a transport error, a non-200 response or a
+// spent request budget; JSON-RPC errors are the node's answer and are returned as they are. An
+// endpoint that fails is skipped for a cooldown that doubles with each consecutive failure. With
+// hedgeAfter set, a call still unanswered after that long is also sent to the next endpoint and
+// the first answer wins.
+type rpcPool struct {
+	endpoints   []*rpcEndpoint
+	hedgeAfter  time.Duration // 0 disables hedging
+	cooldown    time.Duration
+	maxCooldown time.Duration
+	budgetWait  time.Duration // longest wait for a budget when every endpoint's is spent
+	now         func() time.Time
+	mu          sync.Mutex
+	rnd         *rand.Rand
+}
+
+func newRPCPool(endpoints []rpcEndpointConfig, hedgeAfter time.Duration) *rpcPool {
+	p := &rpcPool{
+		hedgeAfter:  hedgeAfter,
+		cooldown:    time.Second,
+		maxCooldown: time.Minute,
+		budgetWait:  10 * time.Second,
+		now:         time.Now,
+		rnd:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, c := range endpoints {
+		e := &rpcEndpoint{name: c.name(), client: newRPCClient(c.URL), weight: max(c.Weight, 1)}
+		if c.RatePerSec > 0 {
+			burst := c.Burst
+			if burst == 0 {
+				burst = max(int(c.RatePerSec), 1)
+			}
+			e.budget = newTokenBucket(c.RatePerSec, burst)
+		}
+		rpcEndpointUp.WithLabelValues(e.name).Set(1)
+		p.endpoints = append(p.endpoints, e)
+	}
+	return p
+}
+
+// order returns the endpoints to try: healthy ones in weighted random order, then the ones
+// cooling down, soonest back first.
+func (p *rpcPool) order() []*rpcEndpoint {
+	now := p.now()
+	var healthy, down []*rpcEndpoint
+	until := make(map[*rpcEndpoint]time.Time, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if until[e] = e.until(); now.Before(until[e]) {
+			down = append(down, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+	p.mu.Lock()
+	keys := make(map[*rpcEndpoint]float64, len(healthy))
+	for _, e := range healthy {
+		keys[e] = p.rnd.ExpFloat64() / e.score() // weighted sampling without replacement
+	}
+	p.mu.Unlock()
+	sort.Slice(healthy, func(i, j int) bool { return keys[healthy[i]] < keys[healthy[j]] })
+	sort.Slice(down, func(i, j int) bool { return until[down[i]].Before(until[down[j]]) })
+	return append(healthy, down...)
+}
+
+// take removes and returns the first endpoint in candidates with budget left. If wait is set and
+// every budget is spent, it waits (up to budgetWait) for the first to refill. It returns nil when
+// candidates is empty or nothing frees up.
+func (p *rpcPool) take(ctx context.Context, candidates *[]*rpcEndpoint, method string, wait bool) *rpcEndpoint {
+	deadline := p.now().Add(p.budgetWait)
+	for len(*candidates) > 0 {
+		soonest := time.Duration(-1)
+		for i, e := range *candidates {
+			d := e.budget.take(p.now())
+			if d == 0 {
+				*candidates = append((*candidates)[:i:i], (*candidates)[i+1:]...)
+				return e
+			}
+			if soonest < 0 || d < soonest {
+				soonest = d
+			}
+		}
+		if !wait {
+			return nil
+		}
+		if p.now().Add(soonest).After(deadline) {
+			for _, e := range *candidates {
+				rpcRequestsTotal.WithLabelValues(e.name, method, "rate_limited").Inc()
+			}
+			return nil
+		}
+		t := time.NewTimer(soonest)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+type rpcResult struct {
+	raw json.RawMessage
+	err error
+}
+
+func (p *rpcPool) call(ctx context.Context, method string, params []any, out any) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops a losing hedged request
+	candidates := p.order()
+	results := make(chan rpcResult, len(candidates))
+	inflight := 0
+	send := func(wait bool) bool {
+		e := p.take(ctx, &candidates, method, wait)
+		if e == nil {
+			return false
+		}
+		inflight++
+		go func() {
+			var raw json.RawMessage
+			err := p.do(ctx, e, method, params, &raw)
+			results <- rpcResult{raw, err}
+		}()
+		return true
+	}
+
+	lastErr := errors.New(method + ": no rpc endpoint available")
+	if !send(true) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return lastErr
+	}
+	var hedge <-chan time.Time
+	if p.hedgeAfter > 0 {
+		t := time.NewTimer(p.hedgeAfter)
+		defer t.Stop()
+		hedge = t.C
+	}
+	for inflight > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-hedge:
+			hedge = nil
+			send(false)
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				if out == nil {
+					return nil
+				}
+				return json.Unmarshal(r.raw, out)
+			}
+			var rerr *rpcError
+			if errors.As(r.err, &rerr) {
+				return r.err
+			}
+			lastErr = r.err
+			if inflight == 0 {
+				send(true)
+			}
+		}
+	}
+	return lastErr
+}
+
+// do sends one request to e and records the outcome against it.
+func (p *rpcPool) do(ctx context.Context, e *rpcEndpoint, method string, params []any, out *json.RawMessage) error {
+	start := p.now()
+	err := e.client.call(ctx, method, params, out)
+	elapsed := p.now().Sub(start)
+	status := "ok"
+	var rerr *rpcError
+	var herr *httpStatusError
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		status = "canceled" // lost a hedge, or the caller gave up
+	case errors.As(err, &rerr):
+		status = "rpc_error"
+	case errors.As(err, &herr) && herr.code == http.StatusTooManyRequests:
+		status = "rate_limited"
+	default:
+		status = "error"
+	}
+	rpcRequestsTotal.WithLabelValues(e.name, method, status).Inc()
+	rpcRequestDuration.WithLabelValues(e.name, method).Observe(elapsed.Seconds())
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch status {
+	case "ok", "rpc_error":
+		e.failures = 0
+		if e.latency == 0 {
+			e.latency = elapsed
+		} else {
+			e.latency = (4*e.latency + elapsed) / 5
+		}
+		rpcEndpointUp.WithLabelValues(e.name).Set(1)
+	case "error", "rate_limited":
+		e.failures++
+		cooldown := p.maxCooldown
+		if e.failures <= 32 {
+			cooldown = min(p.cooldown<<(e.failures-1), p.maxCooldown)
+		}
+		e.downUntil = p.now().Add(cooldown)
+		rpcEndpointUp.WithLabelValues(e.name).Set(0)
+	}
+	return err
+}
+
+// tokenBucket is a request budget refilling at rate per second up to burst.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// take spends a token and returns 0, or returns how long until one is available. A nil bucket
+// is unlimited.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return max(time.Duration((1-b.tokens)/b.rate*float64(time.Second)), time.Millisecond)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rpcUpstream answers eth_blockNumber with head after delay, or fails with status.
+type rpcUpstream struct {
+	head   string
+	status int
+	delay  time.Duration
+	calls  atomic.Int32
+}
+
+func (u *rpcUpstream) serve(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.calls.Add(1)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(u.delay):
+		}
+		if u.status != 0 {
+			w.WriteHeader(u.status)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"` + u.head + `"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testPool builds a pool over upstreams in order. Weights make the first healthy endpoint the
+// pick (with a fixed seed), so tests are deterministic.
+func testPool(t *testing.T, hedgeAfter time.Duration, cfgs []rpcEndpointConfig, upstreams ...*rpcUpstream) *rpcPool {
+	for i, u := range upstreams {
+		cfgs[i].URL = u.serve(t).URL
+		cfgs[i].Name = string(rune('a' + i))
+		if cfgs[i].Weight == 0 {
+			cfgs[i].Weight = 1000 >> (5 * i)
+		}
+	}
+	p := newRPCPool(cfgs, hedgeAfter)
+	p.rnd = rand.New(rand.NewSource(1))
+	return p
+}
+
+func poolHead(t *testing.T, p *rpcPool) uint64 {
+	t.Helper()
+	h, err := newRPCFetcher("1", p).Head(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestRPCPoolFailsOver(t *testing.T) {
+	a := &rpcUpstream{status: http.StatusBadGateway}
+	b := &rpcUpstream{head: "0x2"}
+	p := testPool(t, 0, make([]rpcEndpointConfig, 2), a, b)
+
+	if h := poolHead(t, p); h != 2 {
+		t.Fatalf("head = %d", h)
+	}
+	if a.calls.Load() != 1 || b.calls.Load() != 1 {
+		t.Fatalf("calls a=%d b=%d", a.calls.Load(), b.calls.Load())
+	}
+	// a is cooling down: it is tried last, so b answers without a being asked.
+	poolHead(t, p)
+	if a.calls.Load() != 1 || b.calls.Load() != 2 {
+		t.Fatalf("after cooldown start: calls a=%d b=%d", a.calls.Load(), b.calls.Load())
+	}
+}
+
+func TestRPCPoolAllDown(t *testing.T) {
+	a := &rpcUpstream{status: http.StatusServiceUnavailable}
+	b := &rpcUpstream{status: http.StatusTooManyRequests}
+	p := testPool(t, 0, make([]rpcEndpointConfig, 2), a, b)
+	_, err := newRPCFetcher("1", p).Head(context.Background())
+	var herr *httpStatusError
+	if !errors.As(err, &herr) {
+		t.Fatalf("err = %v", err)
+	}
+	// Cooling down is a preference, not a ban: the next call still tries them.
+	newRPCFetcher("1", p).Head(context.Background())
+	if a.calls.Load() != 2 || b.calls.Load() != 2 {
+		t.Fatalf("calls a=%d b=%d", a.calls.Load(), b.calls.Load())
+	}
+}
+
+func TestRPCPoolReturnsRPCErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found"}}`))
+	}))
+	defer srv.Close()
+	b := &rpcUpstream{head: "0x2"}
+	p := newRPCPool([]rpcEndpointConfig{{URL: srv.URL, Name: "a", Weight: 1000}, {URL: b.serve(t).URL, Name: "b"}}, 0)
+	p.rnd = rand.New(rand.NewSource(1))
+	var rerr *rpcError
+	if _, err := newRPCFetcher("1", p).Head(context.Background()); !errors.As(err, &rerr) {
+		t.Fatalf("err = %v, want the node's rpc error", err)
+	}
+	if b.calls.Load() != 0 {
+		t.Fatal("rpc error failed over")
+	}
+}
+
+func TestRPCPoolHedges(t *testing.T) {
+	a := &rpcUpstream{head: "0x1", delay: time.Second}
+	b := &rpcUpstream{head: "0x2"}
+	p := testPool(t, 20*time.Millisecond, make([]rpcEndpointConfig, 2), a, b)
+	start := time.Now()
+	if h := poolHead(t, p); h != 2 {
+		t.Fatalf("head = %d, want the hedged answer", h)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("hedged call took %v", d)
+	}
+	if a.calls.Load() != 1 || b.calls.Load() != 1 {
+		t.Fatalf("calls a=%d b=%d", a.calls.Load(), b.calls.Load())
+	}
+}
+
+func TestRPCPoolRateLimits(t *testing.T) {
+	a := &rpcUpstream{head: "0x1"}
+	b := &rpcUpstream{head: "0x2"}
+	p := testPool(t, 0, []rpcEndpointConfig{{RatePerSec: 0.001, Burst: 2}, {}}, a, b)
+	for range 4 {
+		poolHead(t, p)
+	}
+	if a.calls.Load() != 2 || b.calls.Load() != 2 {
+		t.Fatalf("calls a=%d b=%d, want a's burst of 2 then b", a.calls.Load(), b.calls.Load())
+	}
+
+	// With every budget spent, calls wait for a refill, up to budgetWait.
+	p = testPool(t, 0, []rpcEndpointConfig{{RatePerSec: 50, Burst: 1}}, &rpcUpstream{head: "0x1"})
+	poolHead(t, p)
+	start := time.Now()
+	poolHead(t, p)
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Fatalf("second call not throttled (%v)", d)
+	}
+	p.budgetWait = 0
+	if _, err := newRPCFetcher("1", p).Head(context.Background()); err == nil {
+		t.Fatal("want error once the budget wait is exceeded")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 2)
+	now := time.Unix(0, 0)
+	if b.take(now) != 0 || b.take(now) != 0 {
+		t.Fatal("burst not available")
+	}
+	if d := b.take(now); d != 500*time.Millisecond {
+		t.Fatalf("wait = %v", d)
+	}
+	if d := b.take(now.Add(500 * time.Millisecond)); d != 0 {
+		t.Fatalf("not refilled: %v", d)
+	}
+	if d := b.take(now.Add(time.Hour)); d != 0 || b.tokens != 1 {
+		t.Fatalf("refill not capped at burst: tokens=%v", b.tokens)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// errWorkerStopped fails a re-ingest the worker was running when it stopped.
+var errWorkerStopped = errors.New("worker stopped during re-ingest")
+
+// scheduler walks a Fetcher from next up to head. While behind it drains the backlog as fast as
+// catchupRate allows; once caught up it waits for a head subscription or polls every pollInterval.
+// If the ingester is a BatchIngester, fetched records are flushed in batches of up to batchSize,
+// or after batchMaxWait, or as soon as head is reached.
+type scheduler struct {
+	chainID      string
+	fetcher      Fetcher
+	ingester     ArkivIngester
+	next         uint64
+	pollInterval time.Duration
+	catchupRate  float64 // blocks/sec while behind head; <= 0 means unthrottled
+	batchSize    int
+	batchMaxWait time.Duration
+	retry        retryPolicy
+	dlq          deadLetterStore         // receives records that exhaust retries; nil drops them
+	state        *chainState             // progress for /readyz and /healthz; may be nil
+	repairs      <-chan blockRange       // gaps to re-fetch behind the cursor (see gapScanner); may be nil
+	reingests    <-chan blockRange       // admin re-ingests, overwriting stored blocks; may be nil
+	overwrites   <-chan overwriteRequest // verifier repairs, run between blocks; may be nil
+	overwriter   overwriter              // used by reingests and overwrites; nil fails them
+	breaker      *circuitBreaker         // the store's; while open the worker holds off fetching. May be nil
+	log          *slog.Logger
+
+	pending      []IngestRecord
+	pendingSince time.Time
+	failures     int    // consecutive head/fetch failures, for backoff
+	holding      bool   // pending was handed back by an open circuit; flush it before fetching more
+	tip          uint64 // one past the highest block stored by this worker, for the freshness metrics
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	defer s.state.reingestAbort(errWorkerStopped) // also runs when a panic unwinds the worker
+	// The subscription ends with this run, not the chain: superviseChain may restart it.
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	defer unsubscribe()
+	heads := s.subscribeHeads(subCtx)
+
+	var throttle <-chan time.Time
+	if s.catchupRate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / s.catchupRate))
+		defer t.Stop()
+		throttle = t.C
+	}
+
+	defer func() {
+		// Best effort: don't drop records already fetched when shutting down.
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !s.flush(flushCtx) && len(s.pending) > 0 {
+			// Not dead-lettered: the restart re-fetches them after the checkpoint, or gap scans do.
+			s.log.Warn("shutdown flush cut short; records left unwritten", "first", s.pending[0].BlockNumber, "count", len(s.pending))
+		}
+	}()
+
+	var head uint64
+	stale := true // head must be re-read before deciding we are caught up
+	for ctx.Err() == nil {
+		s.state.beat()
+		select {
+		case r := <-s.repairs:
+			s.repair(ctx, r)
+		case r := <-s.reingests:
+			s.reingest(ctx, r)
+		case req := <-s.overwrites:
+			req.done <- s.overwriteRecord(ctx, req.record)
+		default:
+		}
+		if paused, changed := s.state.pauseState(); paused {
+			s.pause(ctx, changed)
+			stale = true
+			continue
+		}
+		if wait := s.breaker.retryIn(); wait > 0 {
+			s.sleep(ctx, min(wait, time.Second)) // short naps keep /healthz passing
+			stale = true
+			continue
+		}
+		if s.holding && !s.flush(ctx) {
+			continue
+		}
+		if stale {
+			h, err := s.fetcher.Head(ctx)
+			if err != nil {
+				s.log.Warn("head failed", "err", err)
+				s.state.failed(err)
+				s.failures++
+				ingestTotal.WithLabelValues(s.chainID, "error").Inc()
+				s.backoff(ctx)
+				continue
+			}
+			head, stale = h, false
+			s.failures = 0
+			s.observeHead(head)
+		}
+
+		if s.next > head {
+			if s.flush(ctx) {
+				s.state.progressed() // caught up: nothing left to do counts as progress
+			}
+			h, ok := s.wait(ctx, heads)
+			switch {
+			case !ok:
+				heads = nil // subscription ended; poll from now on
+				stale = true
+			case h > head:
+				head = h
+				s.observeHead(head)
+			default:
+				stale = true
+			}
+			continue
+		}
+
+		if !s.step(ctx) {
+			s.flush(ctx)
+			stale = true
+			if s.failures > 0 {
+				s.backoff(ctx)
+			} else {
+				s.wait(ctx, nil) // block not available yet
+			}
+			continue
+		}
+		if len(s.pending) >= s.batchSize || time.Since(s.pendingSince) >= s.batchMaxWait {
+			s.flush(ctx)
+		}
+		s.observeHead(head)
+
+		if s.next > head {
+			stale = true
+		} else if throttle != nil {
+			select {
+			case <-ctx.Done():
+			case <-throttle:
+			}
+		}
+	}
+}
+
+// step fetches block next and queues it for flush. It returns false if the block could not be
+// fetched, leaving next unchanged so it is retried.
+func (s *scheduler) step(ctx context.Context) bool {
+	start := time.Now()
+	record, err := s.fetcher.FetchBlock(ctx, s.next)
+	status := "ok"
+	switch {
+	case err != nil:
+		status = "error"
+	case record == nil:
+		status = "missing"
+	default:
+		payloadBytes.WithLabelValues(s.chainID).Observe(float64(len(record.Data)))
+	}
+	fetchDuration.WithLabelValues(s.chainID, status).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.log.Warn("fetch failed", "block", s.next, "err", err)
+		s.state.failed(err)
+		ingestTotal.WithLabelValues(s.chainID, "error").Inc()
+		s.failures++
+		return false
+	}
+	s.failures = 0
+	if record == nil {
+		return false
+	}
+	if len(s.pending) == 0 {
+		s.pendingSince = time.Now()
+	}
+	s.pending = append(s.pending, *record)
+	s.next++
+	return true
+}
+
+// flush ingests pending records. Records that still fail after retries are handed to the
+// dead-letter store; the cursor has already moved past them. A batch failing permanently is
+// retried record by record, so good records aren't dead-lettered with a bad one. Records refused by an open circuit
+// go back to pending instead (see hold), as do records whose write was canceled (see keep).
+// Reports whether all succeeded.
+func (s *scheduler) flush(ctx context.Context) bool {
+	s.holding = false
+	if len(s.pending) == 0 {
+		return true
+	}
+	records := s.pending
+	s.pending = nil
+	ingestBatchSize.WithLabelValues(s.chainID).Observe(float64(len(records)))
+
+	if batcher, ok := s.ingester.(BatchIngester); ok && len(records) > 1 {
+		start := time.Now()
+		attempts, err := ingestBatchWithRetry(ctx, s.retry, batcher, records)
+		if errors.Is(err, errCircuitOpen) {
+			s.hold(records, err)
+			return false
+		}
+		if err != nil && ctx.Err() != nil {
+			s.keep(records)
+			return false
+		}
+		if err == nil || classifyError(err) != errClassPermanent {
+			status := "ok"
+			if err != nil {
+				status = "error"
+				s.log.Warn("batch ingest failed", "first", records[0].BlockNumber, "count", len(records), "err", err)
+				s.state.failed(err)
+				deadLetterRecords(ctx, s.dlq, records, err, attempts, s.log)
+			} else {
+				s.stored(records)
+			}
+			ingestTotal.WithLabelValues(s.chainID, status).Add(float64(len(records)))
+			ingestDuration.WithLabelValues(s.chainID, status).Observe(time.Since(start).Seconds())
+			return err == nil
+		}
+		// One bad record fails the whole batch; write them one at a time so only it is dead-lettered.
+		s.log.Warn("batch rejected; writing records one at a time", "first", records[0].BlockNumber, "count", len(records), "err", err)
+	}
+
+	allOK := true
+	for i := range records {
+		s.state.beat()
+		start := time.Now()
+		attempts, err := ingestWithRetry(ctx, s.retry, s.ingester, &records[i])
+		if errors.Is(err, errCircuitOpen) {
+			s.hold(records[i:], err)
+			return false
+		}
+		if err != nil && ctx.Err() != nil {
+			s.keep(records[i:])
+			return false
+		}
+		status := "ok"
+		if err != nil {
+			status = "error"
+			s.log.Warn("ingest failed", "key", records[i].IdempotencyKey, "err", err)
+			s.state.failed(err)
+			allOK = false
+			deadLetterRecords(ctx, s.dlq, records[i:i+1], err, attempts, s.log)
+		} else {
+			s.stored(records[i : i+1])
+		}
+		ingestTotal.WithLabelValues(s.chainID, status).Inc()
+		ingestDuration.WithLabelValues(s.chainID, status).Observe(time.Since(start).Seconds())
+	}
+	return allOK
+}
+
+// stored marks progress and updates the per-chain freshness metrics after records were written.
+// Blocks at or below the tip (gap repairs) don't count towards freshness.
+func (s *scheduler) stored(records []IngestRecord) {
+	s.state.progressed()
+	now := time.Now()
+	lastSuccess.WithLabelValues(s.chainID).Set(float64(now.Unix()))
+	for _, r := range records {
+		if r.BlockNumber < s.tip {
+			continue
+		}
+		s.tip = r.BlockNumber + 1
+		lastIngestedBlock.WithLabelValues(s.chainID).Set(float64(r.BlockNumber))
+		if ts, ok := blockTimestamp(r.Data); ok {
+			lastIngestedBlockTime.WithLabelValues(s.chainID).Set(float64(ts.Unix()))
+			ingestFreshness.WithLabelValues(s.chainID).Observe(max(now.Sub(ts).Seconds(), 0))
+		}
+	}
+}
+
+// hold puts records refused by an open circuit back in front of pending, to be written once the
+// circuit lets calls through again. The cursor has moved past them, so dropping them would lose
+// blocks; they are not dead-lettered either, since nothing is wrong with them.
+func (s *scheduler) hold(records []IngestRecord, err error) {
+	if !s.holding {
+		s.log.Warn("store unavailable; holding records", "first", records[0].BlockNumber, "count", len(records), "err", err)
+	}
+	s.state.failed(err)
+	s.pending = append(records, s.pending...)
+	s.holding = true
+}
+
+// keep puts records whose write failed after ctx ended back in front of pending. ctx only ends
+// when the worker is stopping, so the shutdown flush gets them; they aren't dead-lettered, since
+// nothing need be wrong with them. Writes that time out on their own are retried and
+// dead-lettered like other failures.
+func (s *scheduler) keep(records []IngestRecord) {
+	s.pending = append(records, s.pending...)
+}
+
+// wait blocks until a new head arrives on heads, pollInterval elapses, the worker is paused or
+// ctx is done, running any repairs or re-ingests that arrive meanwhile. ok is false only when
+// heads was closed.
+func (s *scheduler) wait(ctx context.Context, heads <-chan uint64) (head uint64, ok bool) {
+	t := time.NewTimer(s.pollInterval)
+	defer t.Stop()
+	_, pauseChanged := s.state.pauseState()
+	select {
+	case <-ctx.Done():
+		return 0, true
+	case h, open := <-heads:
+		return h, open
+	case r := <-s.repairs:
+		s.repair(ctx, r)
+		return 0, true
+	case r := <-s.reingests:
+		s.reingest(ctx, r)
+		return 0, true
+	case req := <-s.overwrites:
+		req.done <- s.overwriteRecord(ctx, req.record)
+		return 0, true
+	case <-pauseChanged:
+		return 0, true
+	case <-t.C:
+		return 0, true
+	}
+}
+
+// pause flushes what is pending and idles until the worker is resumed, still running re-ingests
+// and overwrites so on-call can rewrite a range with live ingestion stopped.
+func (s *scheduler) pause(ctx context.Context, changed <-chan struct{}) {
+	s.flush(ctx)
+	s.log.Info("worker paused", "next", s.next)
+	beat := time.NewTicker(time.Second) // keep /healthz passing
+	defer beat.Stop()
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-changed:
+			var paused bool
+			if paused, changed = s.state.pauseState(); !paused {
+				s.log.Info("worker resumed", "next", s.next)
+				return
+			}
+		case r := <-s.reingests:
+			s.reingest(ctx, r)
+		case req := <-s.overwrites:
+			req.done <- s.overwriteRecord(ctx, req.record)
+		case <-beat.C:
+		}
+		s.state.beat()
+	}
+}
+
+// reingest re-fetches blocks in r and overwrites what is stored, for the admin API. It runs on
+// the worker, between blocks, so it never races the worker's own writes; the cursor stays put.
+func (s *scheduler) reingest(ctx context.Context, r blockRange) {
+	s.flush(ctx)
+	s.log.Info("re-ingesting", "from", r.from, "to", r.to)
+	if s.overwriter == nil {
+		s.state.reingestProgress(r.from, false, errNoOverwrite)
+		return
+	}
+	for n := r.from; n <= r.to; n++ {
+		s.state.reingestProgress(n, false, nil)
+		if err := s.overwrite(ctx, n); err != nil {
+			s.log.Warn("re-ingest failed", "block", n, "err", err)
+			s.state.reingestProgress(n, false, err)
+			return
+		}
+		s.state.beat()
+	}
+	s.log.Info("re-ingest done", "from", r.from, "to", r.to)
+	s.state.reingestProgress(r.to+1, true, nil)
+}
+
+func (s *scheduler) overwrite(ctx context.Context, n uint64) error {
+	record, err := s.fetcher.FetchBlock(ctx, n)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("block %d not available from the source", n)
+	}
+	return s.overwriteRecord(ctx, *record)
+}
+
+// overwriteRecord replaces a stored record through the worker's ingester chain, with retries.
+func (s *scheduler) overwriteRecord(ctx context.Context, r IngestRecord) error {
+	if s.overwriter == nil {
+		return errNoOverwrite
+	}
+	_, err := s.retry.do(ctx, s.chainID, func() error { return s.overwriter.Overwrite(ctx, r) })
+	return err
+}
+
+// repair re-fetches and ingests blocks in r without moving the cursor. It stops at the first
+// block that can't be fetched; the gap stays and is found again by the next scan.
+func (s *scheduler) repair(ctx context.Context, r blockRange) {
+	s.flush(ctx)
+	s.log.Info("repairing gap", "from", r.from, "to", r.to)
+	for n := r.from; n <= r.to && ctx.Err() == nil && !s.holding; n++ {
+		s.state.beat()
+		record, err := s.fetcher.FetchBlock(ctx, n)
+		if err != nil || record == nil {
+			s.log.Warn("gap repair fetch failed", "block", n, "err", err)
+			break
+		}
+		s.pending = append(s.pending, *record)
+		ingestGapRepairs.WithLabelValues(s.chainID).Inc()
+		if len(s.pending) >= s.batchSize {
+			s.flush(ctx)
+		}
+	}
+	s.flush(ctx)
+}
+
+// backoff sleeps after a head/fetch failure: jittered exponential from 1s, capped at
+// pollInterval (at least 1s) so a flapping source is not hammered.
+func (s *scheduler) backoff(ctx context.Context) {
+	p := retryPolicy{baseDelay: time.Second, maxDelay: max(s.pollInterval, time.Second)}
+	s.sleep(ctx, p.backoff(s.failures-1))
+}
+
+func (s *scheduler) sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+func (s *scheduler) subscribeHeads(ctx context.Context) <-chan uint64 {
+	hs, ok := s.fetcher.(headSubscriber)
+	if !ok {
+		return nil
+	}
+	heads, err := hs.SubscribeHeads(ctx)
+	if err != nil {
+		s.log.Warn("head subscription failed; polling", "err", err)
+		return nil
+	}
+	return heads
+}
+
+func (s *scheduler) observeHead(head uint64) {
+	s.state.position(head, s.next)
+	ingestHeadBlock.WithLabelValues(s.chainID).Set(float64(head))
+	lag := 0.0
+	if head >= s.next {
+		lag = float64(head - s.next + 1)
+	}
+	ingestLagBlocks.WithLabelValues(s.chainID).Set(lag)
+}
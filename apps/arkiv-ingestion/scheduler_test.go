@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeFetcher serves blocks up to a settable head.
+type fakeFetcher struct {
+	mu      sync.Mutex
+	head    uint64
+	fetched []uint64
+	heads   chan uint64
+}
+
+func (f *fakeFetcher) Head(ctx context.Context) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.head, nil
+}
+
+func (f *fakeFetcher) FetchBlock(ctx context.Context, n uint64) (*IngestRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetched = append(f.fetched, n)
+	return &IngestRecord{IdempotencyKey: "k", ChainID: "1", BlockNumber: n, Data: []byte("{}")}, nil
+}
+
+func (f *fakeFetcher) setHead(h uint64) {
+	f.mu.Lock()
+	f.head = h
+	f.mu.Unlock()
+}
+
+func (f *fakeFetcher) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.fetched)
+}
+
+type subscribingFetcher struct{ *fakeFetcher }
+
+func (f subscribingFetcher) SubscribeHeads(ctx context.Context) (<-chan uint64, error) {
+	return f.heads, nil
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSchedulerCatchesUpThenPolls(t *testing.T) {
+	f := &fakeFetcher{head: 99}
+	s := &scheduler{
+		fetcher:      f,
+		ingester:     &mockIngester{ingest: func() error { return nil }},
+		pollInterval: time.Hour, // must not be needed while behind
+		log:          discardLogger(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	waitFor(t, func() bool { return f.count() == 100 })
+	time.Sleep(20 * time.Millisecond)
+	if n := f.count(); n != 100 {
+		t.Errorf("fetched %d blocks, want 100 (should stop at head)", n)
+	}
+}
+
+func TestSchedulerCatchupRate(t *testing.T) {
+	f := &fakeFetcher{head: 1000}
+	s := &scheduler{
+		fetcher:      f,
+		ingester:     &mockIngester{ingest: func() error { return nil }},
+		pollInterval: time.Hour,
+		catchupRate:  100,
+		log:          discardLogger(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.run(ctx)
+	// ~20 blocks in 200ms at 100/s; allow generous slack for slow CI.
+	if n := f.count(); n < 5 || n > 40 {
+		t.Errorf("fetched %d blocks in 200ms at 100/s", n)
+	}
+}
+
+func TestSchedulerFollowsHeadSubscription(t *testing.T) {
+	f := &fakeFetcher{head: 4, heads: make(chan uint64, 1)}
+	s := &scheduler{
+		fetcher:      subscribingFetcher{f},
+		ingester:     &mockIngester{ingest: func() error { return nil }},
+		pollInterval: time.Hour,
+		log:          discardLogger(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	waitFor(t, func() bool { return f.count() == 5 })
+	f.setHead(7)
+	f.heads <- 7
+	waitFor(t, func() bool { return f.count() == 8 })
+}
+
+type fakeBatchIngester struct {
+	mu      sync.Mutex
+	batches [][]IngestRecord
+}
+
+func (f *fakeBatchIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	return f.IngestBatch(ctx, []IngestRecord{r})
+}
+
+func (f *fakeBatchIngester) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, append([]IngestRecord(nil), records...))
+	return nil
+}
+
+func (f *fakeBatchIngester) sizes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []int
+	for _, b := range f.batches {
+		out = append(out, len(b))
+	}
+	return out
+}
+
+func TestSchedulerBatchesWhileCatchingUp(t *testing.T) {
+	f := &fakeFetcher{head: 24}
+	ing := &fakeBatchIngester{}
+	s := &scheduler{
+		fetcher:      f,
+		ingester:     ing,
+		pollInterval: time.Hour,
+		batchSize:    10,
+		batchMaxWait: time.Hour,
+		log:          discardLogger(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	// 25 blocks: two full batches, then the remainder is flushed on reaching head.
+	waitFor(t, func() bool { return len(ing.sizes()) == 3 })
+	got := ing.sizes()
+	if got[0] != 10 || got[1] != 10 || got[2] != 5 {
+		t.Errorf("batch sizes = %v, want [10 10 5]", got)
+	}
+}
+
+func TestSchedulerFreshnessMetrics(t *testing.T) {
+	f := newSyntheticFetcher("fresh-1")
+	f.scenario = syntheticScenario{MeanTxs: 5}
+	f.startHead = 20
+	s := &scheduler{chainID: "fresh-1", fetcher: f, ingester: &fakeBatchIngester{}, batchSize: 5, log: discardLogger()}
+	for range 10 {
+		s.step(context.Background())
+	}
+	s.flush(context.Background())
+	if got := testutil.ToFloat64(lastIngestedBlock.WithLabelValues("fresh-1")); got != 9 {
+		t.Errorf("last ingested block = %v, want 9", got)
+	}
+	want := float64(f.timestamp(9))
+	if got := testutil.ToFloat64(lastIngestedBlockTime.WithLabelValues("fresh-1")); got != want {
+		t.Errorf("last block timestamp = %v, want %v", got, want)
+	}
+
+	// A gap repair below the tip must not move the tip back.
+	s.pending = []IngestRecord{{ChainID: "fresh-1", BlockNumber: 3, Data: []byte(`{"timestamp":"0x1"}`)}}
+	s.flush(context.Background())
+	if got := testutil.ToFloat64(lastIngestedBlock.WithLabelValues("fresh-1")); got != 9 {
+		t.Errorf("after a repair, last ingested block = %v, want 9", got)
+	}
+	if got := testutil.CollectAndCount(ingestFreshness); got == 0 {
+		t.Error("freshness histogram not observed")
+	}
+}
+
+// endingSubscriber reports when its subscription's ctx ends.
+type endingSubscriber struct {
+	*fakeFetcher
+	ended chan struct{}
+}
+
+func (f endingSubscriber) SubscribeHeads(ctx context.Context) (<-chan uint64, error) {
+	context.AfterFunc(ctx, func() { close(f.ended) })
+	return make(chan uint64), nil
+}
+
+func TestSchedulerEndsHeadSubscriptionWhenRunStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := endingSubscriber{&fakeFetcher{head: 5}, make(chan struct{})}
+	s := &scheduler{chainID: "1", fetcher: f, ingester: &mockIngester{ingest: func() error { panic("boom") }},
+		pollInterval: time.Hour, batchSize: 1, log: discardLogger()}
+	if err := runRecovered(ctx, func(ctx context.Context) error { s.run(ctx); return nil }); err == nil {
+		t.Fatal("run didn't panic")
+	}
+	select {
+	case <-f.ended:
+	case <-time.After(time.Second):
+		t.Fatal("head subscription outlived the run; a restart would leak it")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errSinkFailed wraps a required sink's error after the sink's own retries are exhausted. It
+// classifies as permanent so the caller doesn't retry every sink again on top.
+var errSinkFailed = errors.New("required sink failed")
+
+// sink is one destination of a teeIngester.
+type sink struct {
+	name     string
+	ingester ArkivIngester
+	required bool          // failure fails the record; best-effort failures are only logged and counted
+	retry    retryPolicy   // independent of other sinks
+	timeout  time.Duration // per write including retries; 0 = none
+}
+
+// teeIngester writes each record to all sinks concurrently. The write succeeds when every
+// required sink has succeeded; best-effort sinks can fail or time out without affecting it.
+// Sinks must be idempotent, since a record may be written again on replay.
+type teeIngester struct {
+	sinks []sink
+	log   *slog.Logger
+}
+
+func (t *teeIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	return t.fanOut(ctx, r.ChainID, 1, func(ctx context.Context, s sink) error {
+		return s.ingester.Ingest(ctx, r)
+	})
+}
+
+func (t *teeIngester) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return t.fanOut(ctx, records[0].ChainID, len(records), func(ctx context.Context, s sink) error {
+		if b, ok := s.ingester.(BatchIngester); ok {
+			return b.IngestBatch(ctx, records)
+		}
+		for _, r := range records {
+			if err := s.ingester.Ingest(ctx, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Overwrite overwrites r in every sink that supports it and writes it again to the others, so
+// archives append the new version.
+func (t *teeIngester) Overwrite(ctx context.Context, r IngestRecord) error {
+	return t.fanOut(ctx, r.ChainID, 1, func(ctx context.Context, s sink) error {
+		if o, ok := s.ingester.(overwriter); ok {
+			return o.Overwrite(ctx, r)
+		}
+		return s.ingester.Ingest(ctx, r)
+	})
+}
+
+func (t *teeIngester) fanOut(ctx context.Context, chainID string, n int, write func(context.Context, sink) error) error {
+	errs := make([]error, len(t.sinks))
+	var wg sync.WaitGroup
+	for i, s := range t.sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = t.writeSink(ctx, chainID, n, s, write)
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, s := range t.sinks {
+		if errs[i] == nil {
+			continue
+		}
+		if s.required {
+			failed = append(failed, fmt.Errorf("sink %s: %w", s.name, errs[i]))
+		} else {
+			t.log.Warn("best-effort sink failed", "sink", s.name, "chain_id", chainID, "err", errs[i])
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %w", errSinkFailed, errors.Join(failed...))
+	}
+	return nil
+}
+
+func (t *teeIngester) writeSink(ctx context.Context, chainID string, n int, s sink, write func(context.Context, sink) error) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	attempts, err := s.retry.do(ctx, chainID, func() error { return write(ctx, s) })
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	sinkWrites.WithLabelValues(s.name, status).Add(float64(n))
+	sinkWriteDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	if attempts > 1 {
+		sinkRetries.WithLabelValues(s.name).Add(float64(attempts - 1))
+	}
+	return err
+}
+
+// sinkConfig is one entry of INGEST_SINKS, a JSON array of extra sinks next to the primary store.
+type sinkConfig struct {
+	Name        string `json:"name"`         // metrics label; defaults to type
+	Type        string `json:"type"`         // "raw", "normalized" or "archive"
+	Required    bool   `json:"required"`     // default false: best-effort
+	MaxAttempts int    `json:"max_attempts"` // default INGEST_RETRY_MAX_ATTEMPTS
+	TimeoutMS   int    `json:"timeout_ms"`   // default 5000 for best-effort sinks, none for required
+
+	// archive only
+	Path            string `json:"path"`             // directory; required
+	Format          string `json:"format"`           // "ndjson" (default) or "parquet"
+	Gzip            bool   `json:"gzip"`             // gzip NDJSON files / GZIP Parquet pages
+	MaxFileMB       int    `json:"max_file_mb"`      // rotate at this size; default 128
+	MaxFileAgeSec   int    `json:"max_file_age_sec"` // rotate after this long; default 3600
+	PartitionBlocks uint64 `json:"partition_blocks"` // blocks per directory; default 100000
+}
+
+// loadSinks builds the sink list: the primary store (required, named after INGEST_MODE) followed
+// by INGEST_SINKS.
+func loadSinks(cfg config, primary ArkivIngester, pg *postgresIngester, log *slog.Logger) ([]sink, error) {
+	sinks := []sink{{name: cfg.mode, ingester: primary, required: true, retry: cfg.retry}}
+	if cfg.sinksJSON == "" {
+		return sinks, nil
+	}
+	var extra []sinkConfig
+	if err := json.Unmarshal([]byte(cfg.sinksJSON), &extra); err != nil {
+		return nil, fmt.Errorf("parse sinks: %w", err)
+	}
+	seen := map[string]bool{cfg.mode: true}
+	for i, c := range extra {
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		if seen[c.Name] {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("sinks[%d]: duplicate name %q", i, c.Name)
+		}
+		seen[c.Name] = true
+		s := sink{name: c.Name, required: c.Required, retry: cfg.retry}
+		switch c.Type {
+		case "raw":
+			s.ingester = pg
+		case "normalized":
+			s.ingester = &normalizedIngester{pool: pg.pool}
+		case "archive":
+			a, err := newArchiveFromConfig(c, log)
+			if err != nil {
+				closeSinks(sinks)
+				return nil, fmt.Errorf("sink %s: %w", c.Name, err)
+			}
+			s.ingester = a
+		default:
+			closeSinks(sinks)
+			return nil, fmt.Errorf("sink %s: unknown type %q", c.Name, c.Type)
+		}
+		if c.MaxAttempts > 0 {
+			s.retry.maxAttempts = c.MaxAttempts
+		}
+		switch {
+		case c.TimeoutMS > 0:
+			s.timeout = time.Duration(c.TimeoutMS) * time.Millisecond
+		case !c.Required:
+			s.timeout = 5 * time.Second
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+func newArchiveFromConfig(c sinkConfig, log *slog.Logger) (*archiveSink, error) {
+	if c.Path == "" {
+		return nil, errors.New("path required")
+	}
+	format := c.Format
+	if format == "" {
+		format = "ndjson"
+	}
+	maxBytes := int64(128) << 20
+	if c.MaxFileMB > 0 {
+		maxBytes = int64(c.MaxFileMB) << 20
+	}
+	maxAge := time.Hour
+	if c.MaxFileAgeSec > 0 {
+		maxAge = time.Duration(c.MaxFileAgeSec) * time.Second
+	}
+	partition := uint64(100000)
+	if c.PartitionBlocks > 0 {
+		partition = c.PartitionBlocks
+	}
+	return newArchiveSink(c.Path, format, c.Gzip, maxBytes, maxAge, partition, log)
+}
+
+// closeSinks releases sinks that hold resources, e.g. completes open archive files.
+func closeSinks(sinks []sink) error {
+	var errs []error
+	for _, s := range sinks {
+		if c, ok := s.ingester.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
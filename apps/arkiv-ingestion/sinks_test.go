@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingIngester never returns before ctx is done.
+type blockingIngester struct{}
+
+func (blockingIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestTeeIngesterRequiredVsBestEffort(t *testing.T) {
+	primary := &recordingIngester{}
+	archive := &recordingIngester{fail: map[string]bool{"1-1": true}}
+	tee := &teeIngester{log: discardLogger(), sinks: []sink{
+		{name: "t-primary", ingester: primary, required: true, retry: testRetryPolicy},
+		{name: "t-archive", ingester: archive, retry: testRetryPolicy},
+	}}
+	ctx := context.Background()
+	if err := tee.Ingest(ctx, IngestRecord{IdempotencyKey: "1-1", ChainID: "1"}); err != nil {
+		t.Fatalf("best-effort failure leaked: %v", err)
+	}
+	if len(primary.ingested) != 1 {
+		t.Fatalf("primary ingested %v", primary.ingested)
+	}
+	if got := testutil.ToFloat64(sinkWrites.WithLabelValues("t-archive", "error")); got != 1 {
+		t.Fatalf("archive errors = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(sinkRetries.WithLabelValues("t-archive")); got != 2 {
+		t.Fatalf("archive retries = %v, want 2 (own policy)", got)
+	}
+
+	primary.fail = map[string]bool{"1-2": true}
+	err := tee.Ingest(ctx, IngestRecord{IdempotencyKey: "1-2", ChainID: "1"})
+	if !errors.Is(err, errSinkFailed) || !strings.Contains(err.Error(), "t-primary") {
+		t.Fatalf("err = %v", err)
+	}
+	if classifyError(err) != errClassPermanent {
+		t.Fatal("exhausted sink error should not be retried again by the caller")
+	}
+	if len(archive.ingested) != 1 {
+		t.Fatalf("archive should still get the record: %v", archive.ingested)
+	}
+}
+
+func TestTeeIngesterBestEffortTimeout(t *testing.T) {
+	tee := &teeIngester{log: discardLogger(), sinks: []sink{
+		{name: "t-ok", ingester: &recordingIngester{}, required: true, retry: testRetryPolicy},
+		{name: "t-stuck", ingester: blockingIngester{}, retry: testRetryPolicy, timeout: 20 * time.Millisecond},
+	}}
+	start := time.Now()
+	if err := tee.Ingest(context.Background(), IngestRecord{IdempotencyKey: "1-1", ChainID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("stuck sink held the write for %v", d)
+	}
+}
+
+func TestTeeIngesterBatch(t *testing.T) {
+	batcher := &fakeBatchIngester{}
+	single := &recordingIngester{}
+	tee := &teeIngester{log: discardLogger(), sinks: []sink{
+		{name: "t-batch", ingester: batcher, required: true, retry: testRetryPolicy},
+		{name: "t-single", ingester: single, retry: testRetryPolicy},
+	}}
+	records := []IngestRecord{{IdempotencyKey: "1-1", ChainID: "1"}, {IdempotencyKey: "1-2", ChainID: "1"}}
+	if err := tee.IngestBatch(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	if len(batcher.batches) != 1 || len(single.ingested) != 2 {
+		t.Fatalf("batches %v, single %v", batcher.batches, single.ingested)
+	}
+}
+
+func TestTeeIngesterOverwrite(t *testing.T) {
+	store := &recordingOverwriter{}
+	archive := &recordingIngester{}
+	hub := newStreamHub(4)
+	sub := hub.subscribe("")
+	defer hub.unsubscribe(sub)
+	chain := &publishingIngester{hub: hub, ArkivIngester: &teeIngester{log: discardLogger(), sinks: []sink{
+		{name: "t-store", ingester: &overwritingIngester{store}, required: true, retry: testRetryPolicy},
+		{name: "t-archive", ingester: archive, retry: testRetryPolicy},
+	}}}
+	if err := overwriteRecord(context.Background(), chain, IngestRecord{IdempotencyKey: "1-7", ChainID: "1", BlockNumber: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.blocks) != 1 || len(archive.ingested) != 1 {
+		t.Errorf("store overwrote %v, archive got %v; want the block in both", store.blocks, archive.ingested)
+	}
+	if ev := <-sub.events; ev.BlockNumber != 7 {
+		t.Errorf("published block %d, want 7", ev.BlockNumber)
+	}
+
+	plain := &teeIngester{log: discardLogger(), sinks: []sink{{name: "t-plain", ingester: &breakerIngester{ArkivIngester: archive}, required: true, retry: testRetryPolicy}}}
+	if err := plain.Overwrite(context.Background(), IngestRecord{IdempotencyKey: "1-8", ChainID: "1"}); !errors.Is(err, errNoOverwrite) {
+		t.Errorf("overwrite through a store without Overwrite = %v, want errNoOverwrite", err)
+	}
+}
+
+// overwritingIngester is a store that supports overwrites.
+type overwritingIngester struct{ *recordingOverwriter }
+
+func (overwritingIngester) Ingest(ctx context.Context, r IngestRecord) error { return nil }
+
+func TestLoadSinks(t *testing.T) {
+	pg := &postgresIngester{}
+	cfg := config{mode: "raw", retry: testRetryPolicy}
+	sinks, err := loadSinks(cfg, pg, pg, discardLogger())
+	if err != nil || len(sinks) != 1 || !sinks[0].required || sinks[0].name != "raw" {
+		t.Fatalf("default: %+v, %v", sinks, err)
+	}
+
+	cfg.sinksJSON = `[{"type":"normalized","max_attempts":7},{"name":"mirror","type":"raw","required":true}]`
+	sinks, err = loadSinks(cfg, pg, pg, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks) != 3 {
+		t.Fatalf("got %d sinks", len(sinks))
+	}
+	if s := sinks[1]; s.name != "normalized" || s.required || s.retry.maxAttempts != 7 || s.timeout != 5*time.Second {
+		t.Fatalf("normalized sink: %+v", s)
+	}
+	if s := sinks[2]; s.name != "mirror" || !s.required || s.timeout != 0 {
+		t.Fatalf("mirror sink: %+v", s)
+	}
+
+	for _, bad := range []string{`{`, `[{"type":"kafka"}]`, `[{"type":"raw"}]`} {
+		cfg.sinksJSON = bad
+		if _, err := loadSinks(cfg, pg, pg, discardLogger()); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// chainState is a chain worker's progress, written by its scheduler and read by HTTP handlers.
+// A nil *chainState is valid and records nothing.
+type chainState struct {
+	chainID string
+
+	mu           sync.Mutex
+	started      time.Time
+	head         uint64
+	next         uint64
+	lastProgress time.Time // last successful ingest, or head check that found nothing to do
+	lastBeat     time.Time // last scheduler loop iteration; stale means the worker is wedged
+	lastError    string
+	role         string // "leader" or "standby" with leader election, else ""
+	paused       bool
+	pauseChanged chan struct{} // closed and replaced whenever paused flips
+	reingest     *reingestStatus
+}
+
+func newChainState(chainID string) *chainState {
+	now := time.Now()
+	return &chainState{chainID: chainID, started: now, lastBeat: now, pauseChanged: make(chan struct{})}
+}
+
+// reingestStatus tracks the latest admin re-ingest of a block range.
+type reingestStatus struct {
+	From     uint64    `json:"from"`
+	To       uint64    `json:"to"`
+	Next     uint64    `json:"next"`  // next block to overwrite
+	State    string    `json:"state"` // queued, running, done or failed
+	Error    string    `json:"error,omitempty"`
+	Queued   time.Time `json:"queued"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// chainSnapshot is a consistent copy of chainState.
+type chainSnapshot struct {
+	ChainID      string
+	Started      time.Time
+	Head         uint64
+	Next         uint64
+	LastProgress time.Time
+	LastBeat     time.Time
+	LastError    string
+	Role         string
+	Paused       bool
+	Reingest     *reingestStatus
+}
+
+// Lag is the number of blocks at or below head not yet ingested.
+func (c chainSnapshot) Lag() uint64 {
+	if c.Head < c.Next {
+		return 0
+	}
+	return c.Head - c.Next + 1
+}
+
+func (s *chainState) snapshot() chainSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return chainSnapshot{
+		ChainID: s.chainID, Started: s.started, Head: s.head, Next: s.next,
+		LastProgress: s.lastProgress, LastBeat: s.lastBeat, LastError: s.lastError, Role: s.role,
+		Paused: s.paused, Reingest: s.reingestCopy(),
+	}
+}
+
+func (s *chainState) reingestCopy() *reingestStatus {
+	if s.reingest == nil {
+		return nil
+	}
+	r := *s.reingest
+	return &r
+}
+
+func (s *chainState) beat() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.lastBeat = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *chainState) position(head, next uint64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.head, s.next = head, next
+	s.mu.Unlock()
+}
+
+func (s *chainState) progressed() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.lastProgress = time.Now()
+	s.lastError = ""
+	s.mu.Unlock()
+}
+
+func (s *chainState) failed(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.lastError = err.Error()
+	s.mu.Unlock()
+}
+
+// setRole records a leader election outcome. Taking over restarts the progress grace period.
+func (s *chainState) setRole(leader bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !leader {
+		s.role = "standby"
+		return
+	}
+	if s.role != "leader" {
+		s.started, s.lastProgress = time.Now(), time.Time{}
+	}
+	s.role = "leader"
+}
+
+// setPaused pauses or resumes the chain's worker and reports whether that changed anything.
+// Pausing restarts the progress grace period on resume, so /readyz doesn't fail straight away.
+func (s *chainState) setPaused(paused bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused == paused {
+		return false
+	}
+	s.paused = paused
+	if !paused {
+		s.started, s.lastProgress = time.Now(), time.Time{}
+	}
+	close(s.pauseChanged)
+	s.pauseChanged = make(chan struct{})
+	v := 0.0
+	if paused {
+		v = 1
+	}
+	ingestPaused.WithLabelValues(s.chainID).Set(v)
+	return true
+}
+
+// pauseState returns whether the worker is paused and a channel closed on the next change.
+func (s *chainState) pauseState() (paused bool, changed <-chan struct{}) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused, s.pauseChanged
+}
+
+// queueReingest records r as queued unless another re-ingest is still queued or running.
+func (s *chainState) queueReingest(r blockRange) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reingest != nil && (s.reingest.State == "queued" || s.reingest.State == "running") {
+		return false
+	}
+	s.reingest = &reingestStatus{From: r.from, To: r.to, Next: r.from, State: "queued", Queued: time.Now()}
+	return true
+}
+
+// reingestProgress updates the running re-ingest: next is the next block to overwrite, and a
+// non-nil err or done ends it.
+func (s *chainState) reingestProgress(next uint64, done bool, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reingest == nil {
+		return
+	}
+	s.reingest.Next, s.reingest.State = next, "running"
+	switch {
+	case err != nil:
+		s.reingest.State, s.reingest.Error, s.reingest.Finished = "failed", err.Error(), time.Now()
+	case done:
+		s.reingest.State, s.reingest.Finished = "done", time.Now()
+	}
+}
+
+// reingestAbort fails a running re-ingest with err, for a worker that stops or panics part way
+// through; left running, it would refuse every later re-ingest. A queued one is kept: its range
+// is still in the channel for the next worker.
+func (s *chainState) reingestAbort(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reingest != nil && s.reingest.State == "running" {
+		s.reingest.State, s.reingest.Error, s.reingest.Finished = "failed", err.Error(), time.Now()
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamEvent is the data of one SSE "block" event. Its SSE id is "<chain_id>:<block_number>".
+type streamEvent struct {
+	ChainID        string          `json:"chain_id"`
+	BlockNumber    uint64          `json:"block_number"`
+	IdempotencyKey string          `json:"idempotency_key"`
+	Data           json.RawMessage `json:"data"`
+}
+
+func (e streamEvent) id() string { return e.ChainID + ":" + strconv.FormatUint(e.BlockNumber, 10) }
+
+// streamHub fans newly ingested records out to SSE subscribers. Each subscriber has a bounded
+// buffer; a subscriber that falls behind is disconnected (not silently skipped) so it can
+// reconnect with Last-Event-ID and catch up from the database.
+type streamHub struct {
+	bufferSize int
+
+	mu     sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+type subscriber struct {
+	chainID string // "" = all chains
+	events  chan streamEvent
+	done    chan struct{} // closed when the hub drops the subscriber
+}
+
+func newStreamHub(bufferSize int) *streamHub {
+	return &streamHub{bufferSize: bufferSize, subs: map[*subscriber]struct{}{}}
+}
+
+// subscribe returns nil if the hub is closed.
+func (h *streamHub) subscribe(chainID string) *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	s := &subscriber{chainID: chainID, events: make(chan streamEvent, h.bufferSize), done: make(chan struct{})}
+	h.subs[s] = struct{}{}
+	streamSubscribers.Set(float64(len(h.subs)))
+	return s
+}
+
+func (h *streamHub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dropLocked(s)
+}
+
+func (h *streamHub) dropLocked(s *subscriber) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	close(s.done)
+	streamSubscribers.Set(float64(len(h.subs)))
+}
+
+// publish never blocks the ingest path.
+func (h *streamHub) publish(r IngestRecord) {
+	ev := streamEvent{ChainID: r.ChainID, BlockNumber: r.BlockNumber, IdempotencyKey: r.IdempotencyKey, Data: json.RawMessage(r.Data)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if s.chainID != "" && s.chainID != r.ChainID {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+			streamDroppedEvents.Inc()
+			h.dropLocked(s)
+		}
+	}
+}
+
+// close disconnects all subscribers; used on shutdown so long-lived streams don't hold it up.
+func (h *streamHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.dropLocked(s)
+	}
+}
+
+// insertedKeys collects the idempotency keys that one write actually inserted, as reported by the
+// stores that know (see reportInserted); records they skipped as duplicates are not in it.
+type insertedKeys struct {
+	mu       sync.Mutex
+	reported bool // some store reported; if none did, every record counts as inserted
+	keys     map[string]bool
+}
+
+type insertedKeysKey struct{}
+
+// withInsertedKeys returns a ctx under which stores report the keys they insert into the result.
+func withInsertedKeys(ctx context.Context) (context.Context, *insertedKeys) {
+	k := &insertedKeys{keys: map[string]bool{}}
+	return context.WithValue(ctx, insertedKeysKey{}, k), k
+}
+
+// reportInserted records the keys a store committed under ctx, if a caller is collecting them.
+// Stores call it even with no keys, to say that the others were duplicates.
+func reportInserted(ctx context.Context, keys ...string) {
+	k, ok := ctx.Value(insertedKeysKey{}).(*insertedKeys)
+	if !ok {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reported = true
+	for _, key := range keys {
+		k.keys[key] = true
+	}
+}
+
+func (k *insertedKeys) has(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return !k.reported || k.keys[key]
+}
+
+// publishingIngester publishes records to hub after the wrapped ingester stores them, skipping
+// those the store reports as duplicates, so replays and retries don't repeat events.
+type publishingIngester struct {
+	ArkivIngester
+	hub *streamHub
+}
+
+func (p *publishingIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	ctx, inserted := withInsertedKeys(ctx)
+	if err := p.ArkivIngester.Ingest(ctx, r); err != nil {
+		return err
+	}
+	p.publish(inserted, r)
+	return nil
+}
+
+func (p *publishingIngester) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	ctx, inserted := withInsertedKeys(ctx)
+	if b, ok := p.ArkivIngester.(BatchIngester); ok {
+		if err := b.IngestBatch(ctx, records); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range records {
+			if err := p.ArkivIngester.Ingest(ctx, r); err != nil {
+				return err
+			}
+		}
+	}
+	p.publish(inserted, records...)
+	return nil
+}
+
+func (p *publishingIngester) publish(inserted *insertedKeys, records ...IngestRecord) {
+	for _, r := range records {
+		if inserted.has(r.IdempotencyKey) {
+			p.hub.publish(r)
+		}
+	}
+}
+
+func (p *publishingIngester) Overwrite(ctx context.Context, r IngestRecord) error {
+	if err := overwriteRecord(ctx, p.ArkivIngester, r); err != nil {
+		return err
+	}
+	p.hub.publish(r)
+	return nil
+}
+
+// streamHandler serves GET /v1/stream[?chain=<id>] as server-sent events. With a Last-Event-ID
+// header ("<chain>:<block>") it first replays that chain's later blocks from the database; that
+// needs the chain filter, since the id says nothing about other chains.
+type streamHandler struct {
+	hub       *streamHub
+	store     recordReader
+	keepalive time.Duration
+	log       *slog.Logger
+}
+
+const streamReplayPage = 500
+
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	chainFilter := r.URL.Query().Get("chain")
+	var resumeChain string
+	var resumeAfter uint64
+	resuming := false
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		i := strings.LastIndexByte(id, ':')
+		n, err := strconv.ParseUint(id[i+1:], 10, 63)
+		if i <= 0 || err != nil {
+			writeError(w, http.StatusBadRequest, "Last-Event-ID must be <chain>:<block>")
+			return
+		}
+		resumeChain, resumeAfter, resuming = id[:i], n, true
+		// An id holds one chain's position; resuming an all-chains stream would skip the others'.
+		if chainFilter == "" {
+			writeError(w, http.StatusBadRequest, "resuming with Last-Event-ID needs ?chain=<id>")
+			return
+		}
+		if chainFilter != resumeChain {
+			writeError(w, http.StatusBadRequest, "Last-Event-ID is for a different chain")
+			return
+		}
+	}
+
+	// Subscribe before replaying so nothing ingested during the replay is missed.
+	sub := h.hub.subscribe(chainFilter)
+	if sub == nil {
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	defer h.hub.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable proxy buffering (nginx)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	var replayedTo uint64 // live events at or below this for resumeChain were already sent
+	if resuming {
+		next := resumeAfter + 1
+		for {
+			recs, err := h.store.ListBlocks(r.Context(), resumeChain, next, ^uint64(0)>>1, streamReplayPage)
+			if err != nil {
+				h.log.Warn("stream replay failed", "chain_id", resumeChain, "err", err)
+				return
+			}
+			for _, rec := range recs {
+				ev := streamEvent{ChainID: rec.ChainID, BlockNumber: rec.BlockNumber, IdempotencyKey: rec.IdempotencyKey, Data: rec.Data}
+				if writeEvent(w, ev) != nil {
+					return
+				}
+				replayedTo = rec.BlockNumber
+			}
+			if rc.Flush() != nil {
+				return
+			}
+			if len(recs) < streamReplayPage {
+				break
+			}
+			next = recs[len(recs)-1].BlockNumber + 1
+		}
+	}
+
+	ticker := time.NewTicker(h.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.done:
+			return // too slow or shutting down; client resumes with Last-Event-ID
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case ev := <-sub.events:
+			if resuming && ev.ChainID == resumeChain && ev.BlockNumber <= replayedTo {
+				continue
+			}
+			if writeEvent(w, ev) != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev streamEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: block\ndata: %s\n\n", ev.id(), data)
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// openStream connects to /v1/stream and returns a channel of event ids.
+func openStream(t *testing.T, srv *httptest.Server, query, lastEventID string) <-chan string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/stream"+query, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content-type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	ids := make(chan string, 100)
+	go func() {
+		defer close(ids)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if id, ok := strings.CutPrefix(sc.Text(), "id: "); ok {
+				ids <- id
+			}
+		}
+	}()
+	return ids
+}
+
+func nextID(t *testing.T, ids <-chan string) string {
+	t.Helper()
+	select {
+	case id := <-ids:
+		return id
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return ""
+	}
+}
+
+// streamServer serves /v1/stream until the test ends. Cleanups run in reverse, so open stream
+// bodies are closed before the server waits for its handlers.
+func streamServer(t *testing.T, hub *streamHub, store recordReader) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /v1/stream", &streamHandler{hub: hub, store: store, keepalive: time.Minute, log: discardLogger()})
+	srv := httptest.NewServer(instrument(mux))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func waitSubscribers(t *testing.T, hub *streamHub, n int) {
+	t.Helper()
+	waitFor(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.subs) == n
+	})
+}
+
+func TestStreamPublishesAfterIngest(t *testing.T) {
+	hub := newStreamHub(8)
+	srv := streamServer(t, hub, &memReader{})
+	ids := openStream(t, srv, "?chain=1", "")
+	waitSubscribers(t, hub, 1)
+
+	ing := &publishingIngester{ArkivIngester: &mockIngester{ingest: func() error { return nil }}, hub: hub}
+	ctx := context.Background()
+	_ = ing.Ingest(ctx, IngestRecord{IdempotencyKey: "2-1", ChainID: "2", BlockNumber: 1, Data: []byte(`{}`)}) // filtered out
+	_ = ing.IngestBatch(ctx, []IngestRecord{
+		{IdempotencyKey: "1-7", ChainID: "1", BlockNumber: 7, Data: []byte(`{}`)},
+		{IdempotencyKey: "1-8", ChainID: "1", BlockNumber: 8, Data: []byte(`{}`)},
+	})
+	for _, want := range []string{"1:7", "1:8"} {
+		if got := nextID(t, ids); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+
+	failing := &publishingIngester{ArkivIngester: &mockIngester{ingest: func() error { return errMock }}, hub: hub}
+	if err := failing.Ingest(ctx, IngestRecord{ChainID: "1", BlockNumber: 9}); err == nil {
+		t.Fatal("expected error")
+	}
+	_ = ing.Ingest(ctx, IngestRecord{ChainID: "1", BlockNumber: 10, Data: []byte(`{}`)})
+	if got := nextID(t, ids); got != "1:10" {
+		t.Fatalf("failed ingest was published: got %s", got)
+	}
+}
+
+func TestStreamSkipsDuplicates(t *testing.T) {
+	hub := newStreamHub(8)
+	sub := hub.subscribe("")
+	defer hub.unsubscribe(sub)
+	store := &dedupingIngester{seen: map[string]bool{"1-1": true}}
+	ing := &publishingIngester{ArkivIngester: store, hub: hub}
+	ctx := context.Background()
+	_ = ing.IngestBatch(ctx, []IngestRecord{{IdempotencyKey: "1-1", ChainID: "1", BlockNumber: 1}, {IdempotencyKey: "1-2", ChainID: "1", BlockNumber: 2}})
+	_ = ing.Ingest(ctx, IngestRecord{IdempotencyKey: "1-2", ChainID: "1", BlockNumber: 2}) // replayed
+	_ = ing.Ingest(ctx, IngestRecord{IdempotencyKey: "1-3", ChainID: "1", BlockNumber: 3})
+	for _, want := range []uint64{2, 3} {
+		if ev := <-sub.events; ev.BlockNumber != want {
+			t.Fatalf("published block %d, want %d", ev.BlockNumber, want)
+		}
+	}
+	if len(sub.events) != 0 {
+		t.Fatalf("%d more events, want none", len(sub.events))
+	}
+}
+
+// dedupingIngester stores each key once and reports what it inserted, like postgresIngester.
+type dedupingIngester struct{ seen map[string]bool }
+
+func (d *dedupingIngester) Ingest(ctx context.Context, r IngestRecord) error {
+	return d.IngestBatch(ctx, []IngestRecord{r})
+}
+
+func (d *dedupingIngester) IngestBatch(ctx context.Context, records []IngestRecord) error {
+	var inserted []string
+	for _, r := range records {
+		if !d.seen[r.IdempotencyKey] {
+			d.seen[r.IdempotencyKey] = true
+			inserted = append(inserted, r.IdempotencyKey)
+		}
+	}
+	reportInserted(ctx, inserted...)
+	return nil
+}
+
+func TestStreamResumesFromLastEventID(t *testing.T) {
+	hub := newStreamHub(8)
+	srv := streamServer(t, hub, &memReader{n: 5})
+	ids := openStream(t, srv, "?chain=1", "1:2")
+	for _, want := range []string{"1:3", "1:4"} {
+		if got := nextID(t, ids); got != want {
+			t.Fatalf("replay: got %s, want %s", got, want)
+		}
+	}
+	waitSubscribers(t, hub, 1)
+	hub.publish(IngestRecord{ChainID: "1", BlockNumber: 4, Data: []byte(`{}`)}) // already replayed
+	hub.publish(IngestRecord{ChainID: "1", BlockNumber: 5, Data: []byte(`{}`)})
+	if got := nextID(t, ids); got != "1:5" {
+		t.Fatalf("live: got %s, want 1:5", got)
+	}
+}
+
+func TestStreamRejectsBadLastEventID(t *testing.T) {
+	h := &streamHandler{hub: newStreamHub(1), store: &memReader{}, keepalive: time.Minute, log: discardLogger()}
+	for _, tc := range []struct{ query, id string }{{"?chain=1", "nope"}, {"?chain=1", ":5"}, {"?chain=2", "1:5"}, {"", "1:5"}} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/stream"+tc.query, nil)
+		req.Header.Set("Last-Event-ID", tc.id)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q %q: status %d, want 400", tc.query, tc.id, rec.Code)
+		}
+	}
+}
+
+func TestStreamHubDropsSlowSubscriber(t *testing.T) {
+	hub := newStreamHub(1)
+	slow := hub.subscribe("")
+	before := testutil.ToFloat64(streamDroppedEvents)
+
+	hub.publish(IngestRecord{ChainID: "1", BlockNumber: 1})
+	hub.publish(IngestRecord{ChainID: "1", BlockNumber: 2}) // buffer full
+	select {
+	case <-slow.done:
+	default:
+		t.Fatal("slow subscriber not dropped")
+	}
+	if got := testutil.ToFloat64(streamDroppedEvents) - before; got != 1 {
+		t.Fatalf("dropped = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(streamSubscribers); got != 0 {
+		t.Fatalf("subscribers = %v, want 0", got)
+	}
+	hub.unsubscribe(slow) // idempotent
+
+	hub.close()
+	if hub.subscribe("") != nil {
+		t.Fatal("subscribe after close")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Mismatch kinds, also the kind label on arkiv_verify_mismatches_total.
+const (
+	mismatchHash          = "hash"           // stored block hash differs from the source's
+	mismatchContent       = "content"        // same hash, different canonical JSON (full compare only)
+	mismatchSourceMissing = "source_missing" // the source has no such block
+	mismatchUnverified    = "unverified"     // the source could not be fetched or a payload not decoded
+)
+
+// overwriter replaces a stored record's payload; used to repair mismatches. The ingester wrappers
+// (breaker, tee, publisher, faults) implement it by passing the overwrite down their chain.
+type overwriter interface {
+	Overwrite(ctx context.Context, r IngestRecord) error
+}
+
+// errNoOverwrite is returned by overwrites reaching a store that can't do them (normalized mode).
+var errNoOverwrite = errors.New("store does not support overwriting")
+
+// overwriteRecord overwrites r in ingester, or fails with errNoOverwrite if it can't.
+func overwriteRecord(ctx context.Context, ingester ArkivIngester, r IngestRecord) error {
+	if o, ok := ingester.(overwriter); ok {
+		return o.Overwrite(ctx, r)
+	}
+	return errNoOverwrite
+}
+
+// overwriteRequest asks a chain's worker to overwrite record; the outcome is sent on done, which
+// needs a buffer of 1.
+type overwriteRequest struct {
+	record IngestRecord
+	done   chan<- error
+}
+
+// queuedOverwriter hands overwrites to a chain's worker, which runs them between its own writes
+// (so they don't race them) through its full ingester chain, and waits for the outcome.
+type queuedOverwriter chan<- overwriteRequest
+
+func (q queuedOverwriter) Overwrite(ctx context.Context, r IngestRecord) error {
+	done := make(chan error, 1)
+	select {
+	case q <- overwriteRequest{record: r, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// verifier re-fetches stored blocks through the chain's fetcher and compares them with what is
+// stored: block hashes by default, or the whole canonical JSON with full. Mismatched rows are
+// overwritten with the source's version when repair is set.
+type verifier struct {
+	chainID string
+	fetcher Fetcher
+	store   recordReader
+	repair  overwriter // nil = report only
+	full    bool
+	log     *slog.Logger
+}
+
+type verifyReport struct {
+	ChainID    string           `json:"chain_id"`
+	Checked    int              `json:"checked"`
+	Repaired   int              `json:"repaired"`
+	Mismatches []verifyMismatch `json:"mismatches"`
+	Started    time.Time        `json:"started"`
+	Finished   time.Time        `json:"finished"`
+}
+
+type verifyMismatch struct {
+	Block    uint64 `json:"block"`
+	Kind     string `json:"kind"`
+	Stored   string `json:"stored,omitempty"` // block hash, or sha256 of canonical JSON for content
+	Source   string `json:"source,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (v *verifier) newReport() verifyReport {
+	return verifyReport{ChainID: v.chainID, Mismatches: []verifyMismatch{}, Started: time.Now().UTC()}
+}
+
+// verifyRange checks every stored block in [from, to].
+func (v *verifier) verifyRange(ctx context.Context, from, to uint64) (verifyReport, error) {
+	rep := v.newReport()
+	const page = 500
+	for from <= to {
+		recs, err := v.store.ListBlocks(ctx, v.chainID, from, to, page)
+		if err != nil {
+			return rep, err
+		}
+		for _, rec := range recs {
+			if err := v.check(ctx, rec, &rep); err != nil {
+				return rep, err
+			}
+		}
+		if len(recs) < page {
+			break
+		}
+		from = recs[len(recs)-1].BlockNumber + 1
+	}
+	rep.Finished = time.Now().UTC()
+	return rep, nil
+}
+
+// verifySample checks up to n random stored blocks in [from, head].
+func (v *verifier) verifySample(ctx context.Context, from uint64, n int, rnd *rand.Rand) (verifyReport, error) {
+	rep := v.newReport()
+	head, ok, err := v.store.Head(ctx, v.chainID)
+	if err != nil || !ok || head < from {
+		rep.Finished = time.Now().UTC()
+		return rep, err
+	}
+	span := head - from + 1
+	for i := 0; i < n; i++ {
+		b := from + uint64(rnd.Int63n(int64(min(span, 1<<62))))
+		rec, err := v.store.GetBlock(ctx, v.chainID, b)
+		if err != nil {
+			return rep, err
+		}
+		if rec == nil {
+			continue // a gap; the gap scanner's business
+		}
+		if err := v.check(ctx, *rec, &rep); err != nil {
+			return rep, err
+		}
+	}
+	rep.Finished = time.Now().UTC()
+	return rep, nil
+}
+
+// check compares one stored record with the source. Only ctx errors are returned; everything
+// else is recorded in rep.
+func (v *verifier) check(ctx context.Context, rec storedRecord, rep *verifyReport) error {
+	rep.Checked++
+	verifyChecked.WithLabelValues(v.chainID).Inc()
+	m := verifyMismatch{Block: rec.BlockNumber}
+	src, err := v.fetcher.FetchBlock(ctx, rec.BlockNumber)
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		m.Kind, m.Error = mismatchUnverified, err.Error()
+	case src == nil:
+		m.Kind = mismatchSourceMissing
+	default:
+		m.Kind, m.Stored, m.Source, err = v.compare(rec.Data, src.Data)
+		if err != nil {
+			m.Kind, m.Error = mismatchUnverified, err.Error()
+		}
+	}
+	if m.Kind == "" {
+		return nil
+	}
+	verifyMismatches.WithLabelValues(v.chainID, m.Kind).Inc()
+	if v.repair != nil && (m.Kind == mismatchHash || m.Kind == mismatchContent) {
+		if err := v.repair.Overwrite(ctx, *src); err != nil {
+			m.Error = "repair: " + err.Error()
+		} else {
+			m.Repaired = true
+			rep.Repaired++
+			verifyRepaired.WithLabelValues(v.chainID).Inc()
+		}
+	}
+	v.log.Warn("verify mismatch", "block", m.Block, "kind", m.Kind, "repaired", m.Repaired, "err", m.Error)
+	rep.Mismatches = append(rep.Mismatches, m)
+	return nil
+}
+
+// compare returns the mismatch kind ("" if equal) and what was compared on each side.
+func (v *verifier) compare(stored, source []byte) (kind, storedSum, sourceSum string, err error) {
+	sb, err := decodeBlock(stored)
+	if err != nil {
+		return "", "", "", fmt.Errorf("stored: %w", err)
+	}
+	fb, err := decodeBlock(source)
+	if err != nil {
+		return "", "", "", fmt.Errorf("source: %w", err)
+	}
+	if !strings.EqualFold(sb.Hash, fb.Hash) {
+		return mismatchHash, sb.Hash, fb.Hash, nil
+	}
+	if !v.full {
+		return "", "", "", nil
+	}
+	sc, err := canonicalJSON(stored)
+	if err != nil {
+		return "", "", "", fmt.Errorf("stored: %w", err)
+	}
+	fc, err := canonicalJSON(source)
+	if err != nil {
+		return "", "", "", fmt.Errorf("source: %w", err)
+	}
+	if bytes.Equal(sc, fc) {
+		return "", "", "", nil
+	}
+	ss, fs := sha256.Sum256(sc), sha256.Sum256(fc)
+	return mismatchContent, hex.EncodeToString(ss[:]), hex.EncodeToString(fs[:]), nil
+}
+
+// canonicalJSON re-encodes b with sorted object keys and no insignificant whitespace, keeping
+// numbers as written, so payloads compare equal however they were stored (JSONB reorders keys).
+func canonicalJSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// run verifies a sample of the chain every interval until ctx is done.
+func (v *verifier) run(ctx context.Context, from uint64, sample int, interval time.Duration) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		rep, err := v.verifySample(ctx, from, sample, rnd)
+		if err != nil {
+			if ctx.Err() == nil {
+				v.log.Warn("verify failed", "err", err)
+			}
+			continue
+		}
+		verifyLastRun.WithLabelValues(v.chainID).Set(float64(rep.Finished.Unix()))
+		v.log.Info("verify done", "checked", rep.Checked, "mismatches", len(rep.Mismatches), "repaired", rep.Repaired)
+	}
+}
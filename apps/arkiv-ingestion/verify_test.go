@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	a, err := canonicalJSON([]byte(`{"b": 1, "a": {"y": [1, 2], "x": 123456789012345678901234567890}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := canonicalJSON([]byte(`{"a":{"x":123456789012345678901234567890,"y":[1,2]},"b":1}`))
+	if string(a) != string(b) || string(a) != `{"a":{"x":123456789012345678901234567890,"y":[1,2]},"b":1}` {
+		t.Fatalf("%s != %s", a, b)
+	}
+	if _, err := canonicalJSON([]byte(`{`)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// mapReader is a recordReader over a fixed set of records of one chain.
+type mapReader map[uint64]storedRecord
+
+func (m mapReader) GetBlock(ctx context.Context, chainID string, n uint64) (*storedRecord, error) {
+	if r, ok := m[n]; ok {
+		return &r, nil
+	}
+	return nil, nil
+}
+
+func (m mapReader) ListBlocks(ctx context.Context, chainID string, from, to uint64, limit int) ([]storedRecord, error) {
+	var out []storedRecord
+	for n, r := range m {
+		if n >= from && n <= to {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].BlockNumber < out[j].BlockNumber })
+	return out[:min(len(out), limit)], nil
+}
+
+func (m mapReader) Head(ctx context.Context, chainID string) (uint64, bool, error) {
+	var head uint64
+	for n := range m {
+		head = max(head, n)
+	}
+	return head, len(m) > 0, nil
+}
+
+// sourceFetcher serves fixed payloads; missing blocks are nil, errs fail.
+type sourceFetcher struct {
+	blocks map[uint64]string
+	errs   map[uint64]error
+}
+
+func (f *sourceFetcher) Head(ctx context.Context) (uint64, error) { return 0, nil }
+
+func (f *sourceFetcher) FetchBlock(ctx context.Context, n uint64) (*IngestRecord, error) {
+	if err := f.errs[n]; err != nil {
+		return nil, err
+	}
+	data, ok := f.blocks[n]
+	if !ok {
+		return nil, nil
+	}
+	return &IngestRecord{IdempotencyKey: fmt.Sprintf("v-%d", n), ChainID: "v", BlockNumber: n, Data: []byte(data)}, nil
+}
+
+type recordingOverwriter struct{ blocks []uint64 }
+
+func (o *recordingOverwriter) Overwrite(ctx context.Context, r IngestRecord) error {
+	o.blocks = append(o.blocks, r.BlockNumber)
+	return nil
+}
+
+func verifyFixture() (mapReader, *sourceFetcher) {
+	block := func(n uint64, hash, extra string) string {
+		return fmt.Sprintf(`{"number":"0x%x","hash":"%s"%s}`, n, hash, extra)
+	}
+	stored := mapReader{}
+	for n, data := range map[uint64]string{
+		0: block(0, "0x00", ""),
+		1: block(1, "0x01", `,"miner":"0xaa"`),
+		2: block(2, "0x02", ""),
+		3: block(3, "0x03", ""),
+		4: block(4, "0x04", ""),
+	} {
+		stored[n] = storedRecord{ChainID: "v", BlockNumber: n, Data: []byte(data)}
+	}
+	source := &sourceFetcher{
+		blocks: map[uint64]string{
+			0: `{"hash":"0x00","number":"0x0"}`, // same block, different key order
+			1: block(1, "0x01", `,"miner":"0xbb"`),
+			2: block(2, "0xff", ""), // reorged or corrupted
+			4: block(4, "0x04", ""),
+		},
+		errs: map[uint64]error{4: errors.New("rpc down")},
+	}
+	return stored, source
+}
+
+func TestVerifierRange(t *testing.T) {
+	stored, source := verifyFixture()
+	repairs := &recordingOverwriter{}
+	v := &verifier{chainID: "v", fetcher: source, store: stored, repair: repairs, log: discardLogger()}
+	rep, err := v.verifyRange(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Checked != 5 {
+		t.Fatalf("checked %d", rep.Checked)
+	}
+	got := map[uint64]string{}
+	for _, m := range rep.Mismatches {
+		got[m.Block] = m.Kind
+	}
+	want := map[uint64]string{2: mismatchHash, 3: mismatchSourceMissing, 4: mismatchUnverified}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("hash compare: %v, want %v", got, want)
+	}
+	if rep.Repaired != 1 || fmt.Sprint(repairs.blocks) != "[2]" {
+		t.Fatalf("repaired %d %v", rep.Repaired, repairs.blocks)
+	}
+
+	v.full, v.repair = true, nil
+	rep, _ = v.verifyRange(context.Background(), 0, 1)
+	if len(rep.Mismatches) != 1 || rep.Mismatches[0].Block != 1 || rep.Mismatches[0].Kind != mismatchContent || rep.Mismatches[0].Repaired {
+		t.Fatalf("full compare: %+v", rep.Mismatches)
+	}
+}
+
+func TestVerifierSample(t *testing.T) {
+	stored, source := verifyFixture()
+	v := &verifier{chainID: "v", fetcher: source, store: stored, log: discardLogger()}
+	rep, err := v.verifySample(context.Background(), 1, 20, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Checked != 20 {
+		t.Fatalf("checked %d", rep.Checked)
+	}
+	for _, m := range rep.Mismatches {
+		if m.Block < 1 {
+			t.Fatalf("sampled below from: %d", m.Block)
+		}
+	}
+}
+
+func TestVerifierRepairsRunOnTheWorker(t *testing.T) {
+	overwrites := make(chan overwriteRequest)
+	rewriter := &recordingOverwriter{}
+	s := &scheduler{
+		chainID:      "v",
+		fetcher:      &fakeFetcher{},
+		ingester:     &fakeBatchIngester{},
+		pollInterval: time.Hour,
+		batchSize:    1,
+		retry:        testRetryPolicy,
+		overwrites:   overwrites,
+		overwriter:   rewriter,
+		log:          discardLogger(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { s.run(ctx); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	stored, source := verifyFixture()
+	v := &verifier{chainID: "v", fetcher: source, store: stored, repair: queuedOverwriter(overwrites), log: discardLogger()}
+	rep, err := v.verifyRange(context.Background(), 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Repaired != 1 || len(rewriter.blocks) != 1 || rewriter.blocks[0] != 2 {
+		t.Errorf("repaired %d, overwrote %v; want block 2 via the worker", rep.Repaired, rewriter.blocks)
+	}
+
+}